@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// API key scopes. Each v1 endpoint requires one of them.
+const (
+	scopeUpload   = "upload"   // upload and edit files
+	scopeDownload = "download" // download files
+	scopeDelete   = "delete"   // delete files
+	scopeShare    = "share"    // manage share and upload links
+	scopeList     = "list"     // list files and read their details
+)
+
+var apiKeyScopes = []string{scopeUpload, scopeDownload, scopeDelete, scopeShare, scopeList}
+
+// apiKeyPrefix starts every generated key, so leaked keys are easy to spot.
+const apiKeyPrefix = "fip_"
+
+const maxAPIKeyNameLength = 100
+
+// apiKeyColumns is the column list scanAPIKey expects.
+const apiKeyColumns = `id, name, prefix, scopes, created_at, expires_at, last_used_at, last_used_ip, revoked_at, created_by`
+
+var (
+	errAPIKeyInvalid = errors.New("invalid API key")
+	errAPIKeyRevoked = errors.New("this API key has been revoked")
+	errAPIKeyExpired = errors.New("this API key has expired")
+)
+
+// apiKey is a row of the api_keys table. Only the SHA-256 hash of the key
+// is stored; the key itself is shown once, when it is created.
+type apiKey struct {
+	ID         int64
+	Name       string
+	Prefix     string
+	Scopes     string // comma separated
+	CreatedAt  time.Time
+	ExpiresAt  sql.NullTime
+	LastUsedAt sql.NullTime
+	LastUsedIP string
+	RevokedAt  sql.NullTime
+	CreatedBy  sql.NullInt64
+
+	// legacy marks the deprecated key set with api_key in the
+	// configuration. It is named "config", has every scope and no row in
+	// the table.
+	legacy bool
+}
+
+// APIKeyInfo describes an API key in API responses.
+type APIKeyInfo struct {
+	ID         int64      `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	LastUsedIP string     `json:"last_used_ip"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+	CreatedBy  *int64     `json:"created_by"`
+	Active     bool       `json:"active"`
+}
+
+func scanAPIKey(row rowScanner) (*apiKey, error) {
+	var k apiKey
+	err := row.Scan(&k.ID, &k.Name, &k.Prefix, &k.Scopes, &k.CreatedAt, &k.ExpiresAt, &k.LastUsedAt,
+		&k.LastUsedIP, &k.RevokedAt, &k.CreatedBy)
+	if err != nil {
+		return nil, err
+	}
+	return &k, nil
+}
+
+// check reports whether the key can still be used.
+func (k *apiKey) check() error {
+	if k.RevokedAt.Valid {
+		return errAPIKeyRevoked
+	}
+	if k.ExpiresAt.Valid && !time.Now().Before(k.ExpiresAt.Time) {
+		return errAPIKeyExpired
+	}
+	return nil
+}
+
+// hasScope reports whether the key grants the given scope.
+func (k *apiKey) hasScope(scope string) bool {
+	return slices.Contains(strings.Split(k.Scopes, ","), scope)
+}
+
+// info returns the API representation of the key.
+func (k *apiKey) info() APIKeyInfo {
+	info := APIKeyInfo{
+		ID:         k.ID,
+		Name:       k.Name,
+		Prefix:     k.Prefix,
+		Scopes:     strings.Split(k.Scopes, ","),
+		CreatedAt:  k.CreatedAt,
+		LastUsedIP: k.LastUsedIP,
+		Active:     k.check() == nil,
+	}
+	if k.ExpiresAt.Valid {
+		expiresAt := k.ExpiresAt.Time.UTC()
+		info.ExpiresAt = &expiresAt
+	}
+	if k.LastUsedAt.Valid {
+		info.LastUsedAt = &k.LastUsedAt.Time
+	}
+	if k.RevokedAt.Valid {
+		info.RevokedAt = &k.RevokedAt.Time
+	}
+	if k.CreatedBy.Valid {
+		info.CreatedBy = &k.CreatedBy.Int64
+	}
+	return info
+}
+
+// hashToken returns the hex SHA-256 hash stored for an API key or session
+// token. Both are random and long, so a fast hash is enough and keeps every
+// request cheap.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// generateAPIKey returns a new random key.
+func generateAPIKey() (string, error) {
+	bytes := make([]byte, 24)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return apiKeyPrefix + hex.EncodeToString(bytes), nil
+}
+
+// authenticateAPIKey finds the key sent with a v1 request and records that
+// it was used. The configured api_key is only honoured when it was set
+// explicitly.
+func authenticateAPIKey(db *sql.DB, r *http.Request, config AppConfig, key string) (*apiKey, error) {
+	if config.ApiKey != "" && subtle.ConstantTimeCompare([]byte(key), []byte(config.ApiKey)) == 1 {
+		return &apiKey{Name: "config", Scopes: strings.Join(apiKeyScopes, ","), legacy: true}, nil
+	}
+
+	k, err := scanAPIKey(db.QueryRow("SELECT "+apiKeyColumns+" FROM api_keys WHERE key_hash = ?", hashToken(key)))
+	if err == sql.ErrNoRows {
+		return nil, errAPIKeyInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := k.check(); err != nil {
+		return nil, err
+	}
+
+	if _, err := db.Exec("UPDATE api_keys SET last_used_at = ?, last_used_ip = ? WHERE id = ?",
+		time.Now().UTC(), clientIP(r), k.ID); err != nil {
+		log.Printf("Failed to record use of API key %d: %v", k.ID, err)
+	}
+	return k, nil
+}
+
+type apiKeyContextKey struct{}
+
+// withAPIKey returns the request with the key it was authorised with
+// attached.
+func withAPIKey(r *http.Request, k *apiKey) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, k))
+}
+
+// currentAPIKey returns the key a v1 request was authorised with, or nil for
+// web UI requests.
+func currentAPIKey(r *http.Request) *apiKey {
+	k, _ := r.Context().Value(apiKeyContextKey{}).(*apiKey)
+	return k
+}
+
+// imageHostToken returns the Auth-Token sent to the image host for a v1
+// request. The configured API key has always been passed through, so chunks
+// uploaded with it can still be deleted; named keys are never sent out.
+func imageHostToken(r *http.Request, config *AppConfig) string {
+	if k := currentAPIKey(r); k != nil && k.legacy {
+		return r.Header.Get("X-API-KEY")
+	}
+	return config.AuthToken
+}
+
+// normalizeScopes checks a list of scopes and returns it sorted and without
+// duplicates.
+func normalizeScopes(scopes []string) ([]string, error) {
+	var normalized []string
+	for _, scope := range scopes {
+		scope = strings.ToLower(strings.TrimSpace(scope))
+		if !slices.Contains(apiKeyScopes, scope) {
+			return nil, fmt.Errorf("unknown scope %q, must be one of %s", scope, strings.Join(apiKeyScopes, ", "))
+		}
+		if !slices.Contains(normalized, scope) {
+			normalized = append(normalized, scope)
+		}
+	}
+	if len(normalized) == 0 {
+		return nil, errors.New("at least one scope is required")
+	}
+	slices.Sort(normalized)
+	return normalized, nil
+}
+
+// createAPIKeyHandler creates a named API key. The key is only ever
+// returned in this response.
+func createAPIKeyHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Name      string     `json:"name"`
+			Scopes    []string   `json:"scopes"`
+			ExpiresAt *time.Time `json:"expires_at"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		req.Name = strings.TrimSpace(req.Name)
+		if req.Name == "" || len(req.Name) > maxAPIKeyNameLength {
+			http.Error(w, "Invalid name", http.StatusBadRequest)
+			return
+		}
+		scopes, err := normalizeScopes(req.Scopes)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.ExpiresAt != nil {
+			if !req.ExpiresAt.After(time.Now()) {
+				http.Error(w, "expires_at must be in the future", http.StatusBadRequest)
+				return
+			}
+			utc := req.ExpiresAt.UTC()
+			req.ExpiresAt = &utc
+		}
+
+		key, err := generateAPIKey()
+		if err != nil {
+			log.Printf("Failed to generate API key: %v", err)
+			http.Error(w, "Failed to create API key", http.StatusInternalServerError)
+			return
+		}
+		prefix := key[:len(apiKeyPrefix)+8]
+		res, err := db.Exec(`INSERT INTO api_keys (name, prefix, key_hash, scopes, expires_at, created_by)
+			VALUES (?, ?, ?, ?, ?, ?)`,
+			req.Name, prefix, hashToken(key), strings.Join(scopes, ","), req.ExpiresAt, userID(currentUser(r)))
+		if err != nil {
+			log.Printf("Failed to create API key: %v", err)
+			http.Error(w, "Failed to create API key", http.StatusInternalServerError)
+			return
+		}
+		id, _ := res.LastInsertId()
+		log.Printf("Created API key %d (%s) with scopes %s", id, req.Name, strings.Join(scopes, ","))
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"ok":     true,
+			"id":     id,
+			"key":    key,
+			"prefix": prefix,
+			"scopes": scopes,
+		})
+	}
+}
+
+// listAPIKeysHandler lists every API key, newest first, without the keys
+// themselves.
+func listAPIKeysHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rows, err := db.Query("SELECT " + apiKeyColumns + " FROM api_keys ORDER BY id DESC")
+		if err != nil {
+			log.Printf("Failed to query API keys: %v", err)
+			http.Error(w, "Failed to query API keys", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		infos := []APIKeyInfo{}
+		for rows.Next() {
+			k, err := scanAPIKey(rows)
+			if err != nil {
+				log.Printf("Failed to scan API key row: %v", err)
+				http.Error(w, "Failed to query API keys", http.StatusInternalServerError)
+				return
+			}
+			infos = append(infos, k.info())
+		}
+		if err := rows.Err(); err != nil {
+			log.Printf("Failed to read API key rows: %v", err)
+			http.Error(w, "Failed to query API keys", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"api_keys": infos})
+	}
+}
+
+// revokeAPIKeyHandler stops an API key from working. The key is kept so it
+// still shows up in the list.
+func revokeAPIKeyHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid API key ID", http.StatusBadRequest)
+			return
+		}
+
+		res, err := db.Exec("UPDATE api_keys SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL", time.Now().UTC(), id)
+		if err != nil {
+			log.Printf("Failed to revoke API key %d: %v", id, err)
+			http.Error(w, "Failed to revoke API key", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			var exists int
+			db.QueryRow("SELECT COUNT(*) FROM api_keys WHERE id = ?", id).Scan(&exists)
+			if exists == 0 {
+				http.Error(w, "API key not found", http.StatusNotFound)
+				return
+			}
+		}
+
+		log.Printf("Revoked API key %d", id)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "message": "API key revoked."})
+	}
+}
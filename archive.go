@@ -0,0 +1,259 @@
+package main
+
+import (
+	"archive/zip"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxArchiveFiles caps how many files a single archive request may contain.
+const maxArchiveFiles = 10000
+
+// archiveEntry is a file to be written into a ZIP archive.
+type archiveEntry struct {
+	FileID      int64
+	Name        string // path inside the archive
+	Modified    time.Time
+	Size        int64
+	ContentType string
+}
+
+// parseIDList parses a comma separated list of IDs.
+func parseIDList(value string) ([]int64, error) {
+	var ids []int64
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		id, err := strconv.ParseInt(part, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// archiveEntriesForFiles returns the entries for an explicit list of files,
+// all placed at the top of the archive.
+func archiveEntriesForFiles(db *sql.DB, fileIDs []int64) ([]archiveEntry, error) {
+	var entries []archiveEntry
+	for _, fileID := range fileIDs {
+		var entry archiveEntry
+		err := db.QueryRow("SELECT id, filename, upload_timestamp, filesize, content_type FROM files WHERE id = ? AND filename != ''", fileID).
+			Scan(&entry.FileID, &entry.Name, &entry.Modified, &entry.Size, &entry.ContentType)
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("%w: %d", errFileNotFound, fileID)
+		}
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// archiveEntriesForFolder returns the entries for every file in a folder and
+// its subfolders, with paths relative to that folder. A nil folderID means
+// the whole library.
+func archiveEntriesForFolder(db *sql.DB, folderID *int64) ([]archiveEntry, error) {
+	var start string
+	var args []interface{}
+	if folderID == nil {
+		start = "SELECT id, name FROM folders WHERE parent_id IS NULL"
+	} else {
+		start = "SELECT id, '' FROM folders WHERE id = ?"
+		args = append(args, *folderID)
+	}
+
+	query := `
+	WITH RECURSIVE tree(id, path) AS (
+		` + start + `
+		UNION ALL
+		SELECT folders.id, CASE WHEN tree.path = '' THEN folders.name ELSE tree.path || '/' || folders.name END
+		FROM folders JOIN tree ON folders.parent_id = tree.id
+	)
+	SELECT files.id, tree.path, files.filename, files.upload_timestamp, files.filesize, files.content_type
+	FROM files JOIN tree ON files.folder_id = tree.id
+	WHERE files.filename != ''`
+	if folderID == nil {
+		query += `
+	UNION ALL
+	SELECT id, '', filename, upload_timestamp, filesize, content_type FROM files WHERE folder_id IS NULL AND filename != ''`
+	}
+	query += " ORDER BY 2, 3"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []archiveEntry
+	for rows.Next() {
+		var entry archiveEntry
+		var dir, filename string
+		if err := rows.Scan(&entry.FileID, &dir, &filename, &entry.Modified, &entry.Size, &entry.ContentType); err != nil {
+			return nil, err
+		}
+		entry.Name = path.Join(dir, filename)
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// cleanArchiveName turns a path built from stored names into one that stays
+// inside the directory the archive is extracted to, whatever the names
+// contain: backslashes become slashes, and leading "/" and "../" are
+// dropped.
+func cleanArchiveName(name string) string {
+	name = strings.TrimPrefix(path.Clean("/"+strings.ReplaceAll(name, "\\", "/")), "/")
+	if name == "" {
+		return "file"
+	}
+	return name
+}
+
+// uniqueArchiveNames cleans the paths of the entries with cleanArchiveName
+// and renames entries that would otherwise share a path, by adding " (2)",
+// " (3)", ... before the extension.
+func uniqueArchiveNames(entries []archiveEntry) {
+	used := make(map[string]bool)
+	for i := range entries {
+		name := cleanArchiveName(entries[i].Name)
+		ext := path.Ext(name)
+		base := strings.TrimSuffix(name, ext)
+		for n := 2; used[name]; n++ {
+			name = fmt.Sprintf("%s (%d)%s", base, n, ext)
+		}
+		used[name] = true
+		entries[i].Name = name
+	}
+}
+
+// writeArchive streams the entries into a ZIP archive. Files are stored
+// without compression: they are streamed as they are downloaded, and most
+// large files are already compressed.
+func writeArchive(w io.Writer, client *http.Client, db *sql.DB, entries []archiveEntry) error {
+	zw := zip.NewWriter(w)
+	for _, entry := range entries {
+		fw, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     entry.Name,
+			Method:   zip.Store,
+			Modified: entry.Modified,
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := writeFileChunks(fw, client, db, entry.FileID); err != nil {
+			return fmt.Errorf("file ID %d: %w", entry.FileID, err)
+		}
+	}
+	return zw.Close()
+}
+
+// archiveHandler streams a ZIP archive of the files given in the ids query
+// parameter, or of a whole folder given by folder_id ("root" for everything).
+func archiveHandler(db *sql.DB) http.HandlerFunc {
+	client := &http.Client{}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var entries []archiveEntry
+		var err error
+		archiveName := "files.zip"
+
+		if ids := r.URL.Query().Get("ids"); ids != "" {
+			fileIDs, perr := parseIDList(ids)
+			if perr != nil || len(fileIDs) == 0 {
+				http.Error(w, "Invalid file IDs", http.StatusBadRequest)
+				return
+			}
+			if len(fileIDs) > maxArchiveFiles {
+				http.Error(w, "Too many files", http.StatusBadRequest)
+				return
+			}
+			entries, err = archiveEntriesForFiles(db, fileIDs)
+			if errors.Is(err, errFileNotFound) {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+		} else if folderParam, ok := r.URL.Query()["folder_id"]; ok {
+			folderID, perr := parseFolderParam(folderParam[0])
+			if perr != nil {
+				http.Error(w, "Invalid folder ID", http.StatusBadRequest)
+				return
+			}
+			if folderID != nil {
+				var name string
+				if err := db.QueryRow("SELECT name FROM folders WHERE id = ?", *folderID).Scan(&name); err != nil {
+					if err == sql.ErrNoRows {
+						http.Error(w, "Folder not found", http.StatusNotFound)
+						return
+					}
+					log.Printf("Failed to query folder %d: %v", *folderID, err)
+					http.Error(w, "Failed to query folder", http.StatusInternalServerError)
+					return
+				}
+				archiveName = name + ".zip"
+			}
+			entries, err = archiveEntriesForFolder(db, folderID)
+		} else {
+			http.Error(w, "Either ids or folder_id is required", http.StatusBadRequest)
+			return
+		}
+
+		if err != nil {
+			log.Printf("Failed to collect archive entries: %v", err)
+			http.Error(w, "Failed to query files", http.StatusInternalServerError)
+			return
+		}
+		if len(entries) == 0 {
+			http.Error(w, "No files to download", http.StatusNotFound)
+			return
+		}
+		if len(entries) > maxArchiveFiles {
+			http.Error(w, "Too many files", http.StatusBadRequest)
+			return
+		}
+		uniqueArchiveNames(entries)
+		serveArchive(w, client, db, archiveName, entries)
+	}
+}
+
+// serveArchive sends entries as a ZIP download named archiveName. It returns
+// the number of bytes sent and the error that stopped the stream.
+func serveArchive(w http.ResponseWriter, client *http.Client, db *sql.DB, archiveName string, entries []archiveEntry) (int64, error) {
+	w.Header().Set("Content-Disposition", contentDisposition("attachment", archiveName))
+	w.Header().Set("Content-Type", "application/zip")
+
+	log.Printf("Streaming archive of %d files", len(entries))
+	cw := &countingWriter{w: w}
+	// Headers are already sent, so a failure can only cut the archive short.
+	if err := writeArchive(cw, client, db, entries); err != nil {
+		log.Printf("Error: Failed to stream archive: %v", err)
+		return cw.n, err
+	}
+	log.Printf("Finished streaming archive of %d files", len(entries))
+	return cw.n, nil
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,41 @@
+package main
+
+import "testing"
+
+func TestCleanArchiveName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"photo.jpg", "photo.jpg"},
+		{"a/b/photo.jpg", "a/b/photo.jpg"},
+		{"/etc/passwd", "etc/passwd"},
+		{"../../evil.sh", "evil.sh"},
+		{"a/../../evil.sh", "evil.sh"},
+		{"../a/./b/../c.txt", "a/c.txt"},
+		{`..\..\evil.exe`, "evil.exe"},
+		{"..", "file"},
+		{"", "file"},
+	}
+	for _, tt := range tests {
+		if got := cleanArchiveName(tt.name); got != tt.want {
+			t.Errorf("cleanArchiveName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestUniqueArchiveNames(t *testing.T) {
+	entries := []archiveEntry{
+		{Name: "a.txt"},
+		{Name: "../a.txt"},
+		{Name: "/a.txt"},
+		{Name: "dir/b"},
+	}
+	uniqueArchiveNames(entries)
+	want := []string{"a.txt", "a (2).txt", "a (3).txt", "dir/b"}
+	for i, entry := range entries {
+		if entry.Name != want[i] {
+			t.Errorf("entry %d = %q, want %q", i, entry.Name, want[i])
+		}
+	}
+}
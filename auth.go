@@ -1,93 +1,101 @@
 package main
 
 import (
+	"database/sql"
 	"encoding/json"
+	"fmt"
+	"log"
 	"net/http"
-	"sync"
+	"strings"
 	"time"
-
-	"github.com/google/uuid"
 )
 
-// sessionManager holds the sessions map and a mutex for concurrent access.
-type sessionManager struct {
-	sessions map[string]time.Time
-	mu       sync.RWMutex
-}
-
-// Global session manager
-var manager = &sessionManager{
-	sessions: make(map[string]time.Time),
-}
-
-// init starts a background goroutine to clean up expired sessions periodically.
-func init() {
-	go manager.cleanupSessions()
-}
-
-// Store adds a new session token to the manager.
-func (m *sessionManager) Store(token string, expiry time.Time) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	m.sessions[token] = expiry
-}
-
-// Load retrieves a session's expiry time.
-func (m *sessionManager) Load(token string) (time.Time, bool) {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-	expiry, exists := m.sessions[token]
-	return expiry, exists
-}
-
-// Delete removes a session token from the manager.
-func (m *sessionManager) Delete(token string) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	delete(m.sessions, token)
-}
-
-// cleanupSessions iterates through the sessions and removes expired ones.
-func (m *sessionManager) cleanupSessions() {
-	ticker := time.NewTicker(1 * time.Hour)
-	defer ticker.Stop()
-
-	for range ticker.C {
-		m.mu.Lock()
-		for token, expiry := range m.sessions {
-			if time.Now().After(expiry) {
-				delete(m.sessions, token)
-			}
-		}
-		m.mu.Unlock()
-	}
-}
-
-func loginHandler(config AppConfig) http.HandlerFunc {
+// loginHandler logs a user in with their username and password. Logins
+// without a username are for "admin", as before there were user accounts.
+// Users with two-factor authentication also send a TOTP or recovery code;
+// without one the login is refused with "Two-factor code required", so the
+// login page knows to ask for it. Repeated failures lock the client out for
+// a while.
+func loginHandler(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var creds struct {
+			Username string `json:"username"`
 			Password string `json:"password"`
+			Code     string `json:"code"`
 		}
 		if err := json.NewDecoder(r.Body).Decode(&creds); err != nil {
 			http.Error(w, "Invalid request", http.StatusBadRequest)
 			return
 		}
+		if creds.Username == "" {
+			creds.Username = "admin"
+		}
 
-		if creds.Password != config.Password {
+		username := strings.TrimSpace(creds.Username)
+		attempt, ok := beginLoginAttempt(w, r, username)
+		if !ok {
+			return
+		}
+		user, ok := authenticateUser(db, username, creds.Password)
+		if !ok {
+			attempt.fail("")
 			http.Error(w, "Invalid password", http.StatusUnauthorized)
 			return
 		}
+		if user.TOTPEnabled {
+			if err := checkSecondFactor(db, user.ID, creds.Code); err != nil {
+				finishSecondFactorAttempt(attempt, err)
+				writeSecondFactorError(w, err)
+				return
+			}
+		}
+		attempt.succeed()
+
+		sessionToken, expiry, err := manager.Create(user, r)
+		if err != nil {
+			log.Printf("Failed to create session for user %q: %v", user.Username, err)
+			http.Error(w, "Failed to log in", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("User %q logged in", user.Username)
 
-		sessionToken := uuid.NewString()
-		expiry := time.Now().Add(24 * time.Hour)
-		manager.Store(sessionToken, expiry)
+		setSessionCookie(w, sessionToken, expiry)
+	}
+}
+
+// setSessionCookie gives the browser a new session.
+func setSessionCookie(w http.ResponseWriter, sessionToken string, expiry time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     "session_token",
+		Value:    sessionToken,
+		Expires:  expiry,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
 
-		http.SetCookie(w, &http.Cookie{
-			Name:    "session_token",
-			Value:   sessionToken,
-			Expires: expiry,
-			Path:    "/",
-		})
+// beginLoginAttempt starts an attempt by the client of r to prove it knows
+// the password or two-factor code of the account username, for a login or
+// to confirm a change. It writes 429 and returns false if the client has to
+// wait first.
+func beginLoginAttempt(w http.ResponseWriter, r *http.Request, username string) (*passwordAttempt, bool) {
+	attempt, wait := loginAttempts.begin(clientIP(r), fmt.Sprintf("user %q", strings.ToLower(username)))
+	if attempt == nil {
+		writeTooManyAttempts(w, wait)
+		return nil, false
+	}
+	return attempt, true
+}
+
+// finishSecondFactorAttempt records the outcome of a failed
+// checkSecondFactor. A missing code is the first step of a normal login,
+// not a failed guess.
+func finishSecondFactorAttempt(attempt *passwordAttempt, err error) {
+	if err == errTOTPInvalid {
+		attempt.fail("two-factor code")
+	} else {
+		attempt.cancel()
 	}
 }
 
@@ -103,34 +111,50 @@ func authMiddleware(next http.Handler) http.Handler {
 			return
 		}
 
-		sessionToken := c.Value
-		expiry, exists := manager.Load(sessionToken)
-
-		if !exists || expiry.Before(time.Now()) {
-			if exists {
-				manager.Delete(sessionToken)
-			}
+		s, err := manager.Load(c.Value)
+		if err == errSessionNotFound {
 			http.Redirect(w, r, "/login.html", http.StatusFound)
 			return
 		}
+		if err != nil {
+			log.Printf("Failed to load session: %v", err)
+			http.Error(w, "Failed to load session", http.StatusInternalServerError)
+			return
+		}
 
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(w, withSession(r, s))
 	})
 }
 
-func apiAuthMiddleware(next http.Handler, config AppConfig) http.Handler {
+// apiAuthMiddleware authorises v1 API requests by their X-API-KEY header.
+// The key must grant scope; an empty scope accepts any valid key.
+func apiAuthMiddleware(next http.Handler, db *sql.DB, config AppConfig, scope string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		apiKey := r.Header.Get("X-API-KEY")
 		if apiKey == "" {
-			http.Error(w, "API key is required", http.StatusUnauthorized)
+			jsonError(w, "API key is required", http.StatusUnauthorized)
 			return
 		}
 
-		if apiKey != config.ApiKey {
-			http.Error(w, "Invalid API key", http.StatusUnauthorized)
+		k, err := authenticateAPIKey(db, r, config, apiKey)
+		switch err {
+		case nil:
+		case errAPIKeyInvalid:
+			jsonError(w, "Invalid API key", http.StatusUnauthorized)
+			return
+		case errAPIKeyRevoked, errAPIKeyExpired:
+			jsonError(w, err.Error(), http.StatusUnauthorized)
+			return
+		default:
+			log.Printf("Failed to check API key: %v", err)
+			jsonError(w, "Failed to check API key", http.StatusInternalServerError)
+			return
+		}
+		if scope != "" && !k.hasScope(scope) {
+			jsonError(w, fmt.Sprintf("API key does not have the %s scope", scope), http.StatusForbidden)
 			return
 		}
 
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(w, withAPIKey(r, k))
 	})
 }
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// maxBulkFiles caps how many files a single bulk job may touch.
+	maxBulkFiles = 10000
+	// Finished jobs are kept this long so their results can still be read.
+	bulkJobRetention = 1 * time.Hour
+)
+
+// BulkResult is the outcome of a bulk action on one file.
+type BulkResult struct {
+	FileID    int64  `json:"file_id"`
+	OK        bool   `json:"ok"`
+	Error     string `json:"error,omitempty"`
+	ShareLink string `json:"share_link,omitempty"`
+}
+
+// BulkJob tracks a bulk operation running in the background.
+type BulkJob struct {
+	ID         string       `json:"id"`
+	Action     string       `json:"action"`
+	Status     string       `json:"status"` // "running" or "completed"
+	Total      int          `json:"total"`
+	Succeeded  int          `json:"succeeded"`
+	Failed     int          `json:"failed"`
+	Results    []BulkResult `json:"results"`
+	CreatedAt  time.Time    `json:"created_at"`
+	FinishedAt *time.Time   `json:"finished_at,omitempty"`
+
+	// owner is the bulkJobOwner of the request that started the job.
+	owner string
+}
+
+// bulkJobOwner identifies the user or API key behind a request. A job can
+// only be read by whoever started it, since its results may hold share links.
+func bulkJobOwner(r *http.Request) string {
+	if k := currentAPIKey(r); k != nil {
+		if k.legacy {
+			return "api key " + k.Name
+		}
+		return fmt.Sprintf("api key %d", k.ID)
+	}
+	if user := currentUser(r); user != nil {
+		return fmt.Sprintf("user %d", user.ID)
+	}
+	return ""
+}
+
+// bulkJobManager holds the jobs map and a mutex for concurrent access.
+type bulkJobManager struct {
+	jobs map[string]*BulkJob
+	mu   sync.RWMutex
+}
+
+// Global bulk job manager
+var bulkJobs = &bulkJobManager{
+	jobs: make(map[string]*BulkJob),
+}
+
+// init starts a background goroutine to clean up finished jobs periodically.
+func init() {
+	go bulkJobs.cleanupJobs()
+}
+
+// Load returns a copy of a job, safe to read while the job keeps running.
+func (m *bulkJobManager) Load(id string) (BulkJob, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	job, exists := m.jobs[id]
+	if !exists {
+		return BulkJob{}, false
+	}
+	snapshot := *job
+	snapshot.Results = append([]BulkResult{}, job.Results...)
+	return snapshot, true
+}
+
+// Store adds a new job to the manager.
+func (m *bulkJobManager) Store(job *BulkJob) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.jobs[job.ID] = job
+}
+
+// record adds the result for one file to a job.
+func (m *bulkJobManager) record(job *BulkJob, result BulkResult) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job.Results = append(job.Results, result)
+	if result.OK {
+		job.Succeeded++
+	} else {
+		job.Failed++
+	}
+}
+
+// finish marks a job as completed.
+func (m *bulkJobManager) finish(job *BulkJob) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	job.Status = "completed"
+	job.FinishedAt = &now
+}
+
+// cleanupJobs removes jobs that finished more than bulkJobRetention ago.
+func (m *bulkJobManager) cleanupJobs() {
+	ticker := time.NewTicker(10 * time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		m.mu.Lock()
+		for id, job := range m.jobs {
+			if job.FinishedAt != nil && time.Since(*job.FinishedAt) > bulkJobRetention {
+				delete(m.jobs, id)
+			}
+		}
+		m.mu.Unlock()
+	}
+}
+
+// bulkActionScopes is the API key scope each bulk action requires.
+var bulkActionScopes = map[string]string{
+	"delete": scopeDelete,
+	"move":   scopeUpload,
+	"tag":    scopeUpload,
+	"untag":  scopeUpload,
+	"share":  scopeShare,
+}
+
+// bulkRequest is the body of a bulk operation request. Files are selected
+// either by ID or with the same filter parameters GET /api/files accepts.
+type bulkRequest struct {
+	Action       string                 `json:"action"` // delete, move, tag, untag or share
+	FileIDs      []int64                `json:"file_ids"`
+	Filter       map[string]interface{} `json:"filter"`
+	FolderID     *int64                 `json:"folder_id"` // move
+	Tags         []string               `json:"tags"`      // tag, untag
+	shareOptions                        // share
+
+	// user is the logged in user, nil for v1 API requests.
+	user *User
+	// key is set for v1 API requests, which may not delete web uploads.
+	key *apiKey
+	// authToken is sent to the image host when deleting chunks.
+	authToken string
+}
+
+// filterValues converts a JSON filter object into list query parameters.
+// Arrays become repeated parameters, everything else a single value.
+func filterValues(filter map[string]interface{}) url.Values {
+	values := url.Values{}
+	for key, value := range filter {
+		switch v := value.(type) {
+		case []interface{}:
+			for _, item := range v {
+				values.Add(key, fmt.Sprint(item))
+			}
+		case nil:
+			values.Set(key, "")
+		default:
+			values.Set(key, fmt.Sprint(v))
+		}
+	}
+	return values
+}
+
+// resolveBulkFileIDs returns the IDs of every file matching a list filter.
+func resolveBulkFileIDs(db *sql.DB, filter map[string]interface{}, user *User) ([]int64, error) {
+	params := filterValues(filter)
+	if err := resolveOwnerParam(params, user); err != nil {
+		return nil, err
+	}
+	params.Del("cursor")
+	params.Set("limit", fmt.Sprint(maxFileListLimit))
+
+	var ids []int64
+	for {
+		query, err := parseFileListQuery(params)
+		if err != nil {
+			return nil, err
+		}
+		page, err := query.run(db)
+		if err != nil {
+			return nil, err
+		}
+		if page.Total > maxBulkFiles {
+			return nil, fmt.Errorf("filter matches %d files, more than the limit of %d", page.Total, maxBulkFiles)
+		}
+		for _, file := range page.Files {
+			ids = append(ids, file.ID)
+		}
+		if page.NextCursor == "" {
+			return ids, nil
+		}
+		params.Set("cursor", page.NextCursor)
+	}
+}
+
+// bulkAction applies the requested action to a single file.
+type bulkAction func(fileID int64) (BulkResult, error)
+
+// newBulkAction validates a request and returns the function that carries
+// out its action on each file.
+func newBulkAction(db *sql.DB, config *AppConfig, req *bulkRequest) (bulkAction, error) {
+	switch req.Action {
+	case "delete":
+		return func(fileID int64) (BulkResult, error) {
+			if req.key != nil {
+				if err := checkAPIDeletable(db, fileID); err != nil {
+					return BulkResult{}, err
+				}
+			}
+			return BulkResult{}, deleteFile(db, fileID, req.authToken)
+		}, nil
+
+	case "move":
+		if err := checkFolderExists(db, req.FolderID); err != nil {
+			return nil, err
+		}
+		return func(fileID int64) (BulkResult, error) {
+			return BulkResult{}, updateFileRow(db, "UPDATE files SET folder_id = ? WHERE id = ?", req.FolderID, fileID)
+		}, nil
+
+	case "tag", "untag":
+		tags, err := normalizeTags(req.Tags)
+		if err != nil {
+			return nil, err
+		}
+		if len(tags) == 0 {
+			return nil, errors.New("tags are required")
+		}
+		query := "INSERT OR IGNORE INTO file_tags (file_id, tag) SELECT id, ? FROM files WHERE id = ?"
+		if req.Action == "untag" {
+			query = "DELETE FROM file_tags WHERE tag = ? AND file_id = ?"
+		}
+		return func(fileID int64) (BulkResult, error) {
+			if err := checkFileExists(db, fileID); err != nil {
+				return BulkResult{}, err
+			}
+			for _, tag := range tags {
+				if _, err := db.Exec(query, tag, fileID); err != nil {
+					return BulkResult{}, err
+				}
+			}
+			return BulkResult{}, nil
+		}, nil
+
+	case "share":
+		if err := req.shareOptions.validate(); err != nil {
+			return nil, err
+		}
+		passwordHash, err := hashSharePassword(req.Password)
+		if err != nil {
+			return nil, err
+		}
+		req.passwordHash = passwordHash
+		return func(fileID int64) (BulkResult, error) {
+			if err := checkFileExists(db, fileID); err != nil {
+				return BulkResult{}, err
+			}
+			if req.BurnAfterDownload == shareBurnFile {
+				if err := checkBurnAccess(db, req.user, req.key, fileID); err != nil {
+					return BulkResult{}, err
+				}
+			}
+			_, token, err := createShare(db, shareTarget{FileID: &fileID}, req.shareOptions)
+			if err != nil {
+				return BulkResult{}, err
+			}
+			return BulkResult{ShareLink: shareLink(config, token)}, nil
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown action %q", req.Action)
+}
+
+// checkFileExists returns errFileNotFound unless fileID names a file.
+func checkFileExists(db *sql.DB, fileID int64) error {
+	var exists int
+	if err := db.QueryRow("SELECT COUNT(*) FROM files WHERE id = ? AND filename != ''", fileID).Scan(&exists); err != nil {
+		return err
+	}
+	if exists == 0 {
+		return errFileNotFound
+	}
+	return nil
+}
+
+// updateFileRow runs an UPDATE on a single file and returns errFileNotFound
+// if no row was changed.
+func updateFileRow(db *sql.DB, query string, args ...interface{}) error {
+	res, err := db.Exec(query, args...)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errFileNotFound
+	}
+	return nil
+}
+
+// ownFilesOnly wraps an action so that it fails for files the user may not
+// change.
+func ownFilesOnly(db *sql.DB, user *User, action bulkAction) bulkAction {
+	return func(fileID int64) (BulkResult, error) {
+		if err := checkFileAccess(db, user, fileID); err != nil {
+			return BulkResult{}, err
+		}
+		return action(fileID)
+	}
+}
+
+// runBulkJob applies action to every file in turn, recording each outcome.
+func runBulkJob(job *BulkJob, fileIDs []int64, action bulkAction) {
+	for _, fileID := range fileIDs {
+		result, err := action(fileID)
+		result.FileID = fileID
+		result.OK = err == nil
+		if err != nil {
+			result.Error = err.Error()
+			log.Printf("Bulk %s failed for file ID %d: %v", job.Action, fileID, err)
+		}
+		bulkJobs.record(job, result)
+	}
+	bulkJobs.finish(job)
+	log.Printf("Bulk job %s (%s) finished: %d succeeded, %d failed", job.ID, job.Action, job.Succeeded, job.Failed)
+}
+
+// bulkHandler starts a bulk operation and responds with the job to poll.
+func bulkHandler(db *sql.DB, config *AppConfig, fail errorWriter, statusPath string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req bulkRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			fail(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		// The scope is checked before newBulkAction does any work, such as
+		// hashing a share password.
+		scope, ok := bulkActionScopes[req.Action]
+		if !ok {
+			fail(w, fmt.Sprintf("unknown action %q", req.Action), http.StatusBadRequest)
+			return
+		}
+		if req.key = currentAPIKey(r); req.key != nil {
+			if !req.key.hasScope(scope) {
+				fail(w, fmt.Sprintf("API key does not have the %s scope", scope), http.StatusForbidden)
+				return
+			}
+			req.authToken = imageHostToken(r, config)
+		}
+		user := currentUser(r)
+		req.user = user
+		req.createdBy = userID(user)
+
+		action, err := newBulkAction(db, config, &req)
+		if err != nil {
+			if err == errFolderNotFound {
+				fail(w, "Folder not found", http.StatusNotFound)
+				return
+			}
+			fail(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// Any file may be shared, but only its owner may change it. Shares
+		// that delete the file after its download check ownership per file.
+		if req.Action != "share" {
+			action = ownFilesOnly(db, user, action)
+		}
+
+		fileIDs := req.FileIDs
+		if len(fileIDs) == 0 && req.Filter != nil {
+			fileIDs, err = resolveBulkFileIDs(db, req.Filter, user)
+			if err != nil {
+				fail(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if len(fileIDs) == 0 {
+			fail(w, "No files selected", http.StatusBadRequest)
+			return
+		}
+		if len(fileIDs) > maxBulkFiles {
+			fail(w, fmt.Sprintf("At most %d files can be processed at once", maxBulkFiles), http.StatusBadRequest)
+			return
+		}
+
+		job := &BulkJob{
+			ID:        uuid.NewString(),
+			Action:    req.Action,
+			Status:    "running",
+			Total:     len(fileIDs),
+			Results:   []BulkResult{},
+			CreatedAt: time.Now(),
+			owner:     bulkJobOwner(r),
+		}
+		bulkJobs.Store(job)
+		go runBulkJob(job, fileIDs, action)
+
+		log.Printf("Started bulk job %s: %s on %d files", job.ID, job.Action, job.Total)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"ok":         true,
+			"job_id":     job.ID,
+			"total":      job.Total,
+			"status_url": statusPath + job.ID,
+		})
+	}
+}
+
+// bulkJobHandler reports the progress and per-file results of a bulk job to
+// the user or API key that started it. Other callers get 404.
+func bulkJobHandler(fail errorWriter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		job, exists := bulkJobs.Load(r.PathValue("id"))
+		if !exists || job.owner != bulkJobOwner(r) {
+			fail(w, "Job not found", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(job)
+	}
+}
@@ -2,14 +2,21 @@ package main
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"image"
 	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
 	"image/png"
 	"log"
 
+	_ "golang.org/x/image/bmp"
+	"golang.org/x/image/draw"
 	"golang.org/x/image/font"
 	"golang.org/x/image/font/basicfont"
 	"golang.org/x/image/math/fixed"
+	_ "golang.org/x/image/webp"
 )
 
 const (
@@ -18,6 +25,92 @@ const (
 	carrierPadding = 20 * 1024 // 20KB
 )
 
+// thumbnailCarrierSizes are the bounding boxes tried, largest first, until the
+// encoded thumbnail fits inside the carrier padding.
+var thumbnailCarrierSizes = []int{256, 200, 160, 128, 96, 64}
+
+var errThumbnailTooLarge = errors.New("thumbnail does not fit in carrier")
+
+// createChunkCarrier builds the carrier for a chunk. For the first chunk of an
+// image file the carrier is a thumbnail of the image itself, so the uploaded
+// chunk doubles as a preview. The returned bool reports whether that happened.
+func createChunkCarrier(filename string, chunkData []byte, index, total int) ([]byte, bool, error) {
+	if index == 0 {
+		carrierData, err := createThumbnailCarrierPNG(chunkData)
+		if err == nil {
+			return carrierData, true, nil
+		}
+	}
+
+	carrierText := fmt.Sprintf("%s - %d/%d", filename, index+1, total)
+	carrierData, err := createCarrierPNG(carrierText)
+	return carrierData, false, err
+}
+
+// createThumbnailCarrierPNG decodes an image from data and returns a padded PNG
+// thumbnail of it. The image must be fully contained in data, so only images
+// that fit in the first chunk get a thumbnail carrier.
+func createThumbnailCarrierPNG(data []byte) ([]byte, error) {
+	// Check the declared size first: a tiny file can claim dimensions that
+	// would take gigabytes to decode.
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Width*cfg.Height > maxThumbnailSourcePixels {
+		return nil, fmt.Errorf("image is too large for a thumbnail: %dx%d", cfg.Width, cfg.Height)
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, size := range thumbnailCarrierSizes {
+		thumb := resizeToFit(src, size, size)
+
+		buf := new(bytes.Buffer)
+		encoder := png.Encoder{CompressionLevel: png.BestCompression}
+		if err := encoder.Encode(buf, thumb); err != nil {
+			return nil, err
+		}
+		if buf.Len() <= carrierPadding {
+			return padCarrier(buf.Bytes()), nil
+		}
+	}
+
+	return nil, errThumbnailTooLarge
+}
+
+// resizeToFit scales src down so that it fits within maxWidth x maxHeight while
+// keeping its aspect ratio. Images that already fit are copied unscaled.
+func resizeToFit(src image.Image, maxWidth, maxHeight int) image.Image {
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width > maxWidth || height > maxHeight {
+		if width*maxHeight > height*maxWidth {
+			height = max(1, height*maxWidth/width)
+			width = maxWidth
+		} else {
+			width = max(1, width*maxHeight/height)
+			height = maxHeight
+		}
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, bounds, draw.Over, nil)
+	return dst
+}
+
+// padCarrier pads carrier data with zero bytes up to carrierPadding.
+func padCarrier(data []byte) []byte {
+	if len(data) < carrierPadding {
+		padding := make([]byte, carrierPadding-len(data))
+		data = append(data, padding...)
+	}
+	return data
+}
+
 func createCarrierPNG(text string) ([]byte, error) {
 	img := image.NewRGBA(image.Rect(0, 0, carrierWidth, carrierHeight))
 	bgColor := color.RGBA{R: 240, G: 240, B: 240, A: 255}
@@ -48,11 +141,5 @@ func createCarrierPNG(text string) ([]byte, error) {
 	}
 
 	// Pad to 20KB
-	pngData := buf.Bytes()
-	if len(pngData) < carrierPadding {
-		padding := make([]byte, carrierPadding-len(pngData))
-		pngData = append(pngData, padding...)
-	}
-
-	return pngData, nil
+	return padCarrier(buf.Bytes()), nil
 }
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+const defaultContentType = "application/octet-stream"
+
+// inlineContentTypes are the media types that are safe to render directly in
+// the browser. Anything else (notably HTML and SVG, which can run scripts on
+// our origin) is always served as an attachment.
+var inlineContentTypes = []string{
+	"image/png",
+	"image/jpeg",
+	"image/gif",
+	"image/webp",
+	"image/bmp",
+	"image/avif",
+	"application/pdf",
+	"audio/",
+	"video/",
+	"text/plain",
+}
+
+// detectContentType works out the media type of a file from its name and the
+// first bytes of its content. Sniffing wins unless it only produced a generic
+// type and the extension is more specific (e.g. .docx sniffs as a zip archive).
+func detectContentType(filename string, data []byte) string {
+	extType := mime.TypeByExtension(strings.ToLower(filepath.Ext(filename)))
+
+	sniffed := http.DetectContentType(data)
+	if extType != "" && isGenericContentType(sniffed) {
+		return extType
+	}
+	return sniffed
+}
+
+func isGenericContentType(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case defaultContentType, "text/plain", "application/zip":
+		return true
+	}
+	return false
+}
+
+// isInlineContentType reports whether contentType may be served with an
+// inline Content-Disposition.
+func isInlineContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, t := range inlineContentTypes {
+		if mediaType == t || (strings.HasSuffix(t, "/") && strings.HasPrefix(mediaType, t)) {
+			return true
+		}
+	}
+	return false
+}
+
+// contentDisposition formats a Content-Disposition header value, encoding
+// non-ASCII filenames as RFC 2231 requires.
+func contentDisposition(disposition, filename string) string {
+	if v := mime.FormatMediaType(disposition, map[string]string{"filename": filename}); v != "" {
+		return v
+	}
+	return disposition
+}
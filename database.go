@@ -2,11 +2,35 @@ package main
 
 import (
 	"database/sql"
+	"fmt"
 	"log"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
+// sharesSchema defines the shares table. A share links to a single file
+// (file_id), a folder (folder_id) or a collection listed in share_files,
+// as given by kind.
+const sharesSchema = `(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	token TEXT NOT NULL UNIQUE,
+	kind TEXT NOT NULL DEFAULT 'file',
+	file_id INTEGER,
+	folder_id INTEGER,
+	label TEXT NOT NULL DEFAULT '',
+	password TEXT NOT NULL DEFAULT '',
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	expires_at DATETIME,
+	max_downloads INTEGER,
+	download_count INTEGER NOT NULL DEFAULT 0,
+	revoked_at DATETIME,
+	burn TEXT NOT NULL DEFAULT '',
+	allowed_ips TEXT NOT NULL DEFAULT '',
+	created_by INTEGER,
+	FOREIGN KEY(file_id) REFERENCES files(id),
+	FOREIGN KEY(folder_id) REFERENCES folders(id)
+)`
+
 func initDB(filepath string) *sql.DB {
 	db, err := sql.Open("sqlite3", filepath)
 	if err != nil {
@@ -43,5 +67,340 @@ func initDB(filepath string) *sql.DB {
 		log.Fatalf("Failed to create chunks table: %v", err)
 	}
 
+	// Create folders table
+	foldersTable := `
+	CREATE TABLE IF NOT EXISTS folders (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		parent_id INTEGER,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY(parent_id) REFERENCES folders(id)
+	);`
+	_, err = db.Exec(foldersTable)
+	if err != nil {
+		log.Fatalf("Failed to create folders table: %v", err)
+	}
+
+	// Create file_tags table
+	fileTagsTable := `
+	CREATE TABLE IF NOT EXISTS file_tags (
+		file_id INTEGER NOT NULL,
+		tag TEXT NOT NULL,
+		PRIMARY KEY(file_id, tag),
+		FOREIGN KEY(file_id) REFERENCES files(id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_file_tags_tag ON file_tags(tag);`
+	_, err = db.Exec(fileTagsTable)
+	if err != nil {
+		log.Fatalf("Failed to create file_tags table: %v", err)
+	}
+
+	// Create file_metadata table
+	fileMetadataTable := `
+	CREATE TABLE IF NOT EXISTS file_metadata (
+		file_id INTEGER NOT NULL,
+		key TEXT NOT NULL,
+		value TEXT NOT NULL,
+		PRIMARY KEY(file_id, key),
+		FOREIGN KEY(file_id) REFERENCES files(id)
+	);`
+	_, err = db.Exec(fileMetadataTable)
+	if err != nil {
+		log.Fatalf("Failed to create file_metadata table: %v", err)
+	}
+
+	// Create shares table
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS shares " + sharesSchema)
+	if err != nil {
+		log.Fatalf("Failed to create shares table: %v", err)
+	}
+	ensureColumn(db, "shares", "kind", "TEXT NOT NULL DEFAULT 'file'")
+	ensureColumn(db, "shares", "folder_id", "INTEGER REFERENCES folders(id)")
+	relaxSharesFileID(db)
+	ensureColumn(db, "shares", "burn", "TEXT NOT NULL DEFAULT ''")
+	ensureColumn(db, "shares", "allowed_ips", "TEXT NOT NULL DEFAULT ''")
+	ensureColumn(db, "shares", "created_by", "INTEGER REFERENCES users(id)")
+	_, err = db.Exec("CREATE INDEX IF NOT EXISTS idx_shares_file_id ON shares(file_id)")
+	if err != nil {
+		log.Fatalf("Failed to create shares index: %v", err)
+	}
+
+	// Create share_files table, listing the files of collection shares
+	shareFilesTable := `
+	CREATE TABLE IF NOT EXISTS share_files (
+		share_id INTEGER NOT NULL,
+		file_id INTEGER NOT NULL,
+		PRIMARY KEY(share_id, file_id),
+		FOREIGN KEY(share_id) REFERENCES shares(id),
+		FOREIGN KEY(file_id) REFERENCES files(id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_share_files_file_id ON share_files(file_id);`
+	_, err = db.Exec(shareFilesTable)
+	if err != nil {
+		log.Fatalf("Failed to create share_files table: %v", err)
+	}
+
+	// Create share_access table, logging every visit to a share link
+	shareAccessTable := `
+	CREATE TABLE IF NOT EXISTS share_access (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		share_id INTEGER NOT NULL,
+		file_id INTEGER,
+		action TEXT NOT NULL,
+		accessed_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		ip TEXT NOT NULL DEFAULT '',
+		user_agent TEXT NOT NULL DEFAULT '',
+		bytes INTEGER NOT NULL DEFAULT 0,
+		completed INTEGER NOT NULL DEFAULT 1,
+		FOREIGN KEY(share_id) REFERENCES shares(id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_share_access_share_id ON share_access(share_id, accessed_at);`
+	_, err = db.Exec(shareAccessTable)
+	if err != nil {
+		log.Fatalf("Failed to create share_access table: %v", err)
+	}
+
+	// Create upload_requests table, for links that let outsiders upload files
+	uploadRequestsTable := `
+	CREATE TABLE IF NOT EXISTS upload_requests (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		token TEXT NOT NULL UNIQUE,
+		folder_id INTEGER,
+		label TEXT NOT NULL DEFAULT '',
+		password TEXT NOT NULL DEFAULT '',
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		expires_at DATETIME,
+		max_file_size INTEGER,
+		max_files INTEGER,
+		upload_count INTEGER NOT NULL DEFAULT 0,
+		revoked_at DATETIME,
+		FOREIGN KEY(folder_id) REFERENCES folders(id)
+	);`
+	_, err = db.Exec(uploadRequestsTable)
+	if err != nil {
+		log.Fatalf("Failed to create upload_requests table: %v", err)
+	}
+
+	// Create users table, for the accounts that log in to the web UI
+	usersTable := `
+	CREATE TABLE IF NOT EXISTS users (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		username TEXT NOT NULL UNIQUE COLLATE NOCASE,
+		password TEXT NOT NULL,
+		role TEXT NOT NULL DEFAULT 'member',
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);`
+	_, err = db.Exec(usersTable)
+	if err != nil {
+		log.Fatalf("Failed to create users table: %v", err)
+	}
+
+	// Create api_keys table, for named v1 API keys. Only a hash of each key
+	// is stored.
+	apiKeysTable := `
+	CREATE TABLE IF NOT EXISTS api_keys (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		prefix TEXT NOT NULL,
+		key_hash TEXT NOT NULL UNIQUE,
+		scopes TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		expires_at DATETIME,
+		last_used_at DATETIME,
+		last_used_ip TEXT NOT NULL DEFAULT '',
+		revoked_at DATETIME,
+		created_by INTEGER,
+		FOREIGN KEY(created_by) REFERENCES users(id)
+	);`
+	_, err = db.Exec(apiKeysTable)
+	if err != nil {
+		log.Fatalf("Failed to create api_keys table: %v", err)
+	}
+
+	// Create sessions table, for web UI logins. Only a hash of each session
+	// token is stored.
+	sessionsTable := `
+	CREATE TABLE IF NOT EXISTS sessions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		token_hash TEXT NOT NULL UNIQUE,
+		user_id INTEGER NOT NULL,
+		created_at DATETIME NOT NULL,
+		last_seen_at DATETIME NOT NULL,
+		expires_at DATETIME NOT NULL,
+		ip TEXT NOT NULL DEFAULT '',
+		user_agent TEXT NOT NULL DEFAULT '',
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions(user_id);`
+	_, err = db.Exec(sessionsTable)
+	if err != nil {
+		log.Fatalf("Failed to create sessions table: %v", err)
+	}
+
+	// Create recovery_codes table, for the one-time codes that stand in for
+	// a lost two-factor authenticator. Only a hash of each code is stored.
+	recoveryCodesTable := `
+	CREATE TABLE IF NOT EXISTS recovery_codes (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		code_hash TEXT NOT NULL,
+		used_at DATETIME,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_recovery_codes_user_id ON recovery_codes(user_id);`
+	_, err = db.Exec(recoveryCodesTable)
+	if err != nil {
+		log.Fatalf("Failed to create recovery_codes table: %v", err)
+	}
+
+	// Columns added after the initial schema
+	ensureColumn(db, "files", "has_preview", "INTEGER NOT NULL DEFAULT 0")
+	ensureColumn(db, "files", "content_type", "TEXT NOT NULL DEFAULT 'application/octet-stream'")
+	ensureColumn(db, "files", "folder_id", "INTEGER REFERENCES folders(id)")
+	ensureColumn(db, "files", "description", "TEXT NOT NULL DEFAULT ''")
+	ensureColumn(db, "files", "upload_request_id", "INTEGER")
+	ensureColumn(db, "files", "owner_id", "INTEGER REFERENCES users(id)")
+	ensureColumn(db, "upload_requests", "created_by", "INTEGER REFERENCES users(id)")
+	ensureColumn(db, "files", "share_expires_at", "DATETIME")
+	ensureColumn(db, "files", "share_max_downloads", "INTEGER")
+	ensureColumn(db, "files", "share_download_count", "INTEGER NOT NULL DEFAULT 0")
+	ensureColumn(db, "users", "totp_secret", "TEXT")
+	ensureColumn(db, "users", "totp_pending_secret", "TEXT")
+	ensureColumn(db, "users", "totp_last_step", "INTEGER NOT NULL DEFAULT 0")
+	ensureColumn(db, "users", "oidc_subject", "TEXT")
+	_, err = db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_users_oidc_subject ON users(oidc_subject)")
+	if err != nil {
+		log.Fatalf("Failed to create users index: %v", err)
+	}
+
+	migrateFileShares(db)
+	hashSharePasswords(db)
+	initSearchIndex(db)
+
 	return db
 }
+
+// relaxSharesFileID rebuilds a shares table created before folder and
+// collection shares existed, whose file_id column does not allow NULL.
+func relaxSharesFileID(db *sql.DB) {
+	var notNull int
+	err := db.QueryRow(`SELECT "notnull" FROM pragma_table_info('shares') WHERE name = 'file_id'`).Scan(&notNull)
+	if err != nil {
+		log.Fatalf("Failed to read schema of shares table: %v", err)
+	}
+	if notNull == 0 {
+		return
+	}
+
+	const columns = `id, token, kind, file_id, folder_id, label, password, created_at,
+		expires_at, max_downloads, download_count, revoked_at`
+	tx, err := db.Begin()
+	if err != nil {
+		log.Fatalf("Failed to start shares table migration: %v", err)
+	}
+	defer tx.Rollback()
+	for _, query := range []string{
+		"CREATE TABLE shares_new " + sharesSchema,
+		"INSERT INTO shares_new (" + columns + ") SELECT " + columns + " FROM shares",
+		"DROP TABLE shares",
+		"ALTER TABLE shares_new RENAME TO shares",
+	} {
+		if _, err := tx.Exec(query); err != nil {
+			log.Fatalf("Failed to migrate shares table: %v", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Fatalf("Failed to commit shares table migration: %v", err)
+	}
+	log.Printf("Migrated shares table to allow folder and collection shares")
+}
+
+// migrateFileShares moves share links that older versions stored in the share_*
+// columns of the files table into the shares table.
+func migrateFileShares(db *sql.DB) {
+	tx, err := db.Begin()
+	if err != nil {
+		log.Fatalf("Failed to start share migration: %v", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`INSERT OR IGNORE INTO shares (token, file_id, password, expires_at, max_downloads, download_count)
+		SELECT share_token, id, COALESCE(share_password, ''), share_expires_at, share_max_downloads, share_download_count
+		FROM files WHERE COALESCE(share_token, '') != ''`)
+	if err != nil {
+		log.Fatalf("Failed to migrate share links: %v", err)
+	}
+	_, err = tx.Exec(`UPDATE files SET share_token = NULL, share_password = NULL,
+		share_expires_at = NULL, share_max_downloads = NULL, share_download_count = 0
+		WHERE COALESCE(share_token, '') != ''`)
+	if err != nil {
+		log.Fatalf("Failed to clear migrated share links: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		log.Fatalf("Failed to commit share migration: %v", err)
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Printf("Migrated %d share links to the shares table", n)
+	}
+}
+
+// hashSharePasswords replaces share passwords that older versions stored in
+// plaintext with their hash.
+func hashSharePasswords(db *sql.DB) {
+	rows, err := db.Query("SELECT id, password FROM shares WHERE password != ''")
+	if err != nil {
+		log.Fatalf("Failed to query share passwords: %v", err)
+	}
+	plaintext := make(map[int64]string)
+	for rows.Next() {
+		var id int64
+		var password string
+		if err := rows.Scan(&id, &password); err != nil {
+			log.Fatalf("Failed to scan share password: %v", err)
+		}
+		if !isPasswordHash(password) {
+			plaintext[id] = password
+		}
+	}
+	rows.Close()
+
+	for id, password := range plaintext {
+		hash, err := hashSharePassword(password)
+		if err != nil {
+			log.Fatalf("Failed to hash share password: %v", err)
+		}
+		if _, err := db.Exec("UPDATE shares SET password = ? WHERE id = ?", hash, id); err != nil {
+			log.Fatalf("Failed to update share password: %v", err)
+		}
+	}
+	if len(plaintext) > 0 {
+		log.Printf("Hashed %d plaintext share passwords", len(plaintext))
+	}
+}
+
+// ensureColumn adds a column to an existing table if it is not there yet, so
+// databases created by older versions are migrated on startup.
+func ensureColumn(db *sql.DB, table, column, definition string) {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		log.Fatalf("Failed to read schema of %s table: %v", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			log.Fatalf("Failed to scan schema of %s table: %v", table, err)
+		}
+		if name == column {
+			return
+		}
+	}
+	rows.Close()
+
+	if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition)); err != nil {
+		log.Fatalf("Failed to add column %s to %s table: %v", column, table, err)
+	}
+}
@@ -3,9 +3,12 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"strconv"
+	"time"
 )
 
 type ChunkInfo struct {
@@ -13,6 +16,107 @@ type ChunkInfo struct {
 	AuthToken string
 }
 
+var errWebUploadDelete = errors.New("API cannot delete files uploaded from the web UI")
+
+// checkAPIDeletable reports whether an API key may delete a file: files
+// uploaded from the web UI are off limits to the API.
+func checkAPIDeletable(db *sql.DB, fileID int64) error {
+	var source string
+	err := db.QueryRow("SELECT source FROM files WHERE id = ?", fileID).Scan(&source)
+	if err == sql.ErrNoRows {
+		return errFileNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if source == "web" {
+		return errWebUploadDelete
+	}
+	return nil
+}
+
+// checkBurnAccess reports whether the user or API key creating a share that
+// deletes a file after its download could delete that file themselves.
+func checkBurnAccess(db *sql.DB, user *User, key *apiKey, fileID int64) error {
+	if key != nil {
+		return checkAPIDeletable(db, fileID)
+	}
+	return checkFileAccess(db, user, fileID)
+}
+
+// deleteFileRecords removes a file and every row that refers to it. Share
+// links of the file are revoked and detached from it instead, so their
+// access log, including the download that burned a one-time share, is kept.
+func deleteFileRecords(tx *sql.Tx, fileID int64) error {
+	_, err := tx.Exec("UPDATE shares SET file_id = NULL, revoked_at = COALESCE(revoked_at, ?) WHERE file_id = ?",
+		time.Now().UTC(), fileID)
+	if err != nil {
+		return err
+	}
+	for _, query := range []string{
+		"DELETE FROM chunks WHERE file_id = ?",
+		"DELETE FROM file_tags WHERE file_id = ?",
+		"DELETE FROM file_metadata WHERE file_id = ?",
+		"DELETE FROM share_files WHERE file_id = ?",
+		"DELETE FROM files WHERE id = ?",
+	} {
+		if _, err := tx.Exec(query, fileID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteFile removes the chunks of a file from the image host and the file
+// from the database. It returns errFileNotFound if there is no such file.
+func deleteFile(db *sql.DB, fileID int64, authToken string) error {
+	var exists int
+	if err := db.QueryRow("SELECT COUNT(*) FROM files WHERE id = ?", fileID).Scan(&exists); err != nil {
+		return fmt.Errorf("failed to query file: %w", err)
+	}
+	if exists == 0 {
+		return errFileNotFound
+	}
+
+	rows, err := db.Query("SELECT image_path FROM chunks WHERE file_id = ?", fileID)
+	if err != nil {
+		return fmt.Errorf("failed to query chunks: %w", err)
+	}
+	defer rows.Close()
+
+	var chunks []ChunkInfo
+	for rows.Next() {
+		var chunk ChunkInfo
+		if err := rows.Scan(&chunk.ImagePath); err != nil {
+			return fmt.Errorf("failed to scan chunk row: %w", err)
+		}
+		chunks = append(chunks, chunk)
+	}
+	rows.Close()
+
+	// Delete from external API
+	for _, chunk := range chunks {
+		if err := deleteImage(chunk.ImagePath, authToken); err != nil {
+			log.Printf("Failed to delete image %s: %v", chunk.ImagePath, err)
+		}
+	}
+
+	// Delete from database
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	if err := deleteFileRecords(tx, fileID); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to delete file from DB: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit deletion: %w", err)
+	}
+	thumbnails.Remove(fileID)
+	return nil
+}
+
 func deleteHandler(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		fileIDStr := r.PathValue("id")
@@ -23,60 +127,24 @@ func deleteHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		rows, err := db.Query("SELECT image_path FROM chunks WHERE file_id = ?", fileID)
-		if err != nil {
-			log.Printf("Failed to query chunks for file ID %d: %v", fileID, err)
-			http.Error(w, "Failed to query chunks", http.StatusInternalServerError)
-			return
-		}
-		defer rows.Close()
-
-		var chunks []ChunkInfo
-		for rows.Next() {
-			var chunk ChunkInfo
-			if err := rows.Scan(&chunk.ImagePath); err != nil {
-				log.Printf("Failed to scan chunk row for file ID %d: %v", fileID, err)
-				http.Error(w, "Failed to scan chunk row", http.StatusInternalServerError)
-				return
-			}
-			chunks = append(chunks, chunk)
+		err = checkFileAccess(db, currentUser(r), fileID)
+		if err == nil {
+			err = deleteFile(db, fileID, "")
 		}
-
-		if len(chunks) == 0 {
+		if err == errFileNotFound {
 			w.Header().Set("Content-Type", "application/json")
 			json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "message": "File not found or already deleted."})
 			return
 		}
-
-		// Delete from external API
-		for _, chunk := range chunks {
-			if err := deleteImage(chunk.ImagePath, ""); err != nil {
-				log.Printf("Failed to delete image %s: %v", chunk.ImagePath, err)
-			}
-		}
-
-		// Delete from database
-		tx, err := db.Begin()
-		if err != nil {
-			log.Printf("Failed to start transaction for file ID %d: %v", fileID, err)
-			http.Error(w, "Failed to start transaction", http.StatusInternalServerError)
-			return
-		}
-		_, err = tx.Exec("DELETE FROM chunks WHERE file_id = ?", fileID)
-		if err != nil {
-			tx.Rollback()
-			log.Printf("Failed to delete chunks from DB for file ID %d: %v", fileID, err)
-			http.Error(w, "Failed to delete chunks from DB", http.StatusInternalServerError)
+		if err == errForbidden {
+			http.Error(w, "You can only delete files you uploaded", http.StatusForbidden)
 			return
 		}
-		_, err = tx.Exec("DELETE FROM files WHERE id = ?", fileID)
 		if err != nil {
-			tx.Rollback()
-			log.Printf("Failed to delete file from DB for file ID %d: %v", fileID, err)
-			http.Error(w, "Failed to delete file from DB", http.StatusInternalServerError)
+			log.Printf("Failed to delete file ID %d: %v", fileID, err)
+			http.Error(w, "Failed to delete file", http.StatusInternalServerError)
 			return
 		}
-		tx.Commit()
 
 		log.Printf("File with ID %d deleted successfully", fileID)
 		w.Header().Set("Content-Type", "application/json")
@@ -84,13 +152,13 @@ func deleteHandler(db *sql.DB) http.HandlerFunc {
 	}
 }
 
-func apiDeleteHandler(db *sql.DB) http.HandlerFunc {
+func apiDeleteHandler(db *sql.DB, config *AppConfig) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		fileIDStr := r.PathValue("id")
 		fileID, err := strconv.ParseInt(fileIDStr, 10, 64)
 		if err != nil {
 			log.Printf("Error parsing file ID '%s': %v", fileIDStr, err)
-			http.Error(w, "Invalid file ID", http.StatusBadRequest)
+			jsonError(w, "Invalid file ID", http.StatusBadRequest)
 			return
 		}
 
@@ -99,70 +167,26 @@ func apiDeleteHandler(db *sql.DB) http.HandlerFunc {
 		err = db.QueryRow("SELECT source FROM files WHERE id = ?", fileID).Scan(&source)
 		if err != nil {
 			if err == sql.ErrNoRows {
-				http.Error(w, "File not found", http.StatusNotFound)
+				jsonError(w, "File not found", http.StatusNotFound)
 				return
 			}
 			log.Printf("Failed to query file source for file ID %d: %v", fileID, err)
-			http.Error(w, "Failed to query file source", http.StatusInternalServerError)
+			jsonError(w, "Failed to query file source", http.StatusInternalServerError)
 			return
 		}
 
 		if source == "web" {
 			log.Printf("API delete forbidden for file ID %d with source 'web'", fileID)
-			http.Error(w, "API cannot delete files uploaded from the web UI", http.StatusForbidden)
+			jsonError(w, "API cannot delete files uploaded from the web UI", http.StatusForbidden)
 			return
 		}
 
 		// Proceed with deletion if source is not 'web'
-		rows, err := db.Query("SELECT image_path FROM chunks WHERE file_id = ?", fileID)
-		if err != nil {
-			log.Printf("Failed to query chunks for file ID %d: %v", fileID, err)
-			http.Error(w, "Failed to query chunks", http.StatusInternalServerError)
-			return
-		}
-		defer rows.Close()
-
-		var chunks []ChunkInfo
-		for rows.Next() {
-			var chunk ChunkInfo
-			if err := rows.Scan(&chunk.ImagePath); err != nil {
-				log.Printf("Failed to scan chunk row for file ID %d: %v", fileID, err)
-				http.Error(w, "Failed to scan chunk row", http.StatusInternalServerError)
-				return
-			}
-			chunks = append(chunks, chunk)
-		}
-
-		// Delete from external API
-		apiKey := r.Header.Get("X-API-KEY")
-		for _, chunk := range chunks {
-			if err := deleteImage(chunk.ImagePath, apiKey); err != nil {
-				log.Printf("Failed to delete image %s: %v", chunk.ImagePath, err)
-			}
-		}
-
-		// Delete from database
-		tx, err := db.Begin()
-		if err != nil {
-			log.Printf("Failed to start transaction for file ID %d: %v", fileID, err)
-			http.Error(w, "Failed to start transaction", http.StatusInternalServerError)
-			return
-		}
-		_, err = tx.Exec("DELETE FROM chunks WHERE file_id = ?", fileID)
-		if err != nil {
-			tx.Rollback()
-			log.Printf("Failed to delete chunks from DB for file ID %d: %v", fileID, err)
-			http.Error(w, "Failed to delete chunks from DB", http.StatusInternalServerError)
-			return
-		}
-		_, err = tx.Exec("DELETE FROM files WHERE id = ?", fileID)
-		if err != nil {
-			tx.Rollback()
-			log.Printf("Failed to delete file from DB for file ID %d: %v", fileID, err)
-			http.Error(w, "Failed to delete file from DB", http.StatusInternalServerError)
+		if err := deleteFile(db, fileID, imageHostToken(r, config)); err != nil {
+			log.Printf("Failed to delete file ID %d: %v", fileID, err)
+			jsonError(w, "Failed to delete file", http.StatusInternalServerError)
 			return
 		}
-		tx.Commit()
 
 		log.Printf("File with ID %d deleted successfully via API", fileID)
 		w.Header().Set("Content-Type", "application/json")
@@ -20,6 +20,24 @@ var bufferPool = sync.Pool{
 	},
 }
 
+// newChunkRequest creates a GET request for a chunk image on the image host.
+func newChunkRequest(fullURL string) (*http.Request, error) {
+	req, err := http.NewRequest("GET", fullURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Add extensive headers to mimic a real browser request
+	req.Header.Set("User-Agent", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/140.0.0.0 Safari/537.36")
+	req.Header.Set("Accept", "image/avif,image/webp,image/apng,image/svg+xml,image/*,*/*;q=0.8")
+	req.Header.Set("Accept-Language", "zh-CN,zh;q=0.9,en-US;q=0.8,en;q=0.7")
+	req.Header.Set("Referer", "https://xviewer.pages.dev/")
+	req.Header.Set("Sec-Fetch-Dest", "image")
+	req.Header.Set("Sec-Fetch-Mode", "no-cors")
+	req.Header.Set("Sec-Fetch-Site", "cross-site")
+	return req, nil
+}
+
 func downloadHandler(db *sql.DB) http.HandlerFunc {
 	client := &http.Client{}
 
@@ -54,76 +72,203 @@ func downloadHandler(db *sql.DB) http.HandlerFunc {
 		}
 		log.Printf("Found filename: %s", filename)
 
-		rows, err := db.Query("SELECT image_path FROM chunks WHERE file_id = ? ORDER BY chunk_order ASC", fileID)
+		w.Header().Set("Content-Disposition", contentDisposition("attachment", filename))
+		w.Header().Set("Content-Type", defaultContentType)
+
+		serveFileChunks(w, client, db, fileID)
+	}
+}
+
+// viewHandler serves a file inline with its detected content type so that
+// images, PDFs, audio and video can be opened directly in the browser.
+func viewHandler(db *sql.DB) http.HandlerFunc {
+	client := &http.Client{}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		fileIDStr := r.PathValue("id")
+		fileID, err := strconv.ParseInt(fileIDStr, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid file ID", http.StatusBadRequest)
+			return
+		}
+
+		var filename, contentType string
+		err = db.QueryRow("SELECT filename, content_type FROM files WHERE id = ?", fileID).Scan(&filename, &contentType)
 		if err != nil {
-			log.Printf("Error: Failed to query chunks for file ID %d: %v", fileID, err)
-			http.Error(w, "Failed to query chunks", http.StatusInternalServerError)
+			if err == sql.ErrNoRows {
+				http.Error(w, "File not found", http.StatusNotFound)
+			} else {
+				log.Printf("Error: Failed to query file ID %d: %v", fileID, err)
+				http.Error(w, "Failed to query file", http.StatusInternalServerError)
+			}
 			return
 		}
-		defer rows.Close()
 
-		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filename))
-		w.Header().Set("Content-Type", "application/octet-stream")
+		setInlineHeaders(w, filename, contentType)
+		serveFileChunks(w, client, db, fileID)
+	}
+}
 
-		chunkCount := 0
-		// Get a buffer from the pool
-		bufferPtr := bufferPool.Get().(*[]byte)
-		defer bufferPool.Put(bufferPtr) // Return the buffer to the pool when done
-		buffer := *bufferPtr
+// setInlineHeaders sets the response headers for viewing a file in the
+// browser. Types that are not safe to render fall back to a download.
+func setInlineHeaders(w http.ResponseWriter, filename, contentType string) {
+	if isInlineContentType(contentType) {
+		w.Header().Set("Content-Disposition", contentDisposition("inline", filename))
+		w.Header().Set("Content-Type", contentType)
+	} else {
+		w.Header().Set("Content-Disposition", contentDisposition("attachment", filename))
+		w.Header().Set("Content-Type", defaultContentType)
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "sandbox")
+}
 
-		for rows.Next() {
-			chunkCount++
-			var imagePath string
-			if err := rows.Scan(&imagePath); err != nil {
-				log.Printf("Error: Failed to scan chunk row for file ID %d: %v", fileID, err)
-				http.Error(w, "Failed to scan chunk row", http.StatusInternalServerError)
-				return
-			}
-			log.Printf("Processing chunk %d, path: %s", chunkCount, imagePath)
-
-			fullURL := "https://i.111666.best" + imagePath
-			req, err := http.NewRequest("GET", fullURL, nil)
-			if err != nil {
-				log.Printf("Error: Failed to create request for %s: %v", fullURL, err)
-				http.Error(w, "Failed to create download request", http.StatusInternalServerError)
-				return
-			}
+// serveFileChunks streams a file to an HTTP response. An error response is
+// only sent if nothing has been written yet; otherwise the stream is cut short.
+// It returns the number of bytes sent and the error that stopped the stream.
+func serveFileChunks(w http.ResponseWriter, client *http.Client, db *sql.DB, fileID int64) (int64, error) {
+	written, err := writeFileChunks(w, client, db, fileID)
+	if err != nil {
+		log.Printf("Error: Failed to stream file ID %d: %v", fileID, err)
+		if written == 0 {
+			http.Error(w, "Failed to download file", http.StatusInternalServerError)
+		}
+		return written, err
+	}
+	log.Printf("Finished streaming %d bytes for file ID %d", written, fileID)
+	return written, nil
+}
 
-			// Add extensive headers to mimic a real browser request
-			req.Header.Set("User-Agent", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/140.0.0.0 Safari/537.36")
-			req.Header.Set("Accept", "image/avif,image/webp,image/apng,image/svg+xml,image/*,*/*;q=0.8")
-			req.Header.Set("Accept-Language", "zh-CN,zh;q=0.9,en-US;q=0.8,en;q=0.7")
-			req.Header.Set("Referer", "https://xviewer.pages.dev/")
-			req.Header.Set("Sec-Fetch-Dest", "image")
-			req.Header.Set("Sec-Fetch-Mode", "no-cors")
-			req.Header.Set("Sec-Fetch-Site", "cross-site")
-
-			resp, err := client.Do(req)
-			if err != nil {
-				log.Printf("Error: Failed to download chunk from %s: %v", fullURL, err)
-				http.Error(w, "Failed to download chunk", http.StatusInternalServerError)
-				return
-			}
+// writeFileChunks downloads the chunks of a file in order, strips their
+// carriers and writes the reassembled content to dst. It returns the number of
+// bytes written, and an error unless exactly the size of the file was written,
+// so a nil error means the whole file arrived.
+func writeFileChunks(dst io.Writer, client *http.Client, db *sql.DB, fileID int64) (int64, error) {
+	var filesize int64
+	if err := db.QueryRow("SELECT filesize FROM files WHERE id = ?", fileID).Scan(&filesize); err != nil {
+		return 0, fmt.Errorf("failed to query file size: %w", err)
+	}
 
-			bytesSkipped, err := io.CopyN(io.Discard, resp.Body, int64(downloadCarrierPadding))
-			log.Printf("Skipped %d bytes for chunk %d", bytesSkipped, chunkCount)
-			if err != nil && err != io.EOF {
-				log.Printf("Error: Failed to skip carrier data for chunk %d: %v", chunkCount, err)
-				resp.Body.Close()
-				http.Error(w, "Failed to process chunk", http.StatusInternalServerError)
-				return
-			}
+	rows, err := db.Query("SELECT image_path FROM chunks WHERE file_id = ? ORDER BY chunk_order ASC", fileID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query chunks: %w", err)
+	}
+	defer rows.Close()
 
-			bytesWritten, err := io.CopyBuffer(w, resp.Body, buffer)
-			if err != nil {
-				log.Printf("Error: Failed to stream chunk %d to client: %v", chunkCount, err)
-				resp.Body.Close()
-				return
-			}
-			log.Printf("Wrote %d bytes for chunk %d to response", bytesWritten, chunkCount)
+	var imagePaths []string
+	for rows.Next() {
+		var imagePath string
+		if err := rows.Scan(&imagePath); err != nil {
+			return 0, fmt.Errorf("failed to scan chunk row: %w", err)
+		}
+		imagePaths = append(imagePaths, imagePath)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to read chunk rows: %w", err)
+	}
+	rows.Close()
+
+	// Get a buffer from the pool
+	bufferPtr := bufferPool.Get().(*[]byte)
+	defer bufferPool.Put(bufferPtr) // Return the buffer to the pool when done
+	buffer := *bufferPtr
+
+	var total int64
+	for i, imagePath := range imagePaths {
+		log.Printf("Processing chunk %d, path: %s", i+1, imagePath)
 
+		fullURL := "https://i.111666.best" + imagePath
+		req, err := newChunkRequest(fullURL)
+		if err != nil {
+			return total, fmt.Errorf("failed to create request for %s: %w", fullURL, err)
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return total, fmt.Errorf("failed to download chunk from %s: %w", fullURL, err)
+		}
+		// An error page from the image host would otherwise be taken for
+		// carrier padding and silently dropped.
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			resp.Body.Close()
+			return total, fmt.Errorf("image host returned status %d for chunk %d", resp.StatusCode, i+1)
+		}
+
+		_, err = io.CopyN(io.Discard, resp.Body, int64(downloadCarrierPadding))
+		if err != nil && err != io.EOF {
 			resp.Body.Close()
+			return total, fmt.Errorf("failed to skip carrier data for chunk %d: %w", i+1, err)
+		}
+
+		bytesWritten, err := io.CopyBuffer(dst, resp.Body, buffer)
+		total += bytesWritten
+		resp.Body.Close()
+		if err != nil {
+			return total, fmt.Errorf("failed to stream chunk %d: %w", i+1, err)
+		}
+		log.Printf("Wrote %d bytes for chunk %d", bytesWritten, i+1)
+	}
+
+	if total != filesize {
+		return total, fmt.Errorf("incomplete download: got %d of %d bytes", total, filesize)
+	}
+	return total, nil
+}
+
+// previewHandler serves the thumbnail carrier of a file's first chunk. Only the
+// carrier part is fetched from the image host, not the chunk data behind it.
+func previewHandler(db *sql.DB) http.HandlerFunc {
+	client := &http.Client{}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		fileIDStr := r.PathValue("id")
+		fileID, err := strconv.ParseInt(fileIDStr, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid file ID", http.StatusBadRequest)
+			return
+		}
+
+		var imagePath string
+		err = db.QueryRow(`SELECT c.image_path FROM chunks c JOIN files f ON f.id = c.file_id
+			WHERE f.id = ? AND f.has_preview = 1 AND c.chunk_order = 0`, fileID).Scan(&imagePath)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "Preview not found", http.StatusNotFound)
+			} else {
+				log.Printf("Error: Failed to query preview for file ID %d: %v", fileID, err)
+				http.Error(w, "Failed to query preview", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		fullURL := "https://i.111666.best" + imagePath
+		req, err := newChunkRequest(fullURL)
+		if err != nil {
+			log.Printf("Error: Failed to create request for %s: %v", fullURL, err)
+			http.Error(w, "Failed to create preview request", http.StatusInternalServerError)
+			return
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			log.Printf("Error: Failed to download preview from %s: %v", fullURL, err)
+			http.Error(w, "Failed to download preview", http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			log.Printf("Error: Image host returned status %d for %s", resp.StatusCode, fullURL)
+			http.Error(w, "Failed to download preview", http.StatusBadGateway)
+			return
+		}
+
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Cache-Control", "private, max-age=86400")
+		// The carrier is padded with zero bytes after the PNG IEND chunk, which
+		// image decoders ignore.
+		if _, err := io.CopyN(w, resp.Body, int64(downloadCarrierPadding)); err != nil && err != io.EOF {
+			log.Printf("Error: Failed to stream preview for file ID %d: %v", fileID, err)
 		}
-		log.Printf("Finished processing all %d chunks for file ID %d", chunkCount, fileID)
 	}
 }
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultFileListLimit = 100
+	maxFileListLimit     = 1000
+	// sqliteTimestampLayout is how CURRENT_TIMESTAMP values are stored.
+	sqliteTimestampLayout = "2006-01-02 15:04:05"
+)
+
+// fileSortColumns maps the accepted sort names to their SQL expression.
+// Relevance ordering is handled separately since it only exists for searches.
+var fileSortColumns = map[string]string{
+	"name": "files.filename COLLATE NOCASE",
+	"size": "files.filesize",
+	"date": "files.upload_timestamp",
+}
+
+// fileListQuery is a parsed file listing request.
+type fileListQuery struct {
+	from       string
+	conditions []string
+	args       []interface{}
+
+	sort       string
+	descending bool
+	rankExpr   string
+	// paged is set when the request asks for a page with limit or cursor.
+	// Other requests get every file, as a plain array like before pagination.
+	paged  bool
+	limit  int
+	cursor *fileListCursor
+}
+
+// fileListCursor marks the last row of a page. Keyset pagination uses the sort
+// value and ID; relevance ordering has no stable key and uses an offset.
+type fileListCursor struct {
+	Value  interface{} `json:"v,omitempty"`
+	ID     int64       `json:"id,omitempty"`
+	Offset int         `json:"o,omitempty"`
+}
+
+// FileListPage is the response body of a file listing.
+type FileListPage struct {
+	Files      []FileInfo `json:"files"`
+	Total      int        `json:"total"`
+	NextCursor string     `json:"next_cursor,omitempty"`
+}
+
+func (q *fileListQuery) where(condition string, args ...interface{}) {
+	q.conditions = append(q.conditions, condition)
+	q.args = append(q.args, args...)
+}
+
+// parseFileListQuery reads the search, filter, sort and pagination parameters
+// of a file listing request.
+func parseFileListQuery(params url.Values) (*fileListQuery, error) {
+	q := &fileListQuery{
+		from:       "files",
+		sort:       "date",
+		descending: true,
+		limit:      defaultFileListLimit,
+	}
+	q.where("files.filename != ''")
+
+	if search := params.Get("search"); search != "" {
+		if ftsQuery := buildFTSQuery(search); searchIndexEnabled && ftsQuery != "" {
+			q.from = "files JOIN files_fts ON files_fts.rowid = files.id"
+			q.where("files_fts MATCH ?", ftsQuery)
+			// Rank by relevance, weighting filename and tag hits above the rest.
+			q.rankExpr = "bm25(files_fts, 10.0, 2.0, 5.0, 1.0)"
+			q.sort = "relevance"
+			q.descending = false
+		} else {
+			q.where("(files.filename LIKE ? OR files.description LIKE ?)", "%"+search+"%", "%"+search+"%")
+		}
+	}
+
+	// Listing is scoped to a folder only when one is asked for, so searches
+	// and older clients still see every file.
+	if folderParam, ok := params["folder_id"]; ok {
+		folderID, err := parseFolderParam(folderParam[0])
+		if err != nil {
+			return nil, errors.New("invalid folder_id")
+		}
+		q.where("files.folder_id IS ?", folderID)
+	}
+
+	// Every requested tag must be present on the file.
+	for _, tag := range params["tag"] {
+		q.where("EXISTS (SELECT 1 FROM file_tags WHERE file_id = files.id AND tag = ?)", strings.ToLower(strings.TrimSpace(tag)))
+	}
+
+	if err := q.parseFilters(params); err != nil {
+		return nil, err
+	}
+
+	if sort := params.Get("sort"); sort != "" {
+		if _, ok := fileSortColumns[sort]; !ok && !(sort == "relevance" && q.rankExpr != "") {
+			return nil, fmt.Errorf("invalid sort %q", sort)
+		}
+		q.sort = sort
+		q.descending = sort == "date" || sort == "size"
+	}
+	switch params.Get("order") {
+	case "":
+	case "asc":
+		q.descending = false
+	case "desc":
+		q.descending = true
+	default:
+		return nil, errors.New("order must be asc or desc")
+	}
+
+	q.paged = params.Has("limit") || params.Has("cursor")
+	if !q.paged {
+		q.limit = 0
+	}
+	if limit := params.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > maxFileListLimit {
+			return nil, fmt.Errorf("limit must be between 1 and %d", maxFileListLimit)
+		}
+		q.limit = n
+	}
+
+	if cursor := params.Get("cursor"); cursor != "" {
+		data, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil {
+			return nil, errors.New("invalid cursor")
+		}
+		q.cursor = &fileListCursor{}
+		if err := json.Unmarshal(data, q.cursor); err != nil {
+			return nil, errors.New("invalid cursor")
+		}
+	}
+
+	return q, nil
+}
+
+// parseFilters adds the size, date, source, content type and share filters.
+func (q *fileListQuery) parseFilters(params url.Values) error {
+	if v := params.Get("min_size"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return errors.New("invalid min_size")
+		}
+		q.where("files.filesize >= ?", n)
+	}
+	if v := params.Get("max_size"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return errors.New("invalid max_size")
+		}
+		q.where("files.filesize <= ?", n)
+	}
+
+	if v := params.Get("from"); v != "" {
+		t, _, err := parseDateParam(v)
+		if err != nil {
+			return errors.New("invalid from date")
+		}
+		q.where("files.upload_timestamp >= ?", t.UTC().Format(sqliteTimestampLayout))
+	}
+	if v := params.Get("to"); v != "" {
+		t, dateOnly, err := parseDateParam(v)
+		if err != nil {
+			return errors.New("invalid to date")
+		}
+		// A bare date includes the whole day.
+		if dateOnly {
+			q.where("files.upload_timestamp < ?", t.AddDate(0, 0, 1).UTC().Format(sqliteTimestampLayout))
+		} else {
+			q.where("files.upload_timestamp <= ?", t.UTC().Format(sqliteTimestampLayout))
+		}
+	}
+
+	if v := params.Get("source"); v != "" {
+		if v != "web" && v != "api" && v != "request" {
+			return errors.New("source must be web, api or request")
+		}
+		q.where("files.source = ?", v)
+	}
+
+	if v := params.Get("owner_id"); v != "" {
+		ownerID, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return errors.New("invalid owner_id")
+		}
+		q.where("files.owner_id = ?", ownerID)
+	}
+
+	// "image/" matches every image type, "image/png" only that type.
+	if v := params.Get("content_type"); v != "" {
+		if strings.HasSuffix(v, "/") {
+			q.where("files.content_type LIKE ?", v+"%")
+		} else {
+			q.where("(files.content_type = ? OR files.content_type LIKE ?)", v, v+";%")
+		}
+	}
+
+	if v := params.Get("shared"); v != "" {
+		shared, err := strconv.ParseBool(v)
+		if err != nil {
+			return errors.New("invalid shared flag")
+		}
+		condition := "EXISTS (SELECT 1 FROM shares WHERE shares.file_id = files.id AND " + activeShareCondition + ")"
+		if !shared {
+			condition = "NOT " + condition
+		}
+		q.where(condition)
+	}
+	return nil
+}
+
+// resolveOwnerParam replaces owner_id=me with the ID of the user making the
+// request.
+func resolveOwnerParam(params url.Values, user *User) error {
+	if params.Get("owner_id") != "me" {
+		return nil
+	}
+	if user == nil {
+		return errors.New("owner_id=me is only supported for logged in users")
+	}
+	params.Set("owner_id", strconv.FormatInt(user.ID, 10))
+	return nil
+}
+
+// parseDateParam accepts RFC 3339 timestamps and plain YYYY-MM-DD dates. The
+// returned bool reports whether only a date was given.
+func parseDateParam(v string) (time.Time, bool, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, false, nil
+	}
+	t, err := time.Parse("2006-01-02", v)
+	return t, true, err
+}
+
+// run executes the query and returns one page of results, or all of them
+// for queries that are not paged.
+func (q *fileListQuery) run(db *sql.DB) (*FileListPage, error) {
+	page := &FileListPage{Files: []FileInfo{}}
+
+	where := strings.Join(q.conditions, " AND ")
+	if q.paged {
+		if err := db.QueryRow("SELECT COUNT(*) FROM "+q.from+" WHERE "+where, q.args...).Scan(&page.Total); err != nil {
+			return nil, err
+		}
+	}
+
+	direction, cmp := "ASC", ">"
+	if q.descending {
+		direction, cmp = "DESC", "<"
+	}
+
+	args := append([]interface{}{}, q.args...)
+	var orderBy, offset string
+	if q.sort == "relevance" {
+		orderBy = q.rankExpr + " " + direction + ", files.id DESC"
+		if q.cursor != nil {
+			offset = fmt.Sprintf(" OFFSET %d", q.cursor.Offset)
+		}
+	} else {
+		column := fileSortColumns[q.sort]
+		orderBy = fmt.Sprintf("%s %s, files.id %s", column, direction, direction)
+		if q.cursor != nil {
+			where += fmt.Sprintf(" AND (%[1]s %[2]s ? OR (%[1]s = ? AND files.id %[2]s ?))", column, cmp)
+			args = append(args, q.cursor.Value, q.cursor.Value, q.cursor.ID)
+		}
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE %s ORDER BY %s", fileColumns, q.from, where, orderBy)
+	if q.paged {
+		// Fetch one extra row to learn whether there is a next page.
+		query += fmt.Sprintf(" LIMIT %d%s", q.limit+1, offset)
+	}
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		file, err := scanFileInfo(rows)
+		if err != nil {
+			return nil, err
+		}
+		page.Files = append(page.Files, file)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if q.paged && len(page.Files) > q.limit {
+		page.Files = page.Files[:q.limit]
+		page.NextCursor = q.nextCursor(page.Files[len(page.Files)-1])
+	}
+	return page, nil
+}
+
+// nextCursor encodes the cursor that continues after last.
+func (q *fileListQuery) nextCursor(last FileInfo) string {
+	var c fileListCursor
+	switch q.sort {
+	case "relevance":
+		c.Offset = q.limit
+		if q.cursor != nil {
+			c.Offset += q.cursor.Offset
+		}
+	case "name":
+		c.Value, c.ID = last.Filename, last.ID
+	case "size":
+		c.Value, c.ID = last.Filesize, last.ID
+	default:
+		c.Value, c.ID = last.UploadTimestamp.UTC().Format(sqliteTimestampLayout), last.ID
+	}
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestDB returns a fresh database with the full schema.
+func newTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db := initDB(filepath.Join(t.TempDir(), "test.db"))
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// insertTestFile adds a file row and returns its ID.
+func insertTestFile(t *testing.T, db *sql.DB, name string, size int64, uploaded time.Time, ownerID *int64) int64 {
+	t.Helper()
+	res, err := db.Exec("INSERT INTO files (filename, filesize, source, upload_timestamp, owner_id) VALUES (?, ?, 'api', ?, ?)",
+		name, size, uploaded.UTC().Format(sqliteTimestampLayout), ownerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := res.LastInsertId()
+	return id
+}
+
+// listAll pages through the file list with the given page size and returns
+// the IDs in the order they were returned. before runs ahead of each page
+// after the first.
+func listAll(t *testing.T, db *sql.DB, params url.Values, pageSize int, before func()) []int64 {
+	t.Helper()
+	var ids []int64
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > 100 {
+			t.Fatal("pagination does not end")
+		}
+		p := url.Values{}
+		for k, v := range params {
+			p[k] = v
+		}
+		p.Set("limit", fmt.Sprint(pageSize))
+		if cursor != "" {
+			p.Set("cursor", cursor)
+			if before != nil {
+				before()
+			}
+		}
+		q, err := parseFileListQuery(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		page, err := q.run(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page.Files) > pageSize {
+			t.Fatalf("page has %d files, limit is %d", len(page.Files), pageSize)
+		}
+		for _, f := range page.Files {
+			ids = append(ids, f.ID)
+		}
+		if page.NextCursor == "" {
+			return ids
+		}
+		cursor = page.NextCursor
+	}
+}
+
+func TestFileListCursorPagination(t *testing.T) {
+	db := newTestDB(t)
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	// Repeated names, sizes and timestamps make the ID tie-breaker matter.
+	for i := 0; i < 23; i++ {
+		insertTestFile(t, db, fmt.Sprintf("file-%d.txt", i%5), int64(i%4), base.Add(time.Duration(i%6)*time.Hour), nil)
+	}
+
+	for _, sort := range []string{"date", "name", "size"} {
+		for _, order := range []string{"asc", "desc"} {
+			for _, pageSize := range []int{1, 4, 7, 23, 100} {
+				params := url.Values{"sort": {sort}, "order": {order}}
+				q, err := parseFileListQuery(params)
+				if err != nil {
+					t.Fatal(err)
+				}
+				all, err := q.run(db)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				got := listAll(t, db, params, pageSize, nil)
+				if len(got) != len(all.Files) {
+					t.Fatalf("sort=%s order=%s limit=%d: got %d files, want %d", sort, order, pageSize, len(got), len(all.Files))
+				}
+				for i, f := range all.Files {
+					if got[i] != f.ID {
+						t.Errorf("sort=%s order=%s limit=%d: file %d is ID %d, want %d", sort, order, pageSize, i, got[i], f.ID)
+						break
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestFileListCursorStableUnderInserts(t *testing.T) {
+	db := newTestDB(t)
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	want := make(map[int64]bool)
+	for i := 0; i < 20; i++ {
+		want[insertTestFile(t, db, fmt.Sprintf("f%02d", i), 1, base.Add(time.Duration(i)*time.Minute), nil)] = true
+	}
+
+	// Newer files uploaded while paging by date must not shift the pages
+	// and repeat or skip files that were already there.
+	n := 0
+	got := listAll(t, db, url.Values{"sort": {"date"}}, 6, func() {
+		insertTestFile(t, db, fmt.Sprintf("new%d", n), 1, base.Add(time.Hour+time.Duration(n)*time.Minute), nil)
+		n++
+	})
+	seen := make(map[int64]bool)
+	for _, id := range got {
+		if seen[id] {
+			t.Errorf("file %d listed twice", id)
+		}
+		seen[id] = true
+		if !want[id] {
+			t.Errorf("file %d uploaded after the first page was listed", id)
+		}
+	}
+	if len(seen) != len(want) {
+		t.Errorf("listed %d files, want %d", len(seen), len(want))
+	}
+}
+
+func TestFileListQueryParams(t *testing.T) {
+	tests := []struct {
+		query   string
+		paged   bool
+		limit   int
+		wantErr bool
+	}{
+		{"", false, 0, false},
+		{"limit=10", true, 10, false},
+		{"cursor=" + "e30", true, defaultFileListLimit, false},
+		{"limit=0", false, 0, true},
+		{fmt.Sprintf("limit=%d", maxFileListLimit+1), false, 0, true},
+		{"cursor=!!", false, 0, true},
+		{"sort=owner", false, 0, true},
+		{"order=up", false, 0, true},
+	}
+	for _, tt := range tests {
+		params, _ := url.ParseQuery(tt.query)
+		q, err := parseFileListQuery(params)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%q: want an error", tt.query)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.query, err)
+			continue
+		}
+		if q.paged != tt.paged || q.limit != tt.limit {
+			t.Errorf("%q: paged=%v limit=%d, want paged=%v limit=%d", tt.query, q.paged, q.limit, tt.paged, tt.limit)
+		}
+	}
+}
+
+func TestFilesHandlerResponseShape(t *testing.T) {
+	db := newTestDB(t)
+	for i := 0; i < 3; i++ {
+		insertTestFile(t, db, fmt.Sprintf("f%d", i), 1, time.Now(), nil)
+	}
+	handler := filesHandler(db, jsonError)
+
+	tests := []struct {
+		query string
+		paged bool
+	}{
+		{"", false},
+		{"?search=f", false},
+		{"?limit=2", true},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", "/api/v1/files"+tt.query, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%q: status %d: %s", tt.query, w.Code, w.Body)
+		}
+		if !tt.paged {
+			var files []FileInfo
+			if err := json.Unmarshal(w.Body.Bytes(), &files); err != nil {
+				t.Errorf("%q: want an array: %v", tt.query, err)
+			} else if len(files) != 3 {
+				t.Errorf("%q: got %d files, want 3", tt.query, len(files))
+			}
+			continue
+		}
+		var page FileListPage
+		if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+			t.Fatalf("%q: want a page: %v", tt.query, err)
+		}
+		if page.Total != 3 || len(page.Files) != 2 || page.NextCursor == "" {
+			t.Errorf("%q: total=%d files=%d next=%q", tt.query, page.Total, len(page.Files), page.NextCursor)
+		}
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type FolderInfo struct {
+	ID        int64     `json:"id"`
+	Name      string    `json:"name"`
+	ParentID  *int64    `json:"parent_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+var errFolderNotFound = errors.New("folder not found")
+
+// parseFolderParam parses a folder reference from a query parameter or form
+// field. An empty value or "root" means the top level and yields nil.
+func parseFolderParam(value string) (*int64, error) {
+	if value == "" || value == "root" {
+		return nil, nil
+	}
+	id, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &id, nil
+}
+
+// checkFolderExists returns errFolderNotFound unless folderID is nil (the top
+// level) or names an existing folder.
+func checkFolderExists(db *sql.DB, folderID *int64) error {
+	if folderID == nil {
+		return nil
+	}
+	var id int64
+	err := db.QueryRow("SELECT id FROM folders WHERE id = ?", *folderID).Scan(&id)
+	if err == sql.ErrNoRows {
+		return errFolderNotFound
+	}
+	return err
+}
+
+// isFolderDescendant reports whether folderID is ancestorID itself or lies
+// somewhere below it.
+func isFolderDescendant(db *sql.DB, folderID, ancestorID int64) (bool, error) {
+	current := sql.NullInt64{Int64: folderID, Valid: true}
+	for current.Valid {
+		if current.Int64 == ancestorID {
+			return true, nil
+		}
+		if err := db.QueryRow("SELECT parent_id FROM folders WHERE id = ?", current.Int64).Scan(&current); err != nil {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// folderNameTaken reports whether parentID already holds a folder called name,
+// ignoring the folder excludeID.
+func folderNameTaken(db *sql.DB, parentID *int64, name string, excludeID int64) (bool, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM folders WHERE parent_id IS ? AND name = ? AND id != ?",
+		parentID, name, excludeID).Scan(&count)
+	return count > 0, err
+}
+
+// validFolderName reports whether name can be used as a folder name. Folder
+// names become directories in ZIP downloads, so they follow the rules for
+// file names.
+func validFolderName(name string) bool {
+	return validFilename(name)
+}
+
+func listFoldersHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var rows *sql.Rows
+		var err error
+
+		// Without a parent the whole tree is returned, so clients can build paths.
+		if parentParam, ok := r.URL.Query()["parent_id"]; ok {
+			parentID, perr := parseFolderParam(parentParam[0])
+			if perr != nil {
+				http.Error(w, "Invalid parent folder ID", http.StatusBadRequest)
+				return
+			}
+			rows, err = db.Query("SELECT id, name, parent_id, created_at FROM folders WHERE parent_id IS ? ORDER BY name", parentID)
+		} else {
+			rows, err = db.Query("SELECT id, name, parent_id, created_at FROM folders ORDER BY name")
+		}
+		if err != nil {
+			log.Printf("Failed to query folders: %v", err)
+			http.Error(w, "Failed to query folders", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		folders := []FolderInfo{}
+		for rows.Next() {
+			var folder FolderInfo
+			var parentID sql.NullInt64
+			if err := rows.Scan(&folder.ID, &folder.Name, &parentID, &folder.CreatedAt); err != nil {
+				http.Error(w, "Failed to scan folder row", http.StatusInternalServerError)
+				return
+			}
+			if parentID.Valid {
+				folder.ParentID = &parentID.Int64
+			}
+			folders = append(folders, folder)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(folders); err != nil {
+			log.Printf("Failed to encode folders to JSON: %v", err)
+		}
+	}
+}
+
+func createFolderHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Name     string `json:"name"`
+			ParentID *int64 `json:"parent_id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		req.Name = strings.TrimSpace(req.Name)
+		if !validFolderName(req.Name) {
+			http.Error(w, "Invalid folder name", http.StatusBadRequest)
+			return
+		}
+
+		if err := checkFolderExists(db, req.ParentID); err != nil {
+			if err == errFolderNotFound {
+				http.Error(w, "Parent folder not found", http.StatusNotFound)
+				return
+			}
+			log.Printf("Failed to query parent folder: %v", err)
+			http.Error(w, "Failed to query parent folder", http.StatusInternalServerError)
+			return
+		}
+
+		taken, err := folderNameTaken(db, req.ParentID, req.Name, 0)
+		if err != nil {
+			log.Printf("Failed to check folder name: %v", err)
+			http.Error(w, "Failed to create folder", http.StatusInternalServerError)
+			return
+		}
+		if taken {
+			http.Error(w, "A folder with this name already exists", http.StatusConflict)
+			return
+		}
+
+		res, err := db.Exec("INSERT INTO folders (name, parent_id) VALUES (?, ?)", req.Name, req.ParentID)
+		if err != nil {
+			log.Printf("Failed to create folder: %v", err)
+			http.Error(w, "Failed to create folder", http.StatusInternalServerError)
+			return
+		}
+		folderID, err := res.LastInsertId()
+		if err != nil {
+			http.Error(w, "Failed to get last insert ID", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "id": folderID})
+	}
+}
+
+// updateFolderHandler renames a folder and/or moves it under another parent.
+// A parent_id of null moves the folder to the top level.
+func updateFolderHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		folderID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid folder ID", http.StatusBadRequest)
+			return
+		}
+
+		// Decode into raw fields so an explicit null parent can be told apart
+		// from a missing one.
+		var req map[string]json.RawMessage
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		var name string
+		var parent sql.NullInt64
+		err = db.QueryRow("SELECT name, parent_id FROM folders WHERE id = ?", folderID).Scan(&name, &parent)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "Folder not found", http.StatusNotFound)
+				return
+			}
+			log.Printf("Failed to query folder %d: %v", folderID, err)
+			http.Error(w, "Failed to query folder", http.StatusInternalServerError)
+			return
+		}
+
+		var parentID *int64
+		if parent.Valid {
+			parentID = &parent.Int64
+		}
+
+		if rawName, ok := req["name"]; ok {
+			if err := json.Unmarshal(rawName, &name); err != nil {
+				http.Error(w, "Invalid folder name", http.StatusBadRequest)
+				return
+			}
+			name = strings.TrimSpace(name)
+			if !validFolderName(name) {
+				http.Error(w, "Invalid folder name", http.StatusBadRequest)
+				return
+			}
+		}
+
+		if rawParentID, ok := req["parent_id"]; ok {
+			parentID = nil
+			if err := json.Unmarshal(rawParentID, &parentID); err != nil {
+				http.Error(w, "Invalid parent folder ID", http.StatusBadRequest)
+				return
+			}
+			if err := checkFolderExists(db, parentID); err != nil {
+				if err == errFolderNotFound {
+					http.Error(w, "Parent folder not found", http.StatusNotFound)
+					return
+				}
+				log.Printf("Failed to query parent folder: %v", err)
+				http.Error(w, "Failed to query parent folder", http.StatusInternalServerError)
+				return
+			}
+			if parentID != nil {
+				cycle, err := isFolderDescendant(db, *parentID, folderID)
+				if err != nil {
+					log.Printf("Failed to check folder hierarchy: %v", err)
+					http.Error(w, "Failed to move folder", http.StatusInternalServerError)
+					return
+				}
+				if cycle {
+					http.Error(w, "Cannot move a folder into itself", http.StatusBadRequest)
+					return
+				}
+			}
+		}
+
+		taken, err := folderNameTaken(db, parentID, name, folderID)
+		if err != nil {
+			log.Printf("Failed to check folder name: %v", err)
+			http.Error(w, "Failed to update folder", http.StatusInternalServerError)
+			return
+		}
+		if taken {
+			http.Error(w, "A folder with this name already exists", http.StatusConflict)
+			return
+		}
+
+		if _, err := db.Exec("UPDATE folders SET name = ?, parent_id = ? WHERE id = ?", name, parentID, folderID); err != nil {
+			log.Printf("Failed to update folder %d: %v", folderID, err)
+			http.Error(w, "Failed to update folder", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"ok": true})
+	}
+}
+
+// deleteFolderHandler removes an empty folder. Folders that still contain
+// files or subfolders are rejected so nothing is deleted by accident.
+func deleteFolderHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		folderID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid folder ID", http.StatusBadRequest)
+			return
+		}
+
+		var fileCount, folderCount int
+		err = db.QueryRow(`SELECT
+			(SELECT COUNT(*) FROM files WHERE folder_id = ?),
+			(SELECT COUNT(*) FROM folders WHERE parent_id = ?)`, folderID, folderID).Scan(&fileCount, &folderCount)
+		if err != nil {
+			log.Printf("Failed to count folder contents for folder %d: %v", folderID, err)
+			http.Error(w, "Failed to query folder", http.StatusInternalServerError)
+			return
+		}
+		if fileCount > 0 || folderCount > 0 {
+			http.Error(w, "Folder is not empty", http.StatusConflict)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Failed to start transaction: %v", err)
+			http.Error(w, "Failed to delete folder", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		// Links uploading into the folder go with it. Links sharing it are
+		// revoked and kept with their access log.
+		_, err = tx.Exec("UPDATE shares SET folder_id = NULL, revoked_at = COALESCE(revoked_at, ?) WHERE folder_id = ?",
+			time.Now().UTC(), folderID)
+		if err == nil {
+			_, err = tx.Exec("DELETE FROM upload_requests WHERE folder_id = ?", folderID)
+		}
+		if err != nil {
+			log.Printf("Failed to delete shares of folder %d: %v", folderID, err)
+			http.Error(w, "Failed to delete folder", http.StatusInternalServerError)
+			return
+		}
+		res, err := tx.Exec("DELETE FROM folders WHERE id = ?", folderID)
+		if err != nil {
+			log.Printf("Failed to delete folder %d: %v", folderID, err)
+			http.Error(w, "Failed to delete folder", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "Folder not found", http.StatusNotFound)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			log.Printf("Failed to commit folder deletion: %v", err)
+			http.Error(w, "Failed to delete folder", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "message": "Folder deleted successfully."})
+	}
+}
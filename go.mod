@@ -3,8 +3,14 @@ module fileinpic
 go 1.23.3
 
 require (
-	github.com/google/uuid v1.6.0 // indirect
-	github.com/mattn/go-sqlite3 v1.14.32 // indirect
-	golang.org/x/image v0.10.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
+	github.com/coreos/go-oidc/v3 v3.11.0
+	github.com/google/uuid v1.6.0
+	github.com/mattn/go-sqlite3 v1.14.32
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
+	golang.org/x/crypto v0.31.0
+	golang.org/x/image v0.10.0
+	golang.org/x/oauth2 v0.21.0
+	gopkg.in/yaml.v3 v3.0.1
 )
+
+require github.com/go-jose/go-jose/v4 v4.0.2 // indirect
@@ -3,16 +3,70 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 )
 
 type FileInfo struct {
-	ID              int64     `json:"id"`
-	Filename        string    `json:"filename"`
-	Filesize        int64     `json:"filesize"`
-	UploadTimestamp time.Time `json:"upload_timestamp"`
+	ID              int64             `json:"id"`
+	Filename        string            `json:"filename"`
+	Filesize        int64             `json:"filesize"`
+	UploadTimestamp time.Time         `json:"upload_timestamp"`
+	HasPreview      bool              `json:"has_preview"`
+	ContentType     string            `json:"content_type"`
+	Inline          bool              `json:"inline"`
+	HasThumbnail    bool              `json:"has_thumbnail"`
+	FolderID        *int64            `json:"folder_id"`
+	Description     string            `json:"description"`
+	Tags            []string          `json:"tags"`
+	Metadata        map[string]string `json:"metadata"`
+	Source          string            `json:"source"`
+	Shared          bool              `json:"shared"`
+	OwnerID         *int64            `json:"owner_id"`
+	Owner           string            `json:"owner"`
+}
+
+// fileColumns is the column list read by scanFileInfo. Tags and metadata are
+// aggregated into JSON so a listing needs a single query.
+const fileColumns = `files.id, files.filename, files.filesize, files.upload_timestamp, files.has_preview,
+	files.content_type, files.folder_id, files.description, COALESCE(files.source, ''),
+	EXISTS (SELECT 1 FROM shares WHERE shares.file_id = files.id AND ` + activeShareCondition + `),
+	(SELECT json_group_array(tag) FROM (SELECT tag FROM file_tags WHERE file_id = files.id ORDER BY tag)),
+	(SELECT json_group_object(key, value) FROM file_metadata WHERE file_id = files.id),
+	files.owner_id, COALESCE((SELECT username FROM users WHERE users.id = files.owner_id), '')`
+
+// rowScanner is implemented by *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanFileInfo scans a row selected with fileColumns.
+func scanFileInfo(row rowScanner) (FileInfo, error) {
+	var file FileInfo
+	var folderID, ownerID sql.NullInt64
+	var tagsJSON, metadataJSON sql.NullString
+	err := row.Scan(&file.ID, &file.Filename, &file.Filesize, &file.UploadTimestamp, &file.HasPreview,
+		&file.ContentType, &folderID, &file.Description, &file.Source, &file.Shared, &tagsJSON, &metadataJSON,
+		&ownerID, &file.Owner)
+	if err != nil {
+		return file, err
+	}
+	if folderID.Valid {
+		file.FolderID = &folderID.Int64
+	}
+	if ownerID.Valid {
+		file.OwnerID = &ownerID.Int64
+	}
+	if err := scanTagsAndMetadata(tagsJSON, metadataJSON, &file); err != nil {
+		return file, err
+	}
+	file.Inline = isInlineContentType(file.ContentType)
+	file.HasThumbnail = supportsThumbnail(file.ContentType, file.Filesize)
+	return file, nil
 }
 
 type AppConfig struct {
@@ -27,41 +81,233 @@ type UploadResponse struct {
 	Src string `json:"src"`
 }
 
-func filesHandler(db *sql.DB) http.HandlerFunc {
+var errFileNotFound = errors.New("file not found")
+
+// errorWriter reports a failed request. http.Error is used by the session API
+// and jsonError by the v1 API, so handlers shared by both take one of them.
+type errorWriter func(w http.ResponseWriter, message string, code int)
+
+// jsonError writes an error as {"ok": false, "error": message}.
+func jsonError(w http.ResponseWriter, message string, code int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{"ok": false, "error": message})
+}
+
+// validFilename reports whether name can be used as a stored filename.
+func validFilename(name string) bool {
+	if name == "" || name == "." || name == ".." || len(name) > 255 || strings.ContainsAny(name, "/\\") {
+		return false
+	}
+	for _, c := range name {
+		if c < 0x20 || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// filesHandler lists files. With limit or cursor it returns a page with the
+// total and next cursor, otherwise an array of every matching file. See
+// parseFileListQuery for the supported search, filter, sort and pagination
+// parameters.
+func filesHandler(db *sql.DB, fail errorWriter) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		searchQuery := r.URL.Query().Get("search")
+		params := r.URL.Query()
+		err := resolveOwnerParam(params, currentUser(r))
+		var query *fileListQuery
+		if err == nil {
+			query, err = parseFileListQuery(params)
+		}
+		if err != nil {
+			fail(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 
-		var rows *sql.Rows
-		var err error
+		page, err := query.run(db)
+		if err != nil {
+			log.Printf("Failed to query files: %v", err)
+			fail(w, "Failed to query files", http.StatusInternalServerError)
+			return
+		}
 
-		if searchQuery != "" {
-			query := "SELECT id, filename, filesize, upload_timestamp FROM files WHERE filename LIKE ? AND filename != '' ORDER BY upload_timestamp DESC"
-			rows, err = db.Query(query, "%"+searchQuery+"%")
-		} else {
-			query := "SELECT id, filename, filesize, upload_timestamp FROM files WHERE filename != '' ORDER BY upload_timestamp DESC"
-			rows, err = db.Query(query)
+		var body interface{} = page
+		if !query.paged {
+			body = page.Files
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(body); err != nil {
+			log.Printf("Failed to encode files to JSON: %v", err)
 		}
+	}
+}
 
+// fileInfoHandler returns the details of a single file.
+func fileInfoHandler(db *sql.DB, fail errorWriter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fileID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
 		if err != nil {
-			http.Error(w, "Failed to query files", http.StatusInternalServerError)
+			fail(w, "Invalid file ID", http.StatusBadRequest)
 			return
 		}
-		defer rows.Close()
 
-		var files []FileInfo
-		for rows.Next() {
-			var file FileInfo
-			if err := rows.Scan(&file.ID, &file.Filename, &file.Filesize, &file.UploadTimestamp); err != nil {
-				http.Error(w, "Failed to scan file row", http.StatusInternalServerError)
+		file, err := scanFileInfo(db.QueryRow("SELECT "+fileColumns+" FROM files WHERE id = ? AND filename != ''", fileID))
+		if err != nil {
+			if err == sql.ErrNoRows {
+				fail(w, "File not found", http.StatusNotFound)
 				return
 			}
-			files = append(files, file)
+			log.Printf("Failed to query file %d: %v", fileID, err)
+			fail(w, "Failed to query file", http.StatusInternalServerError)
+			return
 		}
 
 		w.Header().Set("Content-Type", "application/json")
-		if err := json.NewEncoder(w).Encode(files); err != nil {
-			log.Printf("Failed to encode files to JSON: %v", err)
+		json.NewEncoder(w).Encode(file)
+	}
+}
+
+// updateFileHandler changes the editable properties of a file. Only the
+// fields present in the request body are updated.
+func updateFileHandler(db *sql.DB, fail errorWriter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fileID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			fail(w, "Invalid file ID", http.StatusBadRequest)
+			return
+		}
+
+		var req map[string]json.RawMessage
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			fail(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		if err := checkFileAccess(db, currentUser(r), fileID); err != nil {
+			writeFileAccessError(w, fail, err)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Failed to start transaction for file ID %d: %v", fileID, err)
+			fail(w, "Failed to start transaction", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		if rawFilename, ok := req["filename"]; ok {
+			var filename string
+			if err := json.Unmarshal(rawFilename, &filename); err != nil || !validFilename(strings.TrimSpace(filename)) {
+				fail(w, "Invalid filename", http.StatusBadRequest)
+				return
+			}
+			if _, err := tx.Exec("UPDATE files SET filename = ? WHERE id = ?", strings.TrimSpace(filename), fileID); err != nil {
+				log.Printf("Failed to rename file %d: %v", fileID, err)
+				fail(w, "Failed to update file", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		if rawFolderID, ok := req["folder_id"]; ok {
+			var folderID *int64
+			if err := json.Unmarshal(rawFolderID, &folderID); err != nil {
+				fail(w, "Invalid folder ID", http.StatusBadRequest)
+				return
+			}
+			if err := checkFolderExists(db, folderID); err != nil {
+				if err == errFolderNotFound {
+					fail(w, "Folder not found", http.StatusNotFound)
+					return
+				}
+				log.Printf("Failed to query folder: %v", err)
+				fail(w, "Failed to query folder", http.StatusInternalServerError)
+				return
+			}
+			if _, err := tx.Exec("UPDATE files SET folder_id = ? WHERE id = ?", folderID, fileID); err != nil {
+				log.Printf("Failed to move file %d: %v", fileID, err)
+				fail(w, "Failed to update file", http.StatusInternalServerError)
+				return
+			}
 		}
+
+		if rawDescription, ok := req["description"]; ok {
+			var description string
+			if err := json.Unmarshal(rawDescription, &description); err != nil {
+				fail(w, "Invalid description", http.StatusBadRequest)
+				return
+			}
+			description = strings.TrimSpace(description)
+			if err := validateDescription(description); err != nil {
+				fail(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if _, err := tx.Exec("UPDATE files SET description = ? WHERE id = ?", description, fileID); err != nil {
+				log.Printf("Failed to update description of file %d: %v", fileID, err)
+				fail(w, "Failed to update file", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		// Tags are replaced as a whole.
+		if rawTags, ok := req["tags"]; ok {
+			var tags []string
+			if err := json.Unmarshal(rawTags, &tags); err != nil {
+				fail(w, "Invalid tags", http.StatusBadRequest)
+				return
+			}
+			tags, err = normalizeTags(tags)
+			if err != nil {
+				fail(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := replaceFileTags(tx, fileID, tags); err != nil {
+				log.Printf("Failed to update tags of file %d: %v", fileID, err)
+				fail(w, "Failed to update file", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		// Metadata is merged key by key; a null value removes the key.
+		if rawMetadata, ok := req["metadata"]; ok {
+			var metadata map[string]*string
+			if err := json.Unmarshal(rawMetadata, &metadata); err != nil {
+				fail(w, "Invalid metadata", http.StatusBadRequest)
+				return
+			}
+			for key, value := range metadata {
+				key, err := normalizeMetadataKey(key)
+				if err == nil && value != nil {
+					err = validateMetadataValue(key, *value)
+				}
+				if err != nil {
+					fail(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				if err := setFileMetadata(tx, fileID, key, value); err != nil {
+					log.Printf("Failed to update metadata of file %d: %v", fileID, err)
+					fail(w, "Failed to update file", http.StatusInternalServerError)
+					return
+				}
+			}
+		}
+
+		if err := tx.Commit(); err != nil {
+			log.Printf("Failed to commit update of file %d: %v", fileID, err)
+			fail(w, "Failed to update file", http.StatusInternalServerError)
+			return
+		}
+
+		file, err := scanFileInfo(db.QueryRow("SELECT "+fileColumns+" FROM files WHERE id = ?", fileID))
+		if err != nil {
+			log.Printf("Failed to query updated file %d: %v", fileID, err)
+			fail(w, "Failed to query file", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(file)
 	}
 }
 
@@ -6,6 +6,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strings"
 
 	"gopkg.in/yaml.v3"
 )
@@ -15,6 +16,12 @@ type Config struct {
 	Password  string `yaml:"password"`
 	AuthToken string `yaml:"auth_token"`
 	ApiKey    string `yaml:"api_key"`
+
+	// TrustedProxies lists the reverse proxies, as CIDR ranges, whose
+	// X-Forwarded-For header gives the real client address.
+	TrustedProxies []string `yaml:"trusted_proxies"`
+
+	OIDC OIDCConfig `yaml:"oidc"`
 }
 
 func loadConfig(path string) (*Config, error) {
@@ -46,6 +53,17 @@ func main() {
 	config.Password = os.Getenv("PASSWORD")
 	config.AuthToken = os.Getenv("AUTH_TOKEN")
 	config.ApiKey = os.Getenv("API_KEY")
+	proxies := strings.Split(os.Getenv("TRUSTED_PROXIES"), ",")
+	oidcConfig := OIDCConfig{
+		Issuer:       os.Getenv("OIDC_ISSUER"),
+		ClientID:     os.Getenv("OIDC_CLIENT_ID"),
+		ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+		RedirectURL:  os.Getenv("OIDC_REDIRECT_URL"),
+		DefaultRole:  os.Getenv("OIDC_DEFAULT_ROLE"),
+	}
+	if emails := os.Getenv("OIDC_ALLOWED_EMAILS"); emails != "" {
+		oidcConfig.AllowedEmails = strings.Split(emails, ",")
+	}
 
 	// If a config file is provided, it overrides the environment variables
 	if *configPath != "" {
@@ -65,39 +83,150 @@ func main() {
 		if cfg.ApiKey != "" {
 			config.ApiKey = cfg.ApiKey
 		}
+		if len(cfg.TrustedProxies) > 0 {
+			proxies = cfg.TrustedProxies
+		}
+		if cfg.OIDC.Issuer != "" {
+			oidcConfig.Issuer = cfg.OIDC.Issuer
+		}
+		if cfg.OIDC.ClientID != "" {
+			oidcConfig.ClientID = cfg.OIDC.ClientID
+		}
+		if cfg.OIDC.ClientSecret != "" {
+			oidcConfig.ClientSecret = cfg.OIDC.ClientSecret
+		}
+		if cfg.OIDC.RedirectURL != "" {
+			oidcConfig.RedirectURL = cfg.OIDC.RedirectURL
+		}
+		if len(cfg.OIDC.AllowedEmails) > 0 {
+			oidcConfig.AllowedEmails = cfg.OIDC.AllowedEmails
+		}
+		if cfg.OIDC.DefaultRole != "" {
+			oidcConfig.DefaultRole = cfg.OIDC.DefaultRole
+		}
+	}
+
+	var err error
+	if trustedProxies, err = parseIPPrefixes(proxies); err != nil {
+		log.Fatalf("Invalid trusted_proxies: %v", err)
 	}
 
 	if config.Password == "" {
 		config.Password = "admin"
 	}
 
+	// api_key used to default to the password, and clients still rely on it.
 	if config.ApiKey == "" {
 		config.ApiKey = config.Password
+		log.Println("Warning: api_key is not set and defaults to password; this default is deprecated and will be removed. " +
+			"Create named API keys in the web UI, move clients to them and set api_key to a random value")
+	} else {
+		log.Println("Warning: api_key is deprecated, create named API keys in the web UI instead")
+	}
+
+	if oidcConfig.enabled() {
+		if oidcConfig.RedirectURL == "" {
+			if config.Host == "" {
+				log.Fatal("oidc.redirect_url or host must be set for single sign-on")
+			}
+			oidcConfig.RedirectURL = strings.TrimSuffix(config.Host, "/") + "/api/oidc/callback"
+		}
+		if oidcConfig.DefaultRole == "" {
+			oidcConfig.DefaultRole = roleMember
+		}
+		if !validRole(oidcConfig.DefaultRole) {
+			log.Fatalf("Invalid oidc.default_role %q", oidcConfig.DefaultRole)
+		}
+		if len(oidcConfig.AllowedEmails) == 0 {
+			log.Println("Warning: oidc.allowed_emails is empty, nobody can log in with single sign-on")
+		}
+		ssoClient = newOIDCClient(oidcConfig)
+		log.Printf("Single sign-on enabled with %s", oidcConfig.Issuer)
 	}
 
 	db := initDB("./fileinpic.db")
 	defer db.Close()
+	ensureAdminUser(db, config.Password)
+	manager = newSessionManager(db)
 	log.Println("Database initialized successfully.")
 
 	mux := http.NewServeMux()
 
 	// API routes
-	mux.Handle("POST /api/upload", authMiddleware(uploadHandler(db, config)))
+	mux.Handle("POST /api/upload", authMiddleware(requireRole(roleMember, uploadHandler(db, config))))
 	mux.Handle("GET /api/download/{id}", authMiddleware(downloadHandler(db)))
-	mux.Handle("DELETE /api/delete/{id}", authMiddleware(deleteHandler(db)))
-	mux.Handle("GET /api/files", authMiddleware(filesHandler(db)))
-	mux.Handle("POST /api/share", authMiddleware(shareHandler(db, &config)))
-	mux.HandleFunc("GET /api/share/info", shareInfoHandler(db))
-	mux.HandleFunc("GET /api/share/download", shareDownloadHandler(db))
-	mux.Handle("GET /api/file/share-details", authMiddleware(fileShareDetailsHandler(db)))
+	mux.Handle("DELETE /api/delete/{id}", authMiddleware(requireRole(roleMember, deleteHandler(db))))
+	mux.Handle("GET /api/files", authMiddleware(filesHandler(db, http.Error)))
+	mux.Handle("GET /api/files/archive", authMiddleware(archiveHandler(db)))
+	mux.Handle("GET /api/files/{id}/preview", authMiddleware(previewHandler(db)))
+	mux.Handle("GET /api/files/{id}/view", authMiddleware(viewHandler(db)))
+	mux.Handle("GET /api/files/{id}/thumbnail", authMiddleware(thumbnailHandler(db)))
+	mux.Handle("PATCH /api/files/{id}", authMiddleware(requireRole(roleMember, updateFileHandler(db, http.Error))))
+	mux.Handle("POST /api/bulk", authMiddleware(requireRole(roleMember, bulkHandler(db, &config, http.Error, "/api/jobs/"))))
+	mux.Handle("GET /api/jobs/{id}", authMiddleware(bulkJobHandler(http.Error)))
+	mux.Handle("GET /api/folders", authMiddleware(listFoldersHandler(db)))
+	mux.Handle("POST /api/folders", authMiddleware(requireRole(roleMember, createFolderHandler(db))))
+	mux.Handle("PATCH /api/folders/{id}", authMiddleware(requireRole(roleMember, updateFolderHandler(db))))
+	mux.Handle("DELETE /api/folders/{id}", authMiddleware(requireRole(roleMember, deleteFolderHandler(db))))
+	mux.Handle("POST /api/share", authMiddleware(requireRole(roleMember, shareHandler(db, &config))))
+	mux.HandleFunc("GET /api/share/info", shareInfoHandler(db, &config))
+	mux.HandleFunc("POST /api/share/unlock", shareUnlockHandler(db))
+	mux.HandleFunc("GET /api/share/download", shareDownloadHandler(db, &config))
+	mux.HandleFunc("GET /api/share/view", shareViewHandler(db))
+	mux.Handle("GET /api/file/share-details", authMiddleware(requireRole(roleMember, fileShareDetailsHandler(db, &config))))
+	mux.Handle("GET /api/shares", authMiddleware(requireRole(roleMember, listSharesHandler(db, &config, http.Error))))
+	mux.Handle("DELETE /api/shares/{id}", authMiddleware(requireRole(roleMember, revokeShareHandler(db, http.Error))))
+	mux.Handle("GET /api/shares/{id}/stats", authMiddleware(requireRole(roleMember, shareStatsHandler(db, http.Error))))
+	mux.Handle("GET /api/shares/{id}/access", authMiddleware(requireRole(roleMember, shareAccessHandler(db, http.Error))))
+	mux.Handle("POST /api/upload-requests", authMiddleware(requireRole(roleMember, createUploadRequestHandler(db, &config, http.Error))))
+	mux.Handle("GET /api/upload-requests", authMiddleware(requireRole(roleMember, listUploadRequestsHandler(db, &config, http.Error))))
+	mux.Handle("DELETE /api/upload-requests/{id}", authMiddleware(requireRole(roleMember, revokeUploadRequestHandler(db, http.Error))))
+	mux.HandleFunc("GET /api/upload-request/info", uploadRequestInfoHandler(db))
+	mux.HandleFunc("POST /api/upload-request/upload", uploadRequestUploadHandler(db, config))
 	mux.Handle("GET /api/config", authMiddleware(configHandler(config)))
-	mux.HandleFunc("POST /api/login", loginHandler(config))
+	mux.HandleFunc("POST /api/login", loginHandler(db))
+	mux.HandleFunc("GET /api/login/options", loginOptionsHandler())
+	mux.HandleFunc("GET /api/oidc/login", oidcLoginHandler())
+	mux.HandleFunc("GET /api/oidc/callback", oidcCallbackHandler(db))
+	mux.HandleFunc("POST /api/oidc/second-factor", oidcSecondFactorHandler(db))
+	mux.Handle("GET /api/oidc/link", authMiddleware(oidcLinkHandler()))
+	mux.Handle("GET /api/me", authMiddleware(meHandler()))
+	mux.Handle("POST /api/me/totp/setup", authMiddleware(totpSetupHandler(db)))
+	mux.Handle("POST /api/me/totp/enable", authMiddleware(totpEnableHandler(db)))
+	mux.Handle("POST /api/me/totp/disable", authMiddleware(totpDisableHandler(db)))
+	mux.Handle("POST /api/me/totp/recovery-codes", authMiddleware(recoveryCodesHandler(db)))
+	mux.Handle("POST /api/logout", authMiddleware(logoutHandler()))
+	mux.Handle("POST /api/logout-all", authMiddleware(logoutAllHandler()))
+	mux.Handle("GET /api/sessions", authMiddleware(listSessionsHandler(db)))
+	mux.Handle("DELETE /api/sessions/{id}", authMiddleware(revokeSessionHandler(db)))
+	mux.Handle("GET /api/users", authMiddleware(requireRole(roleAdmin, listUsersHandler(db))))
+	mux.Handle("POST /api/users", authMiddleware(requireRole(roleAdmin, createUserHandler(db))))
+	mux.Handle("PATCH /api/users/{id}", authMiddleware(updateUserHandler(db)))
+	mux.Handle("DELETE /api/users/{id}", authMiddleware(requireRole(roleAdmin, deleteUserHandler(db))))
+	mux.Handle("DELETE /api/users/{id}/totp", authMiddleware(requireRole(roleAdmin, resetTOTPHandler(db))))
+	mux.Handle("GET /api/api-keys", authMiddleware(requireRole(roleAdmin, listAPIKeysHandler(db))))
+	mux.Handle("POST /api/api-keys", authMiddleware(requireRole(roleAdmin, createAPIKeyHandler(db))))
+	mux.Handle("DELETE /api/api-keys/{id}", authMiddleware(requireRole(roleAdmin, revokeAPIKeyHandler(db))))
 
 	// API v1 routes
-	mux.Handle("POST /api/v1/files/upload", apiAuthMiddleware(apiUploadHandler(db, config), config))
-	mux.Handle("GET /api/v1/files/download/{id}", apiAuthMiddleware(downloadHandler(db), config))
-	mux.Handle("DELETE /api/v1/files/delete/{id}", apiAuthMiddleware(apiDeleteHandler(db), config))
+	mux.Handle("POST /api/v1/files/upload", apiAuthMiddleware(apiUploadHandler(db, config), db, config, scopeUpload))
+	mux.Handle("GET /api/v1/files/download/{id}", apiAuthMiddleware(downloadHandler(db), db, config, scopeDownload))
+	mux.Handle("DELETE /api/v1/files/delete/{id}", apiAuthMiddleware(apiDeleteHandler(db, &config), db, config, scopeDelete))
 	mux.HandleFunc("GET /api/v1/files/public/download/{id}", downloadHandler(db))
+	mux.Handle("GET /api/v1/files", apiAuthMiddleware(filesHandler(db, jsonError), db, config, scopeList))
+	mux.Handle("GET /api/v1/files/{id}", apiAuthMiddleware(fileInfoHandler(db, jsonError), db, config, scopeList))
+	mux.Handle("PATCH /api/v1/files/{id}", apiAuthMiddleware(updateFileHandler(db, jsonError), db, config, scopeUpload))
+	mux.Handle("POST /api/v1/files/{id}/shares", apiAuthMiddleware(apiCreateShareHandler(db, &config), db, config, scopeShare))
+	mux.Handle("POST /api/v1/shares", apiAuthMiddleware(apiShareHandler(db, &config), db, config, scopeShare))
+	mux.Handle("GET /api/v1/shares", apiAuthMiddleware(listSharesHandler(db, &config, jsonError), db, config, scopeShare))
+	mux.Handle("DELETE /api/v1/shares/{id}", apiAuthMiddleware(revokeShareHandler(db, jsonError), db, config, scopeShare))
+	mux.Handle("GET /api/v1/shares/{id}/stats", apiAuthMiddleware(shareStatsHandler(db, jsonError), db, config, scopeShare))
+	mux.Handle("GET /api/v1/shares/{id}/access", apiAuthMiddleware(shareAccessHandler(db, jsonError), db, config, scopeShare))
+	mux.Handle("POST /api/v1/upload-requests", apiAuthMiddleware(createUploadRequestHandler(db, &config, jsonError), db, config, scopeShare))
+	mux.Handle("GET /api/v1/upload-requests", apiAuthMiddleware(listUploadRequestsHandler(db, &config, jsonError), db, config, scopeShare))
+	mux.Handle("DELETE /api/v1/upload-requests/{id}", apiAuthMiddleware(revokeUploadRequestHandler(db, jsonError), db, config, scopeShare))
+	mux.Handle("POST /api/v1/bulk", apiAuthMiddleware(bulkHandler(db, &config, jsonError, "/api/v1/jobs/"), db, config, ""))
+	mux.Handle("GET /api/v1/jobs/{id}", apiAuthMiddleware(bulkJobHandler(jsonError), db, config, ""))
 
 	// Static file server for the frontend
 	fs := http.FileServer(http.Dir("./static"))
@@ -106,6 +235,8 @@ func main() {
 	mux.Handle("/login.html", fs)
 	mux.Handle("/share.html", fs)
 	mux.Handle("/share.js", fs)
+	mux.Handle("/upload.html", fs)
+	mux.Handle("/upload.js", fs)
 	mux.Handle("/style.css", fs)
 	mux.Handle("/app.js", fs) // Needed for login page
 
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+const (
+	maxTagLength         = 64
+	maxMetadataKeyLength = 64
+	maxMetadataValueSize = 1024
+	maxDescriptionSize   = 1024
+	metaHeaderPrefix     = "X-Meta-"
+	metaFormPrefix       = "meta_"
+)
+
+// fileAnnotations holds the user supplied information attached to a file.
+type fileAnnotations struct {
+	Tags        []string
+	Description string
+	Metadata    map[string]string
+}
+
+// normalizeTags trims, lowercases and de-duplicates tags, dropping empty ones.
+func normalizeTags(tags []string) ([]string, error) {
+	seen := make(map[string]bool)
+	result := []string{}
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || seen[tag] {
+			continue
+		}
+		if len(tag) > maxTagLength {
+			return nil, fmt.Errorf("tag %q is longer than %d characters", tag, maxTagLength)
+		}
+		seen[tag] = true
+		result = append(result, tag)
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// splitTags splits a comma separated tag list.
+func splitTags(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
+
+// normalizeMetadataKey lowercases a metadata key and checks that it only uses
+// characters that survive a round trip through an HTTP header name.
+func normalizeMetadataKey(key string) (string, error) {
+	key = strings.ToLower(strings.TrimSpace(key))
+	if key == "" || len(key) > maxMetadataKeyLength {
+		return "", fmt.Errorf("invalid metadata key %q", key)
+	}
+	for _, c := range key {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return "", fmt.Errorf("invalid metadata key %q", key)
+		}
+	}
+	return key, nil
+}
+
+func validateDescription(description string) error {
+	if len(description) > maxDescriptionSize {
+		return fmt.Errorf("description is longer than %d bytes", maxDescriptionSize)
+	}
+	return nil
+}
+
+func validateMetadataValue(key, value string) error {
+	if len(value) > maxMetadataValueSize {
+		return fmt.Errorf("metadata value for %q is longer than %d bytes", key, maxMetadataValueSize)
+	}
+	return nil
+}
+
+// annotationsFromForm reads tags, description and meta_* fields from a parsed
+// multipart form.
+func annotationsFromForm(r *http.Request) (fileAnnotations, error) {
+	var a fileAnnotations
+	var err error
+
+	a.Tags, err = normalizeTags(splitTags(r.FormValue("tags")))
+	if err != nil {
+		return a, err
+	}
+	a.Description = strings.TrimSpace(r.FormValue("description"))
+	if err := validateDescription(a.Description); err != nil {
+		return a, err
+	}
+
+	a.Metadata = make(map[string]string)
+	if r.MultipartForm != nil {
+		for name, values := range r.MultipartForm.Value {
+			if !strings.HasPrefix(name, metaFormPrefix) || len(values) == 0 {
+				continue
+			}
+			key, err := normalizeMetadataKey(strings.TrimPrefix(name, metaFormPrefix))
+			if err != nil {
+				return a, err
+			}
+			if err := validateMetadataValue(key, values[0]); err != nil {
+				return a, err
+			}
+			a.Metadata[key] = values[0]
+		}
+	}
+	return a, nil
+}
+
+// annotationsFromHeaders reads X-Tags, X-Description and X-Meta-* headers.
+func annotationsFromHeaders(h http.Header) (fileAnnotations, error) {
+	var a fileAnnotations
+	var err error
+
+	a.Tags, err = normalizeTags(splitTags(h.Get("X-Tags")))
+	if err != nil {
+		return a, err
+	}
+	a.Description = strings.TrimSpace(h.Get("X-Description"))
+	if err := validateDescription(a.Description); err != nil {
+		return a, err
+	}
+
+	a.Metadata = make(map[string]string)
+	for name, values := range h {
+		if !strings.HasPrefix(name, metaHeaderPrefix) || len(values) == 0 {
+			continue
+		}
+		key, err := normalizeMetadataKey(strings.TrimPrefix(name, metaHeaderPrefix))
+		if err != nil {
+			return a, err
+		}
+		if err := validateMetadataValue(key, values[0]); err != nil {
+			return a, err
+		}
+		a.Metadata[key] = values[0]
+	}
+	return a, nil
+}
+
+// saveFileAnnotations stores the annotations of a newly uploaded file.
+func saveFileAnnotations(db *sql.DB, fileID int64, a fileAnnotations) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("UPDATE files SET description = ? WHERE id = ?", a.Description, fileID); err != nil {
+		return err
+	}
+	if err := replaceFileTags(tx, fileID, a.Tags); err != nil {
+		return err
+	}
+	for key, value := range a.Metadata {
+		if err := setFileMetadata(tx, fileID, key, &value); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// replaceFileTags sets the tags of a file to exactly the given list.
+func replaceFileTags(tx *sql.Tx, fileID int64, tags []string) error {
+	if _, err := tx.Exec("DELETE FROM file_tags WHERE file_id = ?", fileID); err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		if _, err := tx.Exec("INSERT INTO file_tags (file_id, tag) VALUES (?, ?)", fileID, tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setFileMetadata sets a metadata value on a file. A nil value removes the key.
+func setFileMetadata(tx *sql.Tx, fileID int64, key string, value *string) error {
+	if value == nil {
+		_, err := tx.Exec("DELETE FROM file_metadata WHERE file_id = ? AND key = ?", fileID, key)
+		return err
+	}
+	_, err := tx.Exec(`INSERT INTO file_metadata (file_id, key, value) VALUES (?, ?, ?)
+		ON CONFLICT(file_id, key) DO UPDATE SET value = excluded.value`, fileID, key, *value)
+	return err
+}
+
+// scanTagsAndMetadata decodes the JSON produced by the tag and metadata
+// subqueries in fileColumns.
+func scanTagsAndMetadata(tagsJSON, metadataJSON sql.NullString, file *FileInfo) error {
+	file.Tags = []string{}
+	file.Metadata = map[string]string{}
+	if tagsJSON.Valid {
+		if err := json.Unmarshal([]byte(tagsJSON.String), &file.Tags); err != nil {
+			return err
+		}
+	}
+	if metadataJSON.Valid {
+		if err := json.Unmarshal([]byte(metadataJSON.String), &file.Metadata); err != nil {
+			return err
+		}
+	}
+	return nil
+}
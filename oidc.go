@@ -0,0 +1,602 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// oidcLoginTTL is how long a user has to finish logging in at the
+	// identity provider.
+	oidcLoginTTL = 10 * time.Minute
+	// oidcStateCookie binds a login to the browser that started it.
+	oidcStateCookie = "oidc_state"
+	// oidcPendingCookie holds a login by a user with two-factor
+	// authentication that still needs the code.
+	oidcPendingCookie = "oidc_pending"
+)
+
+var (
+	errOIDCNotAllowed = errors.New("email address is not allowed to log in")
+	errOIDCUnverified = errors.New("email address is not verified")
+	errOIDCUnlinked   = errors.New("a user with this email address exists but has not linked single sign-on")
+	errOIDCTaken      = errors.New("this identity is already linked to another user")
+)
+
+// OIDCConfig configures single sign-on with an OpenID Connect provider. It
+// is enabled when both Issuer and ClientID are set.
+type OIDCConfig struct {
+	Issuer       string `yaml:"issuer"`
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+	// RedirectURL is the callback registered with the provider. It defaults
+	// to host + "/api/oidc/callback".
+	RedirectURL string `yaml:"redirect_url"`
+	// AllowedEmails lists who may log in, as full addresses or as
+	// "@example.com" for a whole domain.
+	AllowedEmails []string `yaml:"allowed_emails"`
+	// DefaultRole is the role of accounts created on first login.
+	DefaultRole string `yaml:"default_role"`
+}
+
+func (c *OIDCConfig) enabled() bool {
+	return c.Issuer != "" && c.ClientID != ""
+}
+
+// allowed reports whether email may log in.
+func (c *OIDCConfig) allowed(email string) bool {
+	email = strings.ToLower(email)
+	for _, entry := range c.AllowedEmails {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == email || (strings.HasPrefix(entry, "@") && strings.HasSuffix(email, entry)) {
+			return true
+		}
+	}
+	return false
+}
+
+// oidcLogin is a login waiting for the provider to redirect back.
+type oidcLogin struct {
+	verifier  string // PKCE code verifier
+	nonce     string
+	createdAt time.Time
+	// linkUserID is set when a logged in user is linking their account
+	// to the identity rather than logging in.
+	linkUserID int64
+}
+
+// pendingLogin is a single sign-on login by a user with two-factor
+// authentication, waiting for the user to enter their code. It expires
+// oidcLoginTTL after the provider redirected back.
+type pendingLogin struct {
+	userID    int64
+	createdAt time.Time
+}
+
+// oidcClient talks to the identity provider. The provider is discovered on
+// first use, so the server starts even while the provider is down, and
+// discovery is retried until it succeeds.
+type oidcClient struct {
+	config OIDCConfig
+
+	mu       sync.Mutex
+	provider *oidc.Provider
+	logins   map[string]*oidcLogin // by state
+	pending  map[string]*pendingLogin
+}
+
+// Global OIDC client, set up by main when single sign-on is configured.
+var ssoClient *oidcClient
+
+// newOIDCClient returns an OIDC client and starts a background goroutine that
+// forgets abandoned logins periodically.
+func newOIDCClient(config OIDCConfig) *oidcClient {
+	c := &oidcClient{config: config, logins: make(map[string]*oidcLogin), pending: make(map[string]*pendingLogin)}
+	go c.cleanupLogins()
+	return c
+}
+
+// oauth2Config returns the OAuth 2.0 client configuration, discovering the
+// provider if that has not been done yet. Discovery runs without holding mu,
+// so a slow provider does not hold up other logins.
+func (c *oidcClient) oauth2Config(ctx context.Context) (*oauth2.Config, *oidc.Provider, error) {
+	c.mu.Lock()
+	provider := c.provider
+	c.mu.Unlock()
+	if provider == nil {
+		discovered, err := oidc.NewProvider(ctx, c.config.Issuer)
+		if err != nil {
+			return nil, nil, err
+		}
+		c.mu.Lock()
+		if c.provider == nil {
+			c.provider = discovered
+		}
+		provider = c.provider
+		c.mu.Unlock()
+	}
+	return &oauth2.Config{
+		ClientID:     c.config.ClientID,
+		ClientSecret: c.config.ClientSecret,
+		RedirectURL:  c.config.RedirectURL,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       []string{oidc.ScopeOpenID, "email", "profile"},
+	}, provider, nil
+}
+
+// start records a new login and returns its state. linkUserID is the user
+// linking their account, or 0 for a login.
+func (c *oidcClient) start(linkUserID int64) (string, *oidcLogin, error) {
+	state, err := randomHex(16)
+	if err != nil {
+		return "", nil, err
+	}
+	nonce, err := randomHex(16)
+	if err != nil {
+		return "", nil, err
+	}
+	login := &oidcLogin{verifier: oauth2.GenerateVerifier(), nonce: nonce, createdAt: time.Now(), linkUserID: linkUserID}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.logins[state] = login
+	return state, login, nil
+}
+
+// finish removes and returns the login with the given state, or nil if there
+// is none or it has expired. Each state can only be used once.
+func (c *oidcClient) finish(state string) *oidcLogin {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	login, ok := c.logins[state]
+	if !ok {
+		return nil
+	}
+	delete(c.logins, state)
+	if time.Since(login.createdAt) > oidcLoginTTL {
+		return nil
+	}
+	return login
+}
+
+// waitForSecondFactor records a login by the user that still needs the
+// two-factor code and returns its token.
+func (c *oidcClient) waitForSecondFactor(userID int64) (string, error) {
+	token, err := randomHex(32)
+	if err != nil {
+		return "", err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pending[token] = &pendingLogin{userID: userID, createdAt: time.Now()}
+	return token, nil
+}
+
+// pendingUserID returns the user of the pending login with the given token,
+// or 0 if there is none or it has expired. The login stays pending, so the
+// user can retry a mistyped code, until removePending is called.
+func (c *oidcClient) pendingUserID(token string) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	login, ok := c.pending[token]
+	if !ok || time.Since(login.createdAt) > oidcLoginTTL {
+		return 0
+	}
+	return login.userID
+}
+
+func (c *oidcClient) removePending(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.pending, token)
+}
+
+// cleanupLogins removes logins that were never finished.
+func (c *oidcClient) cleanupLogins() {
+	ticker := time.NewTicker(oidcLoginTTL)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		c.mu.Lock()
+		for state, login := range c.logins {
+			if time.Since(login.createdAt) > oidcLoginTTL {
+				delete(c.logins, state)
+			}
+		}
+		for token, login := range c.pending {
+			if time.Since(login.createdAt) > oidcLoginTTL {
+				delete(c.pending, token)
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+func randomHex(n int) (string, error) {
+	bytes := make([]byte, n)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bytes), nil
+}
+
+// oidcClaims are the ID token claims used to find the local user.
+type oidcClaims struct {
+	Subject       string `json:"sub"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+}
+
+// checkOIDCClaims reports whether the identity may use single sign-on at
+// all. Tokens without email_verified are refused like unverified ones.
+func checkOIDCClaims(config *OIDCConfig, claims *oidcClaims) error {
+	if !claims.EmailVerified {
+		return errOIDCUnverified
+	}
+	if claims.Email == "" || !config.allowed(claims.Email) {
+		return errOIDCNotAllowed
+	}
+	return nil
+}
+
+// oidcUser returns the local user for an identity, creating the account on
+// first login. The identity is found by its subject. It is never linked to
+// an existing user by email address: whoever controls that address at the
+// provider would get the account without its password or two-factor check.
+// Existing users link their identity themselves with oidcLinkHandler.
+func oidcUser(db *sql.DB, config *OIDCConfig, claims *oidcClaims) (*User, error) {
+	if err := checkOIDCClaims(config, claims); err != nil {
+		return nil, err
+	}
+
+	user, err := scanUser(db.QueryRow("SELECT "+userColumns+" FROM users WHERE oidc_subject = ?", claims.Subject))
+	if err != errUserNotFound {
+		return user, err
+	}
+
+	var taken int
+	if err := db.QueryRow("SELECT COUNT(*) FROM users WHERE username = ?", claims.Email).Scan(&taken); err != nil {
+		return nil, err
+	}
+	if taken > 0 {
+		return nil, errOIDCUnlinked
+	}
+	if !validUsername(claims.Email) {
+		return nil, fmt.Errorf("email address %q cannot be used as a username", claims.Email)
+	}
+	// The account has no password; it can only log in through the
+	// provider until an admin sets one.
+	res, err := db.Exec("INSERT INTO users (username, password, role, oidc_subject) VALUES (?, '', ?, ?)",
+		claims.Email, config.DefaultRole, claims.Subject)
+	if err != nil {
+		return nil, err
+	}
+	id, _ := res.LastInsertId()
+	log.Printf("Created user %q (%s) for single sign-on", claims.Email, config.DefaultRole)
+	return lookupUser(db, id)
+}
+
+// linkOIDCUser links an identity to a user who started the link while
+// logged in, replacing any identity linked before.
+func linkOIDCUser(db *sql.DB, config *OIDCConfig, userID int64, claims *oidcClaims) error {
+	if err := checkOIDCClaims(config, claims); err != nil {
+		return err
+	}
+	var taken int
+	if err := db.QueryRow("SELECT COUNT(*) FROM users WHERE oidc_subject = ? AND id != ?", claims.Subject, userID).Scan(&taken); err != nil {
+		return err
+	}
+	if taken > 0 {
+		return errOIDCTaken
+	}
+	res, err := db.Exec("UPDATE users SET oidc_subject = ? WHERE id = ?", claims.Subject, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errUserNotFound
+	}
+	return nil
+}
+
+// sessionUserID returns the ID of the user logged in with the request's
+// session cookie, or 0 if there is none.
+func sessionUserID(r *http.Request) int64 {
+	c, err := r.Cookie("session_token")
+	if err != nil {
+		return 0
+	}
+	s, err := manager.Load(c.Value)
+	if err != nil {
+		return 0
+	}
+	return s.User.ID
+}
+
+// oidcLoginHandler sends the browser to the identity provider, using the
+// authorization code flow with PKCE.
+func oidcLoginHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		startOIDCLogin(w, r, 0, "/login.html")
+	}
+}
+
+// oidcLinkHandler sends a logged in user to the identity provider to link
+// their account to the identity they log in with there.
+func oidcLinkHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		startOIDCLogin(w, r, currentUser(r).ID, "/")
+	}
+}
+
+// startOIDCLogin redirects to the identity provider. Errors send the browser
+// to failPage.
+func startOIDCLogin(w http.ResponseWriter, r *http.Request, linkUserID int64, failPage string) {
+	if ssoClient == nil {
+		http.Error(w, "Single sign-on is not configured", http.StatusNotFound)
+		return
+	}
+	oauth2Config, _, err := ssoClient.oauth2Config(r.Context())
+	if err != nil {
+		log.Printf("Failed to discover OIDC provider %s: %v", ssoClient.config.Issuer, err)
+		http.Redirect(w, r, failPage+"?sso_error=failed", http.StatusFound)
+		return
+	}
+	state, login, err := ssoClient.start(linkUserID)
+	if err != nil {
+		log.Printf("Failed to start OIDC login: %v", err)
+		http.Error(w, "Failed to start login", http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/api/oidc/",
+		MaxAge:   int(oidcLoginTTL / time.Second),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, oauth2Config.AuthCodeURL(state, oidc.Nonce(login.nonce),
+		oauth2.S256ChallengeOption(login.verifier)), http.StatusFound)
+}
+
+// oidcCallbackHandler completes a login when the identity provider redirects
+// back: it exchanges the code for an ID token, verifies it and starts a
+// session for the matching local user, or links the identity to the user
+// who started a link. Users with two-factor authentication are sent to the
+// login page to enter their code first, see oidcSecondFactorHandler. Errors send the browser back to the login page, or to
+// the main page for links.
+func oidcCallbackHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if ssoClient == nil {
+			http.Error(w, "Single sign-on is not configured", http.StatusNotFound)
+			return
+		}
+		failPage := "/login.html"
+		fail := func(reason string) {
+			http.Redirect(w, r, failPage+"?sso_error="+url.QueryEscape(reason), http.StatusFound)
+		}
+
+		query := r.URL.Query()
+		state := query.Get("state")
+		c, err := r.Cookie(oidcStateCookie)
+		http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: "/api/oidc/", MaxAge: -1, HttpOnly: true})
+		if err != nil || state == "" || c.Value != state {
+			log.Printf("OIDC callback from %s with an unknown state", clientIP(r))
+			fail("failed")
+			return
+		}
+		login := ssoClient.finish(state)
+		if login == nil {
+			fail("expired")
+			return
+		}
+		if login.linkUserID != 0 {
+			failPage = "/"
+		}
+		if errorCode := query.Get("error"); errorCode != "" {
+			log.Printf("OIDC provider refused login: %s %s", errorCode, query.Get("error_description"))
+			fail("failed")
+			return
+		}
+
+		oauth2Config, provider, err := ssoClient.oauth2Config(r.Context())
+		if err != nil {
+			log.Printf("Failed to discover OIDC provider %s: %v", ssoClient.config.Issuer, err)
+			fail("failed")
+			return
+		}
+		token, err := oauth2Config.Exchange(r.Context(), query.Get("code"), oauth2.VerifierOption(login.verifier))
+		if err != nil {
+			log.Printf("Failed to exchange OIDC code: %v", err)
+			fail("failed")
+			return
+		}
+		rawIDToken, ok := token.Extra("id_token").(string)
+		if !ok {
+			log.Printf("OIDC token response has no ID token")
+			fail("failed")
+			return
+		}
+		idToken, err := provider.Verifier(&oidc.Config{ClientID: ssoClient.config.ClientID}).Verify(r.Context(), rawIDToken)
+		if err != nil {
+			log.Printf("Failed to verify OIDC ID token: %v", err)
+			fail("failed")
+			return
+		}
+		if idToken.Nonce != login.nonce {
+			log.Printf("OIDC ID token has the wrong nonce")
+			fail("failed")
+			return
+		}
+		var claims oidcClaims
+		if err := idToken.Claims(&claims); err != nil {
+			log.Printf("Failed to read OIDC ID token claims: %v", err)
+			fail("failed")
+			return
+		}
+
+		if login.linkUserID != 0 {
+			// The user who started the link must still be logged in.
+			if sessionUserID(r) != login.linkUserID {
+				fail("expired")
+				return
+			}
+			err := linkOIDCUser(db, &ssoClient.config, login.linkUserID, &claims)
+			switch err {
+			case nil:
+				log.Printf("Linked user %d to single sign-on as %q", login.linkUserID, claims.Email)
+				http.Redirect(w, r, "/?sso=linked", http.StatusFound)
+			case errOIDCNotAllowed, errOIDCUnverified:
+				log.Printf("Refused to link user %d to %q: %v", login.linkUserID, claims.Email, err)
+				fail("denied")
+			case errOIDCTaken:
+				log.Printf("Refused to link user %d to %q: %v", login.linkUserID, claims.Email, err)
+				fail("taken")
+			default:
+				log.Printf("Failed to link user %d to single sign-on: %v", login.linkUserID, err)
+				fail("failed")
+			}
+			return
+		}
+
+		user, err := oidcUser(db, &ssoClient.config, &claims)
+		if err == errOIDCNotAllowed || err == errOIDCUnverified {
+			log.Printf("Refused single sign-on for %q from %s: %v", claims.Email, clientIP(r), err)
+			fail("denied")
+			return
+		}
+		if err == errOIDCUnlinked {
+			log.Printf("Refused single sign-on for %q from %s: %v", claims.Email, clientIP(r), err)
+			fail("unlinked")
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to find user for %q: %v", claims.Email, err)
+			fail("failed")
+			return
+		}
+
+		if user.TOTPEnabled {
+			pendingToken, err := ssoClient.waitForSecondFactor(user.ID)
+			if err != nil {
+				log.Printf("Failed to start two-factor check for user %q: %v", user.Username, err)
+				fail("failed")
+				return
+			}
+			http.SetCookie(w, &http.Cookie{
+				Name:     oidcPendingCookie,
+				Value:    pendingToken,
+				Path:     "/api/oidc/",
+				MaxAge:   int(oidcLoginTTL / time.Second),
+				HttpOnly: true,
+				SameSite: http.SameSiteStrictMode,
+			})
+			http.Redirect(w, r, "/login.html?sso=code", http.StatusFound)
+			return
+		}
+
+		sessionToken, expiry, err := manager.Create(user, r)
+		if err != nil {
+			log.Printf("Failed to create session for user %q: %v", user.Username, err)
+			fail("failed")
+			return
+		}
+		log.Printf("User %q logged in with single sign-on", user.Username)
+
+		setSessionCookie(w, sessionToken, expiry)
+		http.Redirect(w, r, "/", http.StatusFound)
+	}
+}
+
+// oidcSecondFactorHandler finishes a single sign-on login by a user with
+// two-factor authentication, who sends their TOTP or recovery code. Wrong
+// codes count against the same limit as for password logins.
+func oidcSecondFactorHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if ssoClient == nil {
+			http.Error(w, "Single sign-on is not configured", http.StatusNotFound)
+			return
+		}
+		var req struct {
+			Code string `json:"code"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		c, err := r.Cookie(oidcPendingCookie)
+		if err != nil {
+			http.Error(w, "Login expired", http.StatusUnauthorized)
+			return
+		}
+		userID := ssoClient.pendingUserID(c.Value)
+		if userID == 0 {
+			http.Error(w, "Login expired", http.StatusUnauthorized)
+			return
+		}
+		user, err := lookupUser(db, userID)
+		if err == errUserNotFound {
+			ssoClient.removePending(c.Value)
+			http.Error(w, "Login expired", http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to query user %d: %v", userID, err)
+			http.Error(w, "Failed to log in", http.StatusInternalServerError)
+			return
+		}
+
+		attempt, ok := beginLoginAttempt(w, r, user.Username)
+		if !ok {
+			return
+		}
+		// An admin may have reset two-factor authentication meanwhile.
+		if user.TOTPEnabled {
+			if err := checkSecondFactor(db, user.ID, req.Code); err != nil {
+				finishSecondFactorAttempt(attempt, err)
+				writeSecondFactorError(w, err)
+				return
+			}
+		}
+		attempt.succeed()
+		ssoClient.removePending(c.Value)
+		http.SetCookie(w, &http.Cookie{Name: oidcPendingCookie, Path: "/api/oidc/", MaxAge: -1, HttpOnly: true})
+
+		sessionToken, expiry, err := manager.Create(user, r)
+		if err != nil {
+			log.Printf("Failed to create session for user %q: %v", user.Username, err)
+			http.Error(w, "Failed to log in", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("User %q logged in with single sign-on and two-factor code", user.Username)
+
+		setSessionCookie(w, sessionToken, expiry)
+	}
+}
+
+// loginOptionsHandler tells the login page which ways of logging in are
+// available.
+func loginOptionsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"sso": ssoClient != nil})
+	}
+}
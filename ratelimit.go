@@ -0,0 +1,273 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// freeAttempts is how many wrong passwords a client may send for one
+	// account or link before it has to wait between tries.
+	freeAttempts = 5
+	// ipFreeAttempts is how many wrong passwords a client may send for all
+	// accounts or links together, so it cannot try a few passwords against
+	// every account instead.
+	ipFreeAttempts = 20
+	// Lockouts start at attemptBaseDelay and double with every further
+	// failure, up to attemptMaxDelay.
+	attemptBaseDelay = 2 * time.Second
+	attemptMaxDelay  = 15 * time.Minute
+	// attemptMemory is how long a client's failures are remembered after its
+	// last one.
+	attemptMemory = 1 * time.Hour
+
+	// Once globalAttemptLimit failures from all clients together pile up
+	// within globalAttemptWindow, further attempts are refused for the rest
+	// of the window, so spreading guesses over many addresses does not get
+	// around the per-client lockout. Addresses that got a password right
+	// within trustedClientMemory are exempt, so an attack does not keep the
+	// rightful users out.
+	globalAttemptWindow = 1 * time.Minute
+	globalAttemptLimit  = 100
+	trustedClientMemory = 7 * 24 * time.Hour
+)
+
+// attemptRecord tracks the failed password attempts of one client, either at
+// one account or link or at all of them.
+type attemptRecord struct {
+	failures int
+	last     time.Time
+}
+
+// lockedUntil returns when the client may try again after allowed free
+// failures.
+func (r *attemptRecord) lockedUntil(allowed int) time.Time {
+	if r.failures < allowed {
+		return time.Time{}
+	}
+	delay := attemptMaxDelay
+	if shift := r.failures - allowed; shift < 20 {
+		delay = min(attemptBaseDelay<<shift, attemptMaxDelay)
+	}
+	return r.last.Add(delay)
+}
+
+// attemptLimiter slows down password guessing. Each client is locked out of
+// an account or link, and of all of them, for exponentially longer after too
+// many consecutive failures, and unknown clients are refused while failures
+// pile up globally.
+//
+// An attempt counts as a failure from the moment it starts until it is
+// reported as a success, so parallel requests cannot all get past the
+// lockout before the first of them fails.
+type attemptLimiter struct {
+	name string // what is being guessed, for the log
+
+	mu             sync.Mutex
+	targets        map[string]*attemptRecord // by attemptKey
+	ips            map[string]*attemptRecord
+	trusted        map[string]time.Time // last success by IP
+	windowStart    time.Time
+	windowFailures int
+}
+
+func newAttemptLimiter(name string) *attemptLimiter {
+	return &attemptLimiter{
+		name:    name,
+		targets: make(map[string]*attemptRecord),
+		ips:     make(map[string]*attemptRecord),
+		trusted: make(map[string]time.Time),
+	}
+}
+
+var (
+	// loginAttempts limits guesses at user passwords and two-factor codes.
+	loginAttempts = newAttemptLimiter("login")
+	// linkPasswordAttempts limits guesses at share and upload link
+	// passwords.
+	linkPasswordAttempts = newAttemptLimiter("link password")
+)
+
+// init starts a background goroutine to forget old failures periodically.
+func init() {
+	go loginAttempts.cleanupAttempts()
+	go linkPasswordAttempts.cleanupAttempts()
+}
+
+// attemptKey identifies a client guessing at target, such as a username or
+// link.
+func attemptKey(ip, target string) string {
+	return ip + " for " + target
+}
+
+// passwordAttempt is an attempt started with attemptLimiter.begin. Exactly
+// one of its methods must be called once the password has been checked.
+type passwordAttempt struct {
+	limiter *attemptLimiter
+	ip      string
+	key     string
+	number  int // consecutive failures at the target, counting this one
+}
+
+// record returns the record of key in records, starting a new one if the
+// old failures are no longer remembered.
+func record(records map[string]*attemptRecord, key string, now time.Time) *attemptRecord {
+	r, ok := records[key]
+	if !ok || now.Sub(r.last) > attemptMemory {
+		r = &attemptRecord{}
+		records[key] = r
+	}
+	return r
+}
+
+// retryAfterLocked returns how long the client at ip has to wait before it
+// may try target again. l.mu must be held.
+func (l *attemptLimiter) retryAfterLocked(ip, target string, now time.Time) time.Duration {
+	var until time.Time
+	if r, ok := l.targets[attemptKey(ip, target)]; ok {
+		until = r.lockedUntil(freeAttempts)
+	}
+	if r, ok := l.ips[ip]; ok {
+		if ipUntil := r.lockedUntil(ipFreeAttempts); ipUntil.After(until) {
+			until = ipUntil
+		}
+	}
+	if _, ok := l.trusted[ip]; !ok && l.windowFailures >= globalAttemptLimit && now.Sub(l.windowStart) <= globalAttemptWindow {
+		if windowEnd := l.windowStart.Add(globalAttemptWindow); windowEnd.After(until) {
+			until = windowEnd
+		}
+	}
+	return max(until.Sub(now), 0)
+}
+
+// retryAfter returns how long the client at ip has to wait before it may
+// try target again, or zero if it may try now.
+func (l *attemptLimiter) retryAfter(ip, target string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.retryAfterLocked(ip, target, time.Now())
+}
+
+// begin starts an attempt by the client at ip to guess the password of
+// target. If the client has to wait, begin returns how long and no attempt.
+// Otherwise the attempt is counted as a failure until it succeeds.
+func (l *attemptLimiter) begin(ip, target string) (*passwordAttempt, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if wait := l.retryAfterLocked(ip, target, now); wait > 0 {
+		return nil, wait
+	}
+
+	key := attemptKey(ip, target)
+	targetRecord := record(l.targets, key, now)
+	for _, r := range []*attemptRecord{targetRecord, record(l.ips, ip, now)} {
+		r.failures++
+		r.last = now
+	}
+	if now.Sub(l.windowStart) > globalAttemptWindow {
+		l.windowStart = now
+		l.windowFailures = 0
+	}
+	l.windowFailures++
+	if l.windowFailures == globalAttemptLimit {
+		log.Printf("Too many failed %s attempts, refusing unknown clients until %s",
+			l.name, l.windowStart.Add(globalAttemptWindow).Format(time.RFC3339))
+	}
+	return &passwordAttempt{limiter: l, ip: ip, key: key, number: targetRecord.failures}, 0
+}
+
+// fail logs the attempt, which is already counted as a failure. detail, such
+// as a failed two-factor code, is only logged.
+func (a *passwordAttempt) fail(detail string) {
+	l := a.limiter
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	r := record(l.targets, a.key, time.Now())
+	message := fmt.Sprintf("Failed %s attempt from %s (%d in a row)", l.name, a.key, a.number)
+	if detail != "" {
+		message += ": " + detail
+	}
+	if wait := time.Until(r.lockedUntil(freeAttempts)); wait > 0 {
+		message += fmt.Sprintf(", locked out for %s", wait.Round(time.Second))
+	}
+	log.Print(message)
+}
+
+// cancel takes the attempt back without counting it either way, for
+// attempts that did not get as far as a guess, such as a login with the
+// right password that still needs its two-factor code.
+func (a *passwordAttempt) cancel() {
+	l := a.limiter
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.unreserve(a)
+}
+
+// succeed forgets the client's failures at the target after a correct
+// password and trusts its address. Failures at other targets still count
+// against the address.
+func (a *passwordAttempt) succeed() {
+	l := a.limiter
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.unreserve(a)
+	delete(l.targets, a.key)
+	l.trusted[a.ip] = time.Now()
+}
+
+// unreserve takes back the failure counted when the attempt began. l.mu must
+// be held.
+func (l *attemptLimiter) unreserve(a *passwordAttempt) {
+	for _, r := range []*attemptRecord{l.targets[a.key], l.ips[a.ip]} {
+		if r != nil && r.failures > 0 {
+			r.failures--
+		}
+	}
+	if l.windowFailures > 0 {
+		l.windowFailures--
+	}
+}
+
+// cleanupAttempts removes clients whose failures are no longer remembered.
+func (l *attemptLimiter) cleanupAttempts() {
+	ticker := time.NewTicker(10 * time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		l.mu.Lock()
+		l.forgetOld(time.Now())
+		l.mu.Unlock()
+	}
+}
+
+// forgetOld removes records that are no longer remembered. l.mu must be
+// held.
+func (l *attemptLimiter) forgetOld(now time.Time) {
+	for _, records := range []map[string]*attemptRecord{l.targets, l.ips} {
+		for key, r := range records {
+			// attemptMemory outlasts the longest lockout.
+			if now.Sub(r.last) > attemptMemory {
+				delete(records, key)
+			}
+		}
+	}
+	for ip, last := range l.trusted {
+		if now.Sub(last) > trustedClientMemory {
+			delete(l.trusted, ip)
+		}
+	}
+}
+
+// writeTooManyAttempts tells the client to wait before trying again.
+func writeTooManyAttempts(w http.ResponseWriter, wait time.Duration) {
+	seconds := int((wait + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, fmt.Sprintf("Too many failed attempts, try again in %d seconds", seconds), http.StatusTooManyRequests)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// failAttempts makes n failed attempts by ip at target and returns how many
+// were let through.
+func failAttempts(l *attemptLimiter, ip, target string, n int) int {
+	started := 0
+	for i := 0; i < n; i++ {
+		if a, _ := l.begin(ip, target); a != nil {
+			started++
+			a.fail("")
+		}
+	}
+	return started
+}
+
+func TestAttemptRecordLockedUntil(t *testing.T) {
+	last := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		failures int
+		want     time.Duration // zero means not locked
+	}{
+		{0, 0},
+		{freeAttempts - 1, 0},
+		{freeAttempts, attemptBaseDelay},
+		{freeAttempts + 1, 2 * attemptBaseDelay},
+		{freeAttempts + 3, 8 * attemptBaseDelay},
+		{freeAttempts + 15, attemptMaxDelay},
+		{freeAttempts + 1000, attemptMaxDelay},
+	}
+	for _, tt := range tests {
+		r := &attemptRecord{failures: tt.failures, last: last}
+		got := r.lockedUntil(freeAttempts)
+		if tt.want == 0 {
+			if !got.IsZero() {
+				t.Errorf("%d failures: locked until %v, want not locked", tt.failures, got)
+			}
+			continue
+		}
+		if d := got.Sub(last); d != tt.want {
+			t.Errorf("%d failures: locked for %v, want %v", tt.failures, d, tt.want)
+		}
+	}
+}
+
+func TestAttemptLimiterConcurrentLockout(t *testing.T) {
+	for _, parallel := range []int{freeAttempts, 10, 100} {
+		l := newAttemptLimiter("test")
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		started := 0
+		start := make(chan struct{})
+		for i := 0; i < parallel; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				a, wait := l.begin("192.0.2.1", "user")
+				if a == nil {
+					if wait <= 0 {
+						t.Error("refused attempt without a wait")
+					}
+					return
+				}
+				mu.Lock()
+				started++
+				mu.Unlock()
+				// Hold the attempt open so the others overlap with it.
+				time.Sleep(time.Millisecond)
+				a.fail("")
+			}()
+		}
+		close(start)
+		wg.Wait()
+
+		if want := min(parallel, freeAttempts); started != want {
+			t.Errorf("%d parallel attempts: %d got through, want %d", parallel, started, want)
+		}
+		if l.retryAfter("192.0.2.1", "user") <= 0 {
+			t.Errorf("%d parallel attempts: client is not locked out", parallel)
+		}
+	}
+}
+
+func TestAttemptLimiter(t *testing.T) {
+	tests := []struct {
+		name string
+		run  func(l *attemptLimiter) error
+	}{
+		{"locks out after free attempts", func(l *attemptLimiter) error {
+			if n := failAttempts(l, "192.0.2.1", "user", freeAttempts+3); n != freeAttempts {
+				return fmt.Errorf("%d attempts got through, want %d", n, freeAttempts)
+			}
+			return nil
+		}},
+		{"other clients and targets are not locked out", func(l *attemptLimiter) error {
+			failAttempts(l, "192.0.2.1", "user", freeAttempts)
+			if l.retryAfter("192.0.2.2", "user") > 0 {
+				return fmt.Errorf("other IP is locked out")
+			}
+			if l.retryAfter("192.0.2.1", "other") > 0 {
+				return fmt.Errorf("other target is locked out")
+			}
+			return nil
+		}},
+		{"success forgets failures at the target", func(l *attemptLimiter) error {
+			failAttempts(l, "192.0.2.1", "user", freeAttempts-1)
+			a, _ := l.begin("192.0.2.1", "user")
+			a.succeed()
+			if n := failAttempts(l, "192.0.2.1", "user", freeAttempts); n != freeAttempts {
+				return fmt.Errorf("%d attempts got through after a success, want %d", n, freeAttempts)
+			}
+			return nil
+		}},
+		{"cancelled attempts do not count", func(l *attemptLimiter) error {
+			for i := 0; i < 3*freeAttempts; i++ {
+				a, _ := l.begin("192.0.2.1", "user")
+				if a == nil {
+					return fmt.Errorf("attempt %d refused", i+1)
+				}
+				a.cancel()
+			}
+			return nil
+		}},
+		{"per-IP bucket stops spraying across targets", func(l *attemptLimiter) error {
+			started := 0
+			for i := 0; i < ipFreeAttempts+5; i++ {
+				started += failAttempts(l, "192.0.2.1", fmt.Sprintf("user%d", i), 1)
+			}
+			if started != ipFreeAttempts {
+				return fmt.Errorf("%d attempts got through, want %d", started, ipFreeAttempts)
+			}
+			if l.retryAfter("192.0.2.2", "fresh") > 0 {
+				return fmt.Errorf("other IP is locked out")
+			}
+			return nil
+		}},
+		{"global limit refuses unknown clients only", func(l *attemptLimiter) error {
+			a, _ := l.begin("192.0.2.200", "user")
+			a.succeed()
+			for i := 0; i < globalAttemptLimit; i++ {
+				failAttempts(l, fmt.Sprintf("198.51.100.%d", i), "user", 1)
+			}
+			if l.retryAfter("203.0.113.1", "user") <= 0 {
+				return fmt.Errorf("unknown client is let through at the global limit")
+			}
+			if l.retryAfter("192.0.2.200", "user") > 0 {
+				return fmt.Errorf("trusted client is refused at the global limit")
+			}
+			return nil
+		}},
+		{"old records are forgotten", func(l *attemptLimiter) error {
+			failAttempts(l, "192.0.2.1", "user", freeAttempts)
+			a, _ := l.begin("192.0.2.2", "user")
+			a.succeed()
+			l.mu.Lock()
+			l.forgetOld(time.Now().Add(trustedClientMemory + time.Minute))
+			targets, ips, trusted := len(l.targets), len(l.ips), len(l.trusted)
+			l.mu.Unlock()
+			if targets != 0 || ips != 0 || trusted != 0 {
+				return fmt.Errorf("%d targets, %d IPs and %d trusted clients left", targets, ips, trusted)
+			}
+			return nil
+		}},
+	}
+	for _, tt := range tests {
+		if err := tt.run(newAttemptLimiter("test")); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"unicode"
+)
+
+// searchIndexEnabled is set when the SQLite build supports FTS5 (build with
+// -tags sqlite_fts5). Without it searches fall back to LIKE matching.
+var searchIndexEnabled bool
+
+// ftsSourceSQL selects the indexed text of every named file.
+const ftsSourceSQL = `
+	INSERT INTO files_fts (rowid, filename, description, tags, metadata)
+	SELECT id, filename, description,
+		(SELECT group_concat(tag, ' ') FROM file_tags WHERE file_id = files.id),
+		(SELECT group_concat(key || ' ' || value, ' ') FROM file_metadata WHERE file_id = files.id)
+	FROM files WHERE filename != ''`
+
+// ftsRefreshSQL rebuilds the index row of the file whose ID is %[1]s.
+const ftsRefreshSQL = `DELETE FROM files_fts WHERE rowid = %[1]s;` + ftsSourceSQL + ` AND id = %[1]s;`
+
+// ftsTriggers lists the triggers that keep files_fts in sync, as name, event
+// and the expression that yields the affected file ID.
+var ftsTriggers = []struct {
+	name, event, fileID string
+}{
+	{"files_fts_files_insert", "AFTER INSERT ON files", "new.id"},
+	{"files_fts_files_update", "AFTER UPDATE OF filename, description ON files", "new.id"},
+	{"files_fts_tags_insert", "AFTER INSERT ON file_tags", "new.file_id"},
+	{"files_fts_tags_delete", "AFTER DELETE ON file_tags", "old.file_id"},
+	{"files_fts_metadata_insert", "AFTER INSERT ON file_metadata", "new.file_id"},
+	{"files_fts_metadata_update", "AFTER UPDATE ON file_metadata", "new.file_id"},
+	{"files_fts_metadata_delete", "AFTER DELETE ON file_metadata", "old.file_id"},
+}
+
+// ftsDeleteTrigger removes the index row of a deleted file.
+const ftsDeleteTrigger = "files_fts_files_delete"
+
+// initSearchIndex creates the FTS5 index and its triggers, and fills the index
+// if it is out of step with the files table. Without FTS5 it removes an index
+// left by an earlier build with FTS5, whose triggers would make every change
+// to files fail.
+func initSearchIndex(db *sql.DB) {
+	var fts5 bool
+	if err := db.QueryRow("SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&fts5); err != nil {
+		log.Fatalf("Failed to check SQLite compile options: %v", err)
+	}
+	if !fts5 {
+		log.Println("Full-text search unavailable, falling back to simple matching (build with -tags sqlite_fts5)")
+		if err := dropSearchIndex(db); err != nil {
+			log.Fatalf("Failed to remove search index: %v", err)
+		}
+		return
+	}
+
+	_, err := db.Exec(`CREATE VIRTUAL TABLE IF NOT EXISTS files_fts USING fts5(
+		filename, description, tags, metadata,
+		tokenize = 'unicode61 remove_diacritics 2'
+	);`)
+	if err != nil {
+		log.Fatalf("Failed to create search index: %v", err)
+	}
+
+	for _, t := range ftsTriggers {
+		trigger := fmt.Sprintf("CREATE TRIGGER IF NOT EXISTS %s %s BEGIN %s END;",
+			t.name, t.event, fmt.Sprintf(ftsRefreshSQL, t.fileID))
+		if _, err := db.Exec(trigger); err != nil {
+			log.Fatalf("Failed to create trigger %s: %v", t.name, err)
+		}
+	}
+	_, err = db.Exec(`CREATE TRIGGER IF NOT EXISTS ` + ftsDeleteTrigger + ` AFTER DELETE ON files BEGIN
+		DELETE FROM files_fts WHERE rowid = old.id;
+	END;`)
+	if err != nil {
+		log.Fatalf("Failed to create trigger %s: %v", ftsDeleteTrigger, err)
+	}
+
+	var indexed, total int
+	err = db.QueryRow("SELECT (SELECT COUNT(*) FROM files_fts), (SELECT COUNT(*) FROM files WHERE filename != '')").Scan(&indexed, &total)
+	if err != nil {
+		log.Fatalf("Failed to count search index rows: %v", err)
+	}
+	if indexed != total {
+		log.Printf("Rebuilding search index (%d of %d files indexed)", indexed, total)
+		if _, err := db.Exec("DELETE FROM files_fts;" + ftsSourceSQL); err != nil {
+			log.Fatalf("Failed to rebuild search index: %v", err)
+		}
+	}
+
+	searchIndexEnabled = true
+}
+
+// dropSearchIndex removes the FTS5 index and its triggers. SQLite cannot drop
+// a virtual table whose module is missing, so the table's schema entry is
+// removed directly and its shadow tables are dropped like normal tables. The
+// next build with FTS5 creates and fills the index again.
+func dropSearchIndex(db *sql.DB) error {
+	ctx := context.Background()
+	// PRAGMAs apply to one connection.
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	for _, t := range ftsTriggers {
+		if _, err := conn.ExecContext(ctx, "DROP TRIGGER IF EXISTS "+t.name); err != nil {
+			return err
+		}
+	}
+	if _, err := conn.ExecContext(ctx, "DROP TRIGGER IF EXISTS "+ftsDeleteTrigger); err != nil {
+		return err
+	}
+
+	var count int
+	if err := conn.QueryRowContext(ctx, "SELECT COUNT(*) FROM sqlite_master WHERE name = 'files_fts'").Scan(&count); err != nil {
+		return err
+	}
+	if count == 0 {
+		return nil
+	}
+	log.Println("Removing the full-text search index of an earlier build with FTS5")
+
+	var version int
+	if err := conn.QueryRowContext(ctx, "PRAGMA schema_version").Scan(&version); err != nil {
+		return err
+	}
+	for _, stmt := range []string{
+		"PRAGMA writable_schema = ON",
+		"DELETE FROM sqlite_master WHERE type = 'table' AND name = 'files_fts'",
+		"PRAGMA writable_schema = OFF",
+		// Makes every connection reload the schema.
+		fmt.Sprintf("PRAGMA schema_version = %d", version+1),
+		"DROP TABLE IF EXISTS files_fts_data",
+		"DROP TABLE IF EXISTS files_fts_idx",
+		"DROP TABLE IF EXISTS files_fts_content",
+		"DROP TABLE IF EXISTS files_fts_docsize",
+		"DROP TABLE IF EXISTS files_fts_config",
+	} {
+		if _, err := conn.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// buildFTSQuery turns a search box string into an FTS5 MATCH expression.
+// Double-quoted parts are phrases; every other word is matched as a prefix.
+// All terms must match. It returns "" if the input has no searchable terms.
+func buildFTSQuery(input string) string {
+	var terms []string
+	for i, part := range strings.Split(input, `"`) {
+		if i%2 == 1 {
+			// Inside quotes: an exact phrase.
+			if words := ftsWords(part); len(words) > 0 {
+				terms = append(terms, `"`+strings.Join(words, " ")+`"`)
+			}
+			continue
+		}
+		for _, word := range ftsWords(part) {
+			terms = append(terms, `"`+word+`"*`)
+		}
+	}
+	return strings.Join(terms, " ")
+}
+
+// ftsWords splits text into the tokens the unicode61 tokenizer would produce,
+// which also strips anything FTS5 would parse as query syntax.
+func ftsWords(text string) []string {
+	return strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
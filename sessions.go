@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// sessionLifetime is how long a login lasts.
+	sessionLifetime = 24 * time.Hour
+	// sessionTouchInterval limits how often last_seen_at is written, so
+	// browsing does not turn every request into a database write.
+	sessionTouchInterval = time.Minute
+)
+
+var errSessionNotFound = errors.New("session not found")
+
+// session is a row of the sessions table, with the user it belongs to. Only
+// a hash of the session token is stored, so a copy of the database cannot
+// be used to log in.
+type session struct {
+	ID         int64
+	User       User
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+	ExpiresAt  time.Time
+	IP         string
+	UserAgent  string
+}
+
+// SessionInfo describes a session in API responses.
+type SessionInfo struct {
+	ID         int64     `json:"id"`
+	UserID     int64     `json:"user_id"`
+	Username   string    `json:"username"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"user_agent"`
+	Current    bool      `json:"current"`
+}
+
+// sessionColumns is the column list scanSession expects.
+const sessionColumns = `sessions.id, sessions.created_at, sessions.last_seen_at, sessions.expires_at,
+	sessions.ip, sessions.user_agent, ` + userColumns
+
+func scanSession(row rowScanner) (*session, error) {
+	var s session
+	err := row.Scan(&s.ID, &s.CreatedAt, &s.LastSeenAt, &s.ExpiresAt, &s.IP, &s.UserAgent,
+		&s.User.ID, &s.User.Username, &s.User.Role, &s.User.CreatedAt, &s.User.TOTPEnabled, &s.User.HasPassword)
+	if err == sql.ErrNoRows {
+		return nil, errSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// info returns the API representation of the session. current is the
+// session of the request.
+func (s *session) info(current *session) SessionInfo {
+	return SessionInfo{
+		ID:         s.ID,
+		UserID:     s.User.ID,
+		Username:   s.User.Username,
+		CreatedAt:  s.CreatedAt,
+		LastSeenAt: s.LastSeenAt,
+		ExpiresAt:  s.ExpiresAt,
+		IP:         s.IP,
+		UserAgent:  s.UserAgent,
+		Current:    current != nil && current.ID == s.ID,
+	}
+}
+
+// sessionManager stores login sessions in the database, so they survive
+// restarts.
+type sessionManager struct {
+	db *sql.DB
+}
+
+// Global session manager, set up by main once the database is open.
+var manager *sessionManager
+
+// newSessionManager returns a session manager and starts a background
+// goroutine that removes expired sessions periodically.
+func newSessionManager(db *sql.DB) *sessionManager {
+	m := &sessionManager{db: db}
+	go m.cleanupSessions()
+	return m
+}
+
+// Create starts a session for a user logging in with r and returns its
+// token.
+func (m *sessionManager) Create(user *User, r *http.Request) (string, time.Time, error) {
+	token := uuid.NewString()
+	now := time.Now().UTC()
+	expiry := now.Add(sessionLifetime)
+	_, err := m.db.Exec(`INSERT INTO sessions (token_hash, user_id, created_at, last_seen_at, expires_at, ip, user_agent)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		hashToken(token), user.ID, now, now, expiry, clientIP(r), r.UserAgent())
+	return token, expiry, err
+}
+
+// Load returns the unexpired session with the given token and records that
+// it was seen.
+func (m *sessionManager) Load(token string) (*session, error) {
+	s, err := scanSession(m.db.QueryRow("SELECT "+sessionColumns+` FROM sessions
+		JOIN users ON users.id = sessions.user_id
+		WHERE sessions.token_hash = ? AND sessions.expires_at > ?`, hashToken(token), time.Now().UTC()))
+	if err != nil {
+		return nil, err
+	}
+	if time.Since(s.LastSeenAt) > sessionTouchInterval {
+		s.LastSeenAt = time.Now().UTC()
+		if _, err := m.db.Exec("UPDATE sessions SET last_seen_at = ? WHERE id = ?", s.LastSeenAt, s.ID); err != nil {
+			log.Printf("Failed to update session %d: %v", s.ID, err)
+		}
+	}
+	return s, nil
+}
+
+// Delete ends a session.
+func (m *sessionManager) Delete(id int64) error {
+	_, err := m.db.Exec("DELETE FROM sessions WHERE id = ?", id)
+	return err
+}
+
+// DeleteUser ends all sessions of a user.
+func (m *sessionManager) DeleteUser(userID int64) error {
+	_, err := m.db.Exec("DELETE FROM sessions WHERE user_id = ?", userID)
+	return err
+}
+
+// DeleteOthers ends all sessions of a user except keepID.
+func (m *sessionManager) DeleteOthers(userID, keepID int64) error {
+	_, err := m.db.Exec("DELETE FROM sessions WHERE user_id = ? AND id != ?", userID, keepID)
+	return err
+}
+
+// cleanupSessions removes expired sessions.
+func (m *sessionManager) cleanupSessions() {
+	ticker := time.NewTicker(1 * time.Hour)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if _, err := m.db.Exec("DELETE FROM sessions WHERE expires_at <= ?", time.Now().UTC()); err != nil {
+			log.Printf("Failed to remove expired sessions: %v", err)
+		}
+	}
+}
+
+type sessionContextKey struct{}
+
+// withSession returns the request with its session, and the session's user,
+// attached.
+func withSession(r *http.Request, s *session) *http.Request {
+	r = withUser(r, &s.User)
+	return r.WithContext(context.WithValue(r.Context(), sessionContextKey{}, s))
+}
+
+// currentSession returns the session of a web UI request, or nil for v1 API
+// requests.
+func currentSession(r *http.Request) *session {
+	s, _ := r.Context().Value(sessionContextKey{}).(*session)
+	return s
+}
+
+// clearSessionCookie removes the session cookie from the browser.
+func clearSessionCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     "session_token",
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// logoutHandler ends the session of the request.
+func logoutHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s := currentSession(r)
+		if err := manager.Delete(s.ID); err != nil {
+			log.Printf("Failed to delete session %d: %v", s.ID, err)
+			http.Error(w, "Failed to log out", http.StatusInternalServerError)
+			return
+		}
+		clearSessionCookie(w)
+		log.Printf("User %q logged out", s.User.Username)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "message": "Logged out."})
+	}
+}
+
+// logoutAllHandler ends every session of the logged in user, on all devices.
+func logoutAllHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := currentUser(r)
+		if err := manager.DeleteUser(user.ID); err != nil {
+			log.Printf("Failed to delete sessions of user %d: %v", user.ID, err)
+			http.Error(w, "Failed to log out", http.StatusInternalServerError)
+			return
+		}
+		clearSessionCookie(w)
+		log.Printf("User %q logged out everywhere", user.Username)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "message": "Logged out on all devices."})
+	}
+}
+
+// listSessionsHandler lists the active sessions of the logged in user, most
+// recently seen first. Admins may list another user's sessions with
+// user_id, or everyone's with user_id=all.
+func listSessionsHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := currentUser(r)
+		query := "SELECT " + sessionColumns + ` FROM sessions JOIN users ON users.id = sessions.user_id
+			WHERE sessions.expires_at > ?`
+		args := []interface{}{time.Now().UTC()}
+
+		switch param := r.URL.Query().Get("user_id"); {
+		case param == "":
+			query += " AND sessions.user_id = ?"
+			args = append(args, user.ID)
+		case !user.can(roleAdmin):
+			http.Error(w, "Permission denied", http.StatusForbidden)
+			return
+		case param == "all":
+		default:
+			userID, err := strconv.ParseInt(param, 10, 64)
+			if err != nil {
+				http.Error(w, "Invalid user ID", http.StatusBadRequest)
+				return
+			}
+			query += " AND sessions.user_id = ?"
+			args = append(args, userID)
+		}
+
+		rows, err := db.Query(query+" ORDER BY sessions.last_seen_at DESC", args...)
+		if err != nil {
+			log.Printf("Failed to query sessions: %v", err)
+			http.Error(w, "Failed to query sessions", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		current := currentSession(r)
+		infos := []SessionInfo{}
+		for rows.Next() {
+			s, err := scanSession(rows)
+			if err != nil {
+				log.Printf("Failed to scan session row: %v", err)
+				http.Error(w, "Failed to query sessions", http.StatusInternalServerError)
+				return
+			}
+			infos = append(infos, s.info(current))
+		}
+		if err := rows.Err(); err != nil {
+			log.Printf("Failed to read session rows: %v", err)
+			http.Error(w, "Failed to query sessions", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"sessions": infos})
+	}
+}
+
+// revokeSessionHandler ends a session. Users may end their own sessions;
+// admins may end anyone's.
+func revokeSessionHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid session ID", http.StatusBadRequest)
+			return
+		}
+
+		var ownerID int64
+		err = db.QueryRow("SELECT user_id FROM sessions WHERE id = ?", id).Scan(&ownerID)
+		user := currentUser(r)
+		// Other users' sessions are reported as missing to non-admins.
+		if err == sql.ErrNoRows || (err == nil && ownerID != user.ID && !user.can(roleAdmin)) {
+			http.Error(w, "Session not found", http.StatusNotFound)
+			return
+		}
+		if err == nil {
+			err = manager.Delete(id)
+		}
+		if err != nil {
+			log.Printf("Failed to revoke session %d: %v", id, err)
+			http.Error(w, "Failed to revoke session", http.StatusInternalServerError)
+			return
+		}
+		if s := currentSession(r); s != nil && s.ID == id {
+			clearSessionCookie(w)
+		}
+
+		log.Printf("Revoked session %d", id)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "message": "Session revoked."})
+	}
+}
@@ -5,12 +5,375 @@ import (
 	"database/sql"
 	"encoding/hex"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"io"
 	"log"
 	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
 )
 
+const maxShareLabelLength = 100
+
+// activeShareCondition matches share rows that can still be used.
+const activeShareCondition = `shares.revoked_at IS NULL
+	AND (shares.expires_at IS NULL OR datetime(shares.expires_at) > datetime('now'))
+	AND (shares.max_downloads IS NULL OR shares.download_count < shares.max_downloads)`
+
+// shareColumns is the column list scanShare expects.
+const shareColumns = `shares.id, shares.kind, COALESCE(shares.file_id, 0), shares.folder_id, shares.token,
+	shares.label, shares.password, shares.created_at,
+	shares.expires_at, shares.max_downloads, shares.download_count, shares.revoked_at, shares.burn, shares.allowed_ips,
+	shares.created_by`
+
+// Share kinds
+const (
+	shareKindFile       = "file"
+	shareKindFolder     = "folder"
+	shareKindCollection = "collection"
+)
+
+// What a one-time share destroys after its download completed
+const (
+	shareBurnLink = "link" // revoke the link, keep the file
+	shareBurnFile = "file" // delete the file, and with it the link
+)
+
+var (
+	errShareNotFound  = errors.New("share not found")
+	errShareRevoked   = errors.New("this share link has been revoked")
+	errShareExpired   = errors.New("this share link has expired")
+	errShareExhausted = errors.New("this share link has reached its download limit")
+	errShareIPDenied  = errors.New("this share link cannot be used from your network")
+)
+
+// shareOptions are the settings chosen when a file is shared. A nil ExpiresAt
+// or MaxDownloads means the share has no such limit. BurnAfterDownload makes
+// a one-time share of a single file, and AllowedIPs limits the share to the
+// given CIDR ranges.
+type shareOptions struct {
+	Label             string     `json:"label"`
+	Password          string     `json:"password"`
+	ExpiresAt         *time.Time `json:"expires_at"`
+	MaxDownloads      *int64     `json:"max_downloads"`
+	BurnAfterDownload string     `json:"burn_after_download"` // "", "link" or "file"
+	AllowedIPs        []string   `json:"allowed_ips"`
+
+	// passwordHash, if set, is used instead of hashing Password again, so
+	// that sharing many files with one password only hashes it once.
+	passwordHash string
+	// createdBy is the user creating the share, nil for API clients.
+	createdBy *int64
+}
+
+func (o shareOptions) validate() error {
+	if len(o.Label) > maxShareLabelLength {
+		return errors.New("label is too long")
+	}
+	// bcrypt only uses the first 72 bytes of a password.
+	if len(o.Password) > 72 {
+		return errors.New("password is too long")
+	}
+	if o.ExpiresAt != nil && !o.ExpiresAt.After(time.Now()) {
+		return errors.New("expires_at must be in the future")
+	}
+	if o.MaxDownloads != nil && *o.MaxDownloads < 1 {
+		return errors.New("max_downloads must be at least 1")
+	}
+	switch o.BurnAfterDownload {
+	case "", shareBurnLink, shareBurnFile:
+	default:
+		return errors.New("burn_after_download must be link or file")
+	}
+	if o.BurnAfterDownload != "" && o.MaxDownloads != nil && *o.MaxDownloads != 1 {
+		return errors.New("one-time shares allow exactly one download")
+	}
+	if _, err := parseIPPrefixes(o.AllowedIPs); err != nil {
+		return err
+	}
+	return nil
+}
+
+// hashSharePassword returns the bcrypt hash stored for a share password. An
+// empty password stays empty, meaning the share has none.
+func hashSharePassword(password string) (string, error) {
+	if password == "" {
+		return "", nil
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// isPasswordHash reports whether a stored share password is already hashed,
+// as opposed to the plaintext kept by older versions.
+func isPasswordHash(stored string) bool {
+	_, err := bcrypt.Cost([]byte(stored))
+	return err == nil
+}
+
+// shareRecord is a row of the shares table. FileID is only set for file
+// shares and FolderID for folder shares. The file fields are only filled in
+// by lookupShare, for file shares.
+type shareRecord struct {
+	ID            int64
+	Kind          string
+	FileID        int64
+	FolderID      sql.NullInt64
+	Token         string
+	Label         string
+	PasswordHash  string
+	CreatedAt     time.Time
+	ExpiresAt     sql.NullTime
+	MaxDownloads  sql.NullInt64
+	DownloadCount int64
+	RevokedAt     sql.NullTime
+	Burn          string
+	AllowedIPs    string // comma separated CIDR ranges, empty for anywhere
+	CreatedBy     sql.NullInt64
+
+	Filename    string
+	Filesize    int64
+	ContentType string
+}
+
+// ShareInfo describes a share link in API responses.
+type ShareInfo struct {
+	ID                 int64      `json:"id"`
+	Kind               string     `json:"kind"`
+	FileID             *int64     `json:"file_id"`
+	FolderID           *int64     `json:"folder_id"`
+	Token              string     `json:"share_token"`
+	Link               string     `json:"share_link"`
+	Label              string     `json:"label"`
+	PasswordProtected  bool       `json:"password_protected"`
+	CreatedAt          time.Time  `json:"created_at"`
+	ExpiresAt          *time.Time `json:"expires_at"`
+	ExpiresIn          *int64     `json:"expires_in"` // seconds left
+	MaxDownloads       *int64     `json:"max_downloads"`
+	DownloadCount      int64      `json:"download_count"`
+	RemainingDownloads *int64     `json:"remaining_downloads"`
+	RevokedAt          *time.Time `json:"revoked_at"`
+	BurnAfterDownload  string     `json:"burn_after_download"`
+	AllowedIPs         []string   `json:"allowed_ips"`
+	Active             bool       `json:"active"`
+	CreatedBy          *int64     `json:"created_by"`
+}
+
+// scanShare scans a row selected with shareColumns, followed by extra.
+func scanShare(row rowScanner, extra ...interface{}) (*shareRecord, error) {
+	var s shareRecord
+	dest := []interface{}{&s.ID, &s.Kind, &s.FileID, &s.FolderID, &s.Token, &s.Label, &s.PasswordHash, &s.CreatedAt,
+		&s.ExpiresAt, &s.MaxDownloads, &s.DownloadCount, &s.RevokedAt, &s.Burn, &s.AllowedIPs, &s.CreatedBy}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// checkPassword reports whether password unlocks the share. The comparison
+// takes the same time however much of the password is right.
+func (s *shareRecord) checkPassword(password string) bool {
+	if s.PasswordHash == "" {
+		return true
+	}
+	return bcrypt.CompareHashAndPassword([]byte(s.PasswordHash), []byte(password)) == nil
+}
+
+// attemptTarget names the share for linkPasswordAttempts.
+func (s *shareRecord) attemptTarget() string {
+	return "share " + strconv.FormatInt(s.ID, 10)
+}
+
+// check reports whether the share can still be used.
+func (s *shareRecord) check() error {
+	if s.RevokedAt.Valid {
+		return errShareRevoked
+	}
+	if s.ExpiresAt.Valid && !time.Now().Before(s.ExpiresAt.Time) {
+		return errShareExpired
+	}
+	if s.MaxDownloads.Valid && s.DownloadCount >= s.MaxDownloads.Int64 {
+		return errShareExhausted
+	}
+	return nil
+}
+
+// allowsClient reports whether the request comes from a network the share
+// may be used from.
+func (s *shareRecord) allowsClient(r *http.Request) bool {
+	if s.AllowedIPs == "" {
+		return true
+	}
+	// The ranges were checked when the share was created.
+	prefixes, _ := parseIPPrefixes(strings.Split(s.AllowedIPs, ","))
+	return ipInPrefixes(clientIP(r), prefixes)
+}
+
+// info returns the API representation of the share.
+func (s *shareRecord) info(config *AppConfig) ShareInfo {
+	info := ShareInfo{
+		ID:                s.ID,
+		Kind:              s.Kind,
+		Token:             s.Token,
+		Link:              shareLink(config, s.Token),
+		Label:             s.Label,
+		PasswordProtected: s.PasswordHash != "",
+		CreatedAt:         s.CreatedAt,
+		DownloadCount:     s.DownloadCount,
+		BurnAfterDownload: s.Burn,
+		AllowedIPs:        []string{},
+		Active:            s.check() == nil,
+	}
+	if s.AllowedIPs != "" {
+		info.AllowedIPs = strings.Split(s.AllowedIPs, ",")
+	}
+	// Links of deleted files have no file.
+	if s.Kind == shareKindFile && s.FileID != 0 {
+		info.FileID = &s.FileID
+	}
+	if s.FolderID.Valid {
+		info.FolderID = &s.FolderID.Int64
+	}
+	if s.ExpiresAt.Valid {
+		expiresAt := s.ExpiresAt.Time.UTC()
+		expiresIn := max(0, int64(time.Until(expiresAt).Seconds()))
+		info.ExpiresAt, info.ExpiresIn = &expiresAt, &expiresIn
+	}
+	if s.MaxDownloads.Valid {
+		remaining := max(0, s.MaxDownloads.Int64-s.DownloadCount)
+		info.MaxDownloads, info.RemainingDownloads = &s.MaxDownloads.Int64, &remaining
+	}
+	if s.RevokedAt.Valid {
+		info.RevokedAt = &s.RevokedAt.Time
+	}
+	if s.CreatedBy.Valid {
+		info.CreatedBy = &s.CreatedBy.Int64
+	}
+	return info
+}
+
+// lookupShare finds the share with the given token and, for file shares, the
+// file it shares.
+func lookupShare(db *sql.DB, token string) (*shareRecord, error) {
+	var filename, contentType sql.NullString
+	var filesize sql.NullInt64
+	row := db.QueryRow(`SELECT `+shareColumns+`, files.filename, files.filesize, files.content_type
+		FROM shares LEFT JOIN files ON files.id = shares.file_id AND files.filename != ''
+		WHERE shares.token = ?`, token)
+	s, err := scanShare(row, &filename, &filesize, &contentType)
+	if err == sql.ErrNoRows {
+		return nil, errShareNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if s.Kind == shareKindFile && !filename.Valid {
+		return nil, errShareNotFound
+	}
+	s.Filename, s.Filesize, s.ContentType = filename.String, filesize.Int64, contentType.String
+	return s, nil
+}
+
+// openShareToken looks up the share with the given token for a visitor and
+// checks that it can still be used from where the request comes from.
+func openShareToken(db *sql.DB, r *http.Request, token string) (*shareRecord, error) {
+	share, err := lookupShare(db, token)
+	if err != nil {
+		return nil, err
+	}
+	if err := share.check(); err != nil {
+		return nil, err
+	}
+	if !share.allowsClient(r) {
+		log.Printf("Refused access to share %d from %s", share.ID, clientIP(r))
+		return nil, errShareIPDenied
+	}
+	return share, nil
+}
+
+// queryShares returns the shares matching a condition, newest first.
+func queryShares(db *sql.DB, condition string, args ...interface{}) ([]*shareRecord, error) {
+	rows, err := db.Query("SELECT "+shareColumns+" FROM shares WHERE "+condition+" ORDER BY id DESC", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var shares []*shareRecord
+	for rows.Next() {
+		s, err := scanShare(rows)
+		if err != nil {
+			return nil, err
+		}
+		shares = append(shares, s)
+	}
+	return shares, rows.Err()
+}
+
+// countShareDownload uses up one download of a share. It returns
+// errShareExhausted if another request took the last one first.
+func countShareDownload(db *sql.DB, shareID int64) error {
+	res, err := db.Exec(`UPDATE shares SET download_count = download_count + 1
+		WHERE id = ? AND (max_downloads IS NULL OR download_count < max_downloads)`, shareID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errShareExhausted
+	}
+	return nil
+}
+
+// writeShareError reports a failed share lookup: 404 for unknown tokens and
+// 410 Gone for shares that were revoked, have expired or ran out of downloads.
+func writeShareError(w http.ResponseWriter, err error) {
+	switch err {
+	case errShareNotFound:
+		http.Error(w, "File not found", http.StatusNotFound)
+	case errShareRevoked:
+		http.Error(w, "This share link has been revoked", http.StatusGone)
+	case errShareExpired:
+		http.Error(w, "This share link has expired", http.StatusGone)
+	case errShareExhausted:
+		http.Error(w, "This share link has reached its download limit", http.StatusGone)
+	case errShareIPDenied:
+		http.Error(w, "This share link cannot be used from your network", http.StatusForbidden)
+	default:
+		log.Printf("Failed to query file by share token: %v", err)
+		http.Error(w, "Failed to query file", http.StatusInternalServerError)
+	}
+}
+
+// openShare checks the token and access of a share download request. It
+// writes the error response and returns nil if the share may not be used.
+func openShare(db *sql.DB, w http.ResponseWriter, r *http.Request) *shareRecord {
+	fileToken := r.URL.Query().Get("file")
+
+	if fileToken == "" {
+		http.Error(w, "Invalid share file token", http.StatusBadRequest)
+		return nil
+	}
+
+	share, err := openShareToken(db, r, fileToken)
+	if err != nil {
+		writeShareError(w, err)
+		return nil
+	}
+
+	if !hasShareAccess(r, share) {
+		writeLinkPasswordError(w, r, share.attemptTarget())
+		return nil
+	}
+	return share
+}
+
 func generateShareToken() (string, error) {
 	bytes := make([]byte, 16)
 	if _, err := rand.Read(bytes); err != nil {
@@ -27,8 +390,8 @@ func shareHandler(db *sql.DB, config *AppConfig) http.HandlerFunc {
 		}
 
 		var req struct {
-			FileID   int64  `json:"file_id"`
-			Password string `json:"password"`
+			shareTarget
+			shareOptions
 		}
 
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -36,37 +399,215 @@ func shareHandler(db *sql.DB, config *AppConfig) http.HandlerFunc {
 			return
 		}
 
-		token, err := generateShareToken()
-		if err != nil {
-			log.Printf("Failed to generate share token: %v", err)
-			http.Error(w, "Failed to generate share token", http.StatusInternalServerError)
+		req.createdBy = userID(currentUser(r))
+		shareID, token, ok := createShareFor(w, r, db, req.shareTarget, req.shareOptions, http.Error)
+		if !ok {
 			return
 		}
 
-		_, err = db.Exec("UPDATE files SET share_password = ?, share_token = ? WHERE id = ?", req.Password, token, req.FileID)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"id":          shareID,
+			"share_link":  shareLink(config, token),
+			"share_token": token,
+		})
+	}
+}
+
+// createShareFor validates a share request and creates the share, reporting
+// any failure with fail. ok is false if no share was created.
+func createShareFor(w http.ResponseWriter, r *http.Request, db *sql.DB, target shareTarget, opts shareOptions, fail errorWriter) (shareID int64, token string, ok bool) {
+	if err := opts.validate(); err != nil {
+		fail(w, err.Error(), http.StatusBadRequest)
+		return 0, "", false
+	}
+	if opts.BurnAfterDownload != "" && target.kind() != shareKindFile {
+		fail(w, "burn_after_download is only supported for single file shares", http.StatusBadRequest)
+		return 0, "", false
+	}
+	if err := target.check(db); err != nil {
+		switch {
+		case errors.Is(err, errFileNotFound):
+			fail(w, err.Error(), http.StatusNotFound)
+		case err == errFolderNotFound:
+			fail(w, "Folder not found", http.StatusNotFound)
+		case errors.Is(err, errInvalidShareTarget):
+			fail(w, err.Error(), http.StatusBadRequest)
+		default:
+			log.Printf("Failed to check share target: %v", err)
+			fail(w, "Failed to query files", http.StatusInternalServerError)
+		}
+		return 0, "", false
+	}
+	// A share that deletes the file is as good as deleting it, so it needs
+	// the same permission.
+	if opts.BurnAfterDownload == shareBurnFile {
+		if err := checkBurnAccess(db, currentUser(r), currentAPIKey(r), *target.FileID); err != nil {
+			switch err {
+			case errFileNotFound:
+				fail(w, "File not found", http.StatusNotFound)
+			case errForbidden:
+				fail(w, "Only files you uploaded can be deleted after download", http.StatusForbidden)
+			case errWebUploadDelete:
+				fail(w, err.Error(), http.StatusForbidden)
+			default:
+				log.Printf("Failed to check access to file ID %d: %v", *target.FileID, err)
+				fail(w, "Failed to query files", http.StatusInternalServerError)
+			}
+			return 0, "", false
+		}
+	}
+
+	shareID, token, err := createShare(db, target, opts)
+	if err != nil {
+		log.Printf("Failed to create %s share: %v", target.kind(), err)
+		fail(w, "Failed to create share", http.StatusInternalServerError)
+		return 0, "", false
+	}
+	return shareID, token, true
+}
+
+// createShare adds a new share link. Existing links to the same files keep
+// working. The target must have been checked.
+func createShare(db *sql.DB, target shareTarget, opts shareOptions) (int64, string, error) {
+	token, err := generateShareToken()
+	if err != nil {
+		return 0, "", err
+	}
+
+	passwordHash := opts.passwordHash
+	if passwordHash == "" {
+		if passwordHash, err = hashSharePassword(opts.Password); err != nil {
+			return 0, "", err
+		}
+	}
+
+	var expiresAt *time.Time
+	if opts.ExpiresAt != nil {
+		utc := opts.ExpiresAt.UTC()
+		expiresAt = &utc
+	}
+	// The download limit keeps a second visitor out while the first
+	// download of a one-time share is still running.
+	maxDownloads := opts.MaxDownloads
+	if opts.BurnAfterDownload != "" {
+		one := int64(1)
+		maxDownloads = &one
+	}
+	prefixes, err := parseIPPrefixes(opts.AllowedIPs)
+	if err != nil {
+		return 0, "", err
+	}
+	allowedIPs := make([]string, len(prefixes))
+	for i, prefix := range prefixes {
+		allowedIPs[i] = prefix.String()
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, "", err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`INSERT INTO shares (token, kind, file_id, folder_id, label, password, expires_at, max_downloads, burn, allowed_ips, created_by)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		token, target.kind(), target.FileID, target.FolderID, strings.TrimSpace(opts.Label), passwordHash, expiresAt, maxDownloads,
+		opts.BurnAfterDownload, strings.Join(allowedIPs, ","), opts.createdBy)
+	if err != nil {
+		return 0, "", err
+	}
+	shareID, err := res.LastInsertId()
+	if err != nil {
+		return 0, "", err
+	}
+	for _, fileID := range target.FileIDs {
+		if _, err := tx.Exec("INSERT OR IGNORE INTO share_files (share_id, file_id) VALUES (?, ?)", shareID, fileID); err != nil {
+			return 0, "", err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, "", err
+	}
+	return shareID, token, nil
+}
+
+// shareLink returns the share page URL for a token.
+func shareLink(config *AppConfig, token string) string {
+	if config.Host != "" {
+		return config.Host + "/share.html?file=" + token
+	}
+	// Fallback to relative path if host is not set
+	return "/share.html?file=" + token
+}
+
+// apiCreateShareHandler shares the file named in the path for API clients.
+func apiCreateShareHandler(db *sql.DB, config *AppConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fileID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
 		if err != nil {
-			log.Printf("Failed to update file with share info: %v", err)
-			http.Error(w, "Failed to update file", http.StatusInternalServerError)
+			jsonError(w, "Invalid file ID", http.StatusBadRequest)
 			return
 		}
 
-		shareLink := ""
-		if config.Host != "" {
-			shareLink = config.Host + "/share.html?file=" + token
-		} else {
-			// Fallback to relative path if host is not set
-			shareLink = "/share.html?file=" + token
+		var req shareOptions
+		// The body is optional; without one the share has no password or limits.
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+				jsonError(w, "Invalid request body", http.StatusBadRequest)
+				return
+			}
+		}
+
+		shareID, token, ok := createShareFor(w, r, db, shareTarget{FileID: &fileID}, req, jsonError)
+		if !ok {
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"ok":          true,
+			"id":          shareID,
+			"share_link":  shareLink(config, token),
+			"share_token": token,
+		})
+	}
+}
+
+// apiShareHandler creates a share of a file, a folder or a collection of
+// files for API clients, as given in the request body.
+func apiShareHandler(db *sql.DB, config *AppConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			shareTarget
+			shareOptions
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			jsonError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		shareID, token, ok := createShareFor(w, r, db, req.shareTarget, req.shareOptions, jsonError)
+		if !ok {
+			return
 		}
 
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]string{
-			"share_link":  shareLink,
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"ok":          true,
+			"id":          shareID,
+			"kind":        req.kind(),
+			"share_link":  shareLink(config, token),
 			"share_token": token,
 		})
 	}
 }
 
-func shareInfoHandler(db *sql.DB) http.HandlerFunc {
+// shareInfoHandler describes a share for the share page. Folder and
+// collection shares list their files, but only once a password protected
+// share has been unlocked.
+func shareInfoHandler(db *sql.DB, config *AppConfig) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		fileToken := r.URL.Query().Get("file")
 		if fileToken == "" {
@@ -74,157 +615,306 @@ func shareInfoHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		var filename string
-		var filesize int64
-		err := db.QueryRow("SELECT filename, filesize FROM files WHERE share_token = ?", fileToken).Scan(&filename, &filesize)
+		share, err := openShareToken(db, r, fileToken)
 		if err != nil {
-			if err == sql.ErrNoRows {
-				http.Error(w, "File not found", http.StatusNotFound)
+			writeShareError(w, err)
+			return
+		}
+
+		limits := share.info(config)
+		info := map[string]interface{}{
+			"kind":                share.Kind,
+			"password_required":   share.PasswordHash != "",
+			"expires_at":          limits.ExpiresAt,
+			"expires_in":          limits.ExpiresIn,
+			"max_downloads":       limits.MaxDownloads,
+			"download_count":      limits.DownloadCount,
+			"remaining_downloads": limits.RemainingDownloads,
+			"burn_after_download": share.Burn,
+		}
+
+		if share.Kind == shareKindFile {
+			info["filename"] = share.Filename
+			info["filesize"] = share.Filesize
+			info["content_type"] = share.ContentType
+			info["inline"] = isInlineContentType(share.ContentType)
+		} else {
+			name, err := shareName(db, share)
+			if err != nil {
+				writeShareError(w, err)
 				return
 			}
-			log.Printf("Failed to query file by share token: %v", err)
-			http.Error(w, "Failed to query file", http.StatusInternalServerError)
-			return
+			info["name"] = name
+			if hasShareAccess(r, share) {
+				entries, err := shareEntries(db, share)
+				if err != nil {
+					writeShareError(w, err)
+					return
+				}
+				info["files"] = shareFileList(entries)
+			}
 		}
 
+		logShareAccess(db, r, share, shareActionInfo, nil, 0, true)
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"filename": filename,
-			"filesize": filesize,
-		})
+		json.NewEncoder(w).Encode(info)
 	}
 }
 
-func shareDownloadHandler(db *sql.DB) http.HandlerFunc {
+// shareDownloadHandler downloads a shared file. For folder and collection
+// shares the item parameter picks one file; without it every file is sent as
+// a ZIP archive. Each request counts as one download.
+func shareDownloadHandler(db *sql.DB, config *AppConfig) http.HandlerFunc {
 	client := &http.Client{}
 
 	return func(w http.ResponseWriter, r *http.Request) {
-		fileToken := r.URL.Query().Get("file")
-		password := r.URL.Query().Get("password")
-
-		if fileToken == "" {
-			http.Error(w, "Invalid share file token", http.StatusBadRequest)
+		share := openShare(db, w, r)
+		if share == nil {
 			return
 		}
 
-		var fileID int64
-		var filename, dbPassword string
-		err := db.QueryRow("SELECT id, filename, share_password FROM files WHERE share_token = ?", fileToken).Scan(&fileID, &filename, &dbPassword)
-		if err != nil {
-			if err == sql.ErrNoRows {
-				http.Error(w, "File not found", http.StatusNotFound)
+		if share.Kind != shareKindFile && r.URL.Query().Get("item") == "" {
+			entries, err := shareEntries(db, share)
+			if err != nil {
+				writeShareError(w, err)
 				return
 			}
-			log.Printf("Failed to query file by share token: %v", err)
-			http.Error(w, "Failed to query file", http.StatusInternalServerError)
+			if len(entries) == 0 {
+				http.Error(w, "No files to download", http.StatusNotFound)
+				return
+			}
+			if len(entries) > maxArchiveFiles {
+				http.Error(w, "Too many files", http.StatusBadRequest)
+				return
+			}
+			name, err := shareName(db, share)
+			if err != nil {
+				writeShareError(w, err)
+				return
+			}
+			if err := countShareDownload(db, share.ID); err != nil {
+				writeShareError(w, err)
+				return
+			}
+
+			log.Printf("Starting archive download of %d files via share link %d", len(entries), share.ID)
+			written, err := serveArchive(w, client, db, name+".zip", entries)
+			logShareAccess(db, r, share, shareActionDownload, nil, written, err == nil)
 			return
 		}
 
-		if dbPassword != "" && dbPassword != password {
-			http.Error(w, "Invalid password", http.StatusUnauthorized)
+		item := shareItem(db, w, r, share)
+		if item == nil {
+			return
+		}
+		if err := countShareDownload(db, share.ID); err != nil {
+			writeShareError(w, err)
 			return
 		}
 
-		log.Printf("Starting download for file ID %d via share link", fileID)
+		log.Printf("Starting download for file ID %d via share link %d", item.FileID, share.ID)
 
-		rows, err := db.Query("SELECT image_path FROM chunks WHERE file_id = ? ORDER BY chunk_order ASC", fileID)
-		if err != nil {
-			log.Printf("Error: Failed to query chunks for file ID %d: %v", fileID, err)
-			http.Error(w, "Failed to query chunks", http.StatusInternalServerError)
+		w.Header().Set("Content-Disposition", contentDisposition("attachment", path.Base(item.Name)))
+		w.Header().Set("Content-Type", defaultContentType)
+
+		// serveFileChunks only succeeds once the whole file was sent, so a
+		// failed or short transfer never burns the share.
+		written, err := serveFileChunks(w, client, db, item.FileID)
+		completed := err == nil
+		logShareAccess(db, r, share, shareActionDownload, &item.FileID, written, completed)
+		if share.Burn != "" {
+			burnShare(db, config, share, completed)
+		}
+	}
+}
+
+// burnShare destroys a one-time share after its download: the link, or the
+// file with its chunks on the image host. A download that was cut short is
+// given back instead, so the recipient can try again.
+func burnShare(db *sql.DB, config *AppConfig, share *shareRecord, completed bool) {
+	if !completed {
+		if _, err := db.Exec("UPDATE shares SET download_count = download_count - 1 WHERE id = ? AND download_count > 0", share.ID); err != nil {
+			log.Printf("Failed to give back download of one-time share %d: %v", share.ID, err)
+		}
+		return
+	}
+
+	if share.Burn == shareBurnFile {
+		if err := deleteFile(db, share.FileID, config.AuthToken); err != nil && err != errFileNotFound {
+			log.Printf("Failed to delete file ID %d of one-time share %d: %v", share.FileID, share.ID, err)
 			return
 		}
-		defer rows.Close()
+		log.Printf("Deleted file ID %d after download via one-time share %d", share.FileID, share.ID)
+		return
+	}
+	if _, err := db.Exec("UPDATE shares SET revoked_at = ? WHERE id = ?", time.Now().UTC(), share.ID); err != nil {
+		log.Printf("Failed to revoke one-time share %d: %v", share.ID, err)
+		return
+	}
+	log.Printf("Revoked one-time share %d after download", share.ID)
+}
 
-		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filename))
-		w.Header().Set("Content-Type", "application/octet-stream")
+// shareViewHandler serves a shared file inline, with the same checks as
+// shareDownloadHandler. Viewing counts as a download.
+func shareViewHandler(db *sql.DB) http.HandlerFunc {
+	client := &http.Client{}
 
-		chunkCount := 0
-		// Get a buffer from the pool
-		bufferPtr := bufferPool.Get().(*[]byte)
-		defer bufferPool.Put(bufferPtr) // Return the buffer to the pool when done
-		buffer := *bufferPtr
+	return func(w http.ResponseWriter, r *http.Request) {
+		share := openShare(db, w, r)
+		if share == nil {
+			return
+		}
+		// A one-time share is used up by its download, so it is not viewable.
+		if share.Burn != "" {
+			http.Error(w, "One-time shares can only be downloaded", http.StatusForbidden)
+			return
+		}
 
-		for rows.Next() {
-			chunkCount++
-			var imagePath string
-			if err := rows.Scan(&imagePath); err != nil {
-				log.Printf("Error: Failed to scan chunk row for file ID %d: %v", fileID, err)
-				http.Error(w, "Failed to scan chunk row", http.StatusInternalServerError)
+		item := shareItem(db, w, r, share)
+		if item == nil {
+			return
+		}
+		if err := countShareDownload(db, share.ID); err != nil {
+			writeShareError(w, err)
+			return
+		}
+
+		setInlineHeaders(w, path.Base(item.Name), item.ContentType)
+		written, err := serveFileChunks(w, client, db, item.FileID)
+		logShareAccess(db, r, share, shareActionView, &item.FileID, written, err == nil)
+	}
+}
+
+// fileShareDetailsHandler returns the newest usable share link of a file
+// that the user may manage, or an empty object if there is none.
+func fileShareDetailsHandler(db *sql.DB, config *AppConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fileID, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "File ID is required", http.StatusBadRequest)
+			return
+		}
+
+		if err := checkFileExists(db, fileID); err != nil {
+			if err == errFileNotFound {
+				http.Error(w, "File not found", http.StatusNotFound)
 				return
 			}
-			log.Printf("Processing chunk %d, path: %s", chunkCount, imagePath)
+			log.Printf("Failed to query file share details: %v", err)
+			http.Error(w, "Failed to query file", http.StatusInternalServerError)
+			return
+		}
 
-			fullURL := "https://i.111666.best" + imagePath
-			req, err := http.NewRequest("GET", fullURL, nil)
-			if err != nil {
-				log.Printf("Error: Failed to create request for %s: %v", fullURL, err)
-				http.Error(w, "Failed to create download request", http.StatusInternalServerError)
-				return
+		own, ownArgs := createdByCondition(currentUser(r), "shares.created_by")
+		shares, err := queryShares(db, "shares.kind = 'file' AND shares.file_id = ? AND "+own, append([]interface{}{fileID}, ownArgs...)...)
+		if err != nil {
+			log.Printf("Failed to query file share details: %v", err)
+			http.Error(w, "Failed to query file", http.StatusInternalServerError)
+			return
+		}
+
+		var details interface{} = struct{}{}
+		for _, share := range shares {
+			if share.check() == nil {
+				details = share.info(config)
+				break
 			}
+		}
 
-			// Add extensive headers to mimic a real browser request
-			req.Header.Set("User-Agent", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/140.0.0.0 Safari/537.36")
-			req.Header.Set("Accept", "image/avif,image/webp,image/apng,image/svg+xml,image/*,*/*;q=0.8")
-			req.Header.Set("Accept-Language", "zh-CN,zh;q=0.9,en-US;q=0.8,en;q=0.7")
-			req.Header.Set("Referer", "https://xviewer.pages.dev/")
-			req.Header.Set("Sec-Fetch-Dest", "image")
-			req.Header.Set("Sec-Fetch-Mode", "no-cors")
-			req.Header.Set("Sec-Fetch-Site", "cross-site")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(details)
+	}
+}
 
-			resp, err := client.Do(req)
-			if err != nil {
-				log.Printf("Error: Failed to download chunk from %s: %v", fullURL, err)
-				http.Error(w, "Failed to download chunk", http.StatusInternalServerError)
+// listSharesHandler lists share links, including revoked and expired ones:
+// those of the file given by file_id, of the folder given by folder_id, or
+// every share if neither is given.
+func listSharesHandler(db *sql.DB, config *AppConfig, fail errorWriter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		var shares []*shareRecord
+		var err error
+		// The list holds live links, so members only see their own.
+		own, ownArgs := createdByCondition(currentUser(r), "shares.created_by")
+
+		switch {
+		case query.Get("file_id") != "":
+			fileID, perr := strconv.ParseInt(query.Get("file_id"), 10, 64)
+			if perr != nil {
+				fail(w, "Invalid file ID", http.StatusBadRequest)
 				return
 			}
-
-			bytesSkipped, err := io.CopyN(io.Discard, resp.Body, int64(downloadCarrierPadding))
-			log.Printf("Skipped %d bytes for chunk %d", bytesSkipped, chunkCount)
-			if err != nil && err != io.EOF {
-				log.Printf("Error: Failed to skip carrier data for chunk %d: %v", chunkCount, err)
-				resp.Body.Close()
-				http.Error(w, "Failed to process chunk", http.StatusInternalServerError)
+			if err := checkFileExists(db, fileID); err != nil {
+				if err == errFileNotFound {
+					fail(w, "File not found", http.StatusNotFound)
+					return
+				}
+				log.Printf("Failed to query file %d: %v", fileID, err)
+				fail(w, "Failed to query file", http.StatusInternalServerError)
 				return
 			}
-
-			bytesWritten, err := io.CopyBuffer(w, resp.Body, buffer)
-			if err != nil {
-				log.Printf("Error: Failed to stream chunk %d to client: %v", chunkCount, err)
-				resp.Body.Close()
+			shares, err = queryShares(db, "shares.kind = 'file' AND shares.file_id = ? AND "+own, append([]interface{}{fileID}, ownArgs...)...)
+		case query.Get("folder_id") != "":
+			folderID, perr := strconv.ParseInt(query.Get("folder_id"), 10, 64)
+			if perr != nil {
+				fail(w, "Invalid folder ID", http.StatusBadRequest)
 				return
 			}
-			log.Printf("Wrote %d bytes for chunk %d to response", bytesWritten, chunkCount)
+			shares, err = queryShares(db, "shares.kind = 'folder' AND shares.folder_id = ? AND "+own, append([]interface{}{folderID}, ownArgs...)...)
+		default:
+			shares, err = queryShares(db, own, ownArgs...)
+		}
+		if err != nil {
+			log.Printf("Failed to query shares: %v", err)
+			fail(w, "Failed to query shares", http.StatusInternalServerError)
+			return
+		}
 
-			resp.Body.Close()
+		infos := []ShareInfo{}
+		for _, share := range shares {
+			infos = append(infos, share.info(config))
 		}
-		log.Printf("Finished processing all %d chunks for file ID %d via share link", chunkCount, fileID)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"shares": infos})
 	}
 }
 
-func fileShareDetailsHandler(db *sql.DB) http.HandlerFunc {
+// revokeShareHandler stops a share link from working. The share is kept so
+// it still shows up in the file's share list. Only admins and the user who
+// created the share may revoke it.
+func revokeShareHandler(db *sql.DB, fail errorWriter) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		fileID := r.URL.Query().Get("id")
-		if fileID == "" {
-			http.Error(w, "File ID is required", http.StatusBadRequest)
+		shareID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			fail(w, "Invalid share ID", http.StatusBadRequest)
 			return
 		}
 
-		var shareToken, sharePassword sql.NullString
-		err := db.QueryRow("SELECT share_token, share_password FROM files WHERE id = ?", fileID).Scan(&shareToken, &sharePassword)
+		var createdBy sql.NullInt64
+		err = db.QueryRow("SELECT created_by FROM shares WHERE id = ?", shareID).Scan(&createdBy)
+		if err == sql.ErrNoRows {
+			fail(w, "Share not found", http.StatusNotFound)
+			return
+		}
 		if err != nil {
-			if err == sql.ErrNoRows {
-				http.Error(w, "File not found", http.StatusNotFound)
-				return
-			}
-			log.Printf("Failed to query file share details: %v", err)
-			http.Error(w, "Failed to query file", http.StatusInternalServerError)
+			log.Printf("Failed to query share %d: %v", shareID, err)
+			fail(w, "Failed to revoke share", http.StatusInternalServerError)
+			return
+		}
+		if !canManageCreated(currentUser(r), createdBy) {
+			fail(w, "You can only revoke shares you created", http.StatusForbidden)
 			return
 		}
 
+		if _, err := db.Exec("UPDATE shares SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL", time.Now().UTC(), shareID); err != nil {
+			log.Printf("Failed to revoke share %d: %v", shareID, err)
+			fail(w, "Failed to revoke share", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("Revoked share %d", shareID)
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]string{
-			"share_token":    shareToken.String,
-			"share_password": sharePassword.String,
-		})
+		json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "message": "Share revoked."})
 	}
 }
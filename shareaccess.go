@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// shareAccessTTL is how long a verified share password stays valid.
+const shareAccessTTL = 10 * time.Minute
+
+// shareAccessKey signs share access tokens. It is generated at startup, so a
+// restart only costs visitors one more password prompt.
+var shareAccessKey = make([]byte, 32)
+
+func init() {
+	if _, err := rand.Read(shareAccessKey); err != nil {
+		log.Fatalf("Failed to generate share access key: %v", err)
+	}
+}
+
+// shareAccessCookie is the name of the cookie holding the access token of a
+// share, so tokens for different shares do not overwrite each other.
+func shareAccessCookie(shareID int64) string {
+	return fmt.Sprintf("share_access_%d", shareID)
+}
+
+// signShareAccess returns a token proving the password of a share was given,
+// valid until expiry.
+func signShareAccess(shareID int64, expiry time.Time) string {
+	payload := fmt.Sprintf("%d:%d", shareID, expiry.Unix())
+	mac := hmac.New(sha256.New, shareAccessKey)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." +
+		base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifyShareAccess reports whether token is an unexpired access token for
+// the share.
+func verifyShareAccess(token string, shareID int64) bool {
+	encodedPayload, encodedMAC, ok := strings.Cut(token, ".")
+	if !ok {
+		return false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if err != nil {
+		return false
+	}
+	sum, err := base64.RawURLEncoding.DecodeString(encodedMAC)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, shareAccessKey)
+	mac.Write(payload)
+	if !hmac.Equal(sum, mac.Sum(nil)) {
+		return false
+	}
+
+	id, expiry, ok := strings.Cut(string(payload), ":")
+	if !ok || id != strconv.FormatInt(shareID, 10) {
+		return false
+	}
+	unix, err := strconv.ParseInt(expiry, 10, 64)
+	return err == nil && time.Now().Unix() < unix
+}
+
+// hasShareAccess reports whether a request may download a share: either the
+// share has no password, or the request carries a valid access token in its
+// cookie. Neither passwords nor tokens are accepted in the URL, where they
+// would end up in logs and browser history.
+func hasShareAccess(r *http.Request, share *shareRecord) bool {
+	if share.PasswordHash == "" {
+		return true
+	}
+	c, err := r.Cookie(shareAccessCookie(share.ID))
+	return err == nil && verifyShareAccess(c.Value, share.ID)
+}
+
+// checkLinkPassword checks a password given for a share or upload link with
+// check, recording the attempt. It fails without checking while the client
+// is locked out; callers report both with writeLinkPasswordError.
+func checkLinkPassword(r *http.Request, check func(string) bool, password, link string) bool {
+	attempt, _ := linkPasswordAttempts.begin(clientIP(r), link)
+	if attempt == nil {
+		return false
+	}
+	if !check(password) {
+		attempt.fail("")
+		return false
+	}
+	attempt.succeed()
+	return true
+}
+
+// writeLinkPasswordError writes the response for a rejected link password:
+// 429 while the client is locked out, 401 otherwise.
+func writeLinkPasswordError(w http.ResponseWriter, r *http.Request, link string) {
+	if wait := linkPasswordAttempts.retryAfter(clientIP(r), link); wait > 0 {
+		writeTooManyAttempts(w, wait)
+		return
+	}
+	http.Error(w, "Invalid password", http.StatusUnauthorized)
+}
+
+// shareUnlockHandler checks the password of a share sent in a POST body and
+// issues a short-lived access token for it as a cookie.
+func shareUnlockHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			File     string `json:"file"`
+			Password string `json:"password"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.File == "" {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		share, err := openShareToken(db, r, req.File)
+		if err != nil {
+			writeShareError(w, err)
+			return
+		}
+
+		if share.PasswordHash != "" && !checkLinkPassword(r, share.checkPassword, req.Password, share.attemptTarget()) {
+			writeLinkPasswordError(w, r, share.attemptTarget())
+			return
+		}
+
+		expiry := time.Now().Add(shareAccessTTL)
+		token := signShareAccess(share.ID, expiry)
+		http.SetCookie(w, &http.Cookie{
+			Name:     shareAccessCookie(share.ID),
+			Value:    token,
+			Expires:  expiry,
+			Path:     "/api/share/",
+			HttpOnly: true,
+			SameSite: http.SameSiteStrictMode,
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"expires_at": expiry.UTC(),
+		})
+	}
+}
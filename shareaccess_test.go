@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifyShareAccess(t *testing.T) {
+	valid := signShareAccess(7, time.Now().Add(time.Minute))
+	payload, mac, _ := strings.Cut(valid, ".")
+	otherPayload := base64.RawURLEncoding.EncodeToString([]byte("8:" + strings.Split(mustDecode(t, payload), ":")[1]))
+	laterPayload := base64.RawURLEncoding.EncodeToString([]byte("7:9999999999"))
+
+	tests := []struct {
+		name    string
+		token   string
+		shareID int64
+		want    bool
+	}{
+		{"valid", valid, 7, true},
+		{"other share", valid, 8, false},
+		{"expired", signShareAccess(7, time.Now().Add(-time.Second)), 7, false},
+		{"payload for another share", otherPayload + "." + mac, 8, false},
+		{"extended expiry", laterPayload + "." + mac, 7, false},
+		{"flipped signature", payload + "." + flipFirst(mac), 7, false},
+		{"missing signature", payload, 7, false},
+		{"empty signature", payload + ".", 7, false},
+		{"bad encoding", "!!!." + mac, 7, false},
+		{"empty", "", 7, false},
+	}
+	for _, tt := range tests {
+		if got := verifyShareAccess(tt.token, tt.shareID); got != tt.want {
+			t.Errorf("%s: verifyShareAccess = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestHasShareAccess(t *testing.T) {
+	share := &shareRecord{ID: 7, PasswordHash: "hash"}
+	token := signShareAccess(share.ID, time.Now().Add(time.Minute))
+
+	tests := []struct {
+		name   string
+		cookie string
+		query  string
+		want   bool
+	}{
+		{"cookie", token, "", true},
+		{"token in the URL", "", "?access=" + token, false},
+		{"no token", "", "", false},
+		{"tampered cookie", token + "x", "", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/api/share/download"+tt.query, nil)
+		if tt.cookie != "" {
+			r.Header.Set("Cookie", shareAccessCookie(share.ID)+"="+tt.cookie)
+		}
+		if got := hasShareAccess(r, share); got != tt.want {
+			t.Errorf("%s: hasShareAccess = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	if !hasShareAccess(httptest.NewRequest("GET", "/", nil), &shareRecord{ID: 7}) {
+		t.Error("share without a password needs an access token")
+	}
+}
+
+func mustDecode(t *testing.T, s string) string {
+	t.Helper()
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// flipFirst changes the first character of a base64 string to another valid
+// one.
+func flipFirst(s string) string {
+	if s[0] == 'A' {
+		return "B" + s[1:]
+	}
+	return "A" + s[1:]
+}
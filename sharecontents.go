@@ -0,0 +1,194 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+var errInvalidShareTarget = errors.New("invalid share target")
+
+// shareTarget is what a share link gives access to: one file, a folder with
+// everything below it, or a fixed collection of files. Exactly one field is
+// set.
+type shareTarget struct {
+	FileID   *int64  `json:"file_id"`
+	FolderID *int64  `json:"folder_id"`
+	FileIDs  []int64 `json:"file_ids"`
+}
+
+// kind returns the share kind stored for the target.
+func (t shareTarget) kind() string {
+	switch {
+	case t.FolderID != nil:
+		return shareKindFolder
+	case len(t.FileIDs) > 0:
+		return shareKindCollection
+	default:
+		return shareKindFile
+	}
+}
+
+// check verifies that exactly one target is given and that everything it
+// names exists.
+func (t shareTarget) check(db *sql.DB) error {
+	given := 0
+	if t.FileID != nil {
+		given++
+	}
+	if t.FolderID != nil {
+		given++
+	}
+	if len(t.FileIDs) > 0 {
+		given++
+	}
+	if given != 1 {
+		return fmt.Errorf("%w: exactly one of file_id, folder_id or file_ids is required", errInvalidShareTarget)
+	}
+	if len(t.FileIDs) > maxArchiveFiles {
+		return fmt.Errorf("%w: at most %d files can be shared together", errInvalidShareTarget, maxArchiveFiles)
+	}
+
+	switch t.kind() {
+	case shareKindFolder:
+		return checkFolderExists(db, t.FolderID)
+	case shareKindCollection:
+		for _, fileID := range t.FileIDs {
+			if err := checkFileExists(db, fileID); err != nil {
+				if err == errFileNotFound {
+					return fmt.Errorf("%w: %d", errFileNotFound, fileID)
+				}
+				return err
+			}
+		}
+		return nil
+	default:
+		return checkFileExists(db, *t.FileID)
+	}
+}
+
+// shareEntries returns the files a share currently gives access to, named by
+// their path inside the share's download-all archive.
+func shareEntries(db *sql.DB, share *shareRecord) ([]archiveEntry, error) {
+	var entries []archiveEntry
+	var err error
+
+	switch share.Kind {
+	case shareKindFolder:
+		entries, err = archiveEntriesForFolder(db, &share.FolderID.Int64)
+	case shareKindCollection:
+		entries, err = collectionEntries(db, share.ID)
+	default:
+		entries, err = archiveEntriesForFiles(db, []int64{share.FileID})
+		if errors.Is(err, errFileNotFound) {
+			return nil, errShareNotFound
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	uniqueArchiveNames(entries)
+	return entries, nil
+}
+
+// collectionEntries returns the files of a collection share that still exist.
+func collectionEntries(db *sql.DB, shareID int64) ([]archiveEntry, error) {
+	rows, err := db.Query(`SELECT files.id, files.filename, files.upload_timestamp, files.filesize, files.content_type
+		FROM share_files JOIN files ON files.id = share_files.file_id
+		WHERE share_files.share_id = ? AND files.filename != ''
+		ORDER BY files.filename COLLATE NOCASE, files.id`, shareID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []archiveEntry
+	for rows.Next() {
+		var entry archiveEntry
+		if err := rows.Scan(&entry.FileID, &entry.Name, &entry.Modified, &entry.Size, &entry.ContentType); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// shareName returns the name shown on the share page and used for the
+// download-all archive: the folder name for folder shares, and the label of
+// a collection share.
+func shareName(db *sql.DB, share *shareRecord) (string, error) {
+	switch share.Kind {
+	case shareKindFolder:
+		var name string
+		err := db.QueryRow("SELECT name FROM folders WHERE id = ?", share.FolderID.Int64).Scan(&name)
+		if err == sql.ErrNoRows {
+			return "", errShareNotFound
+		}
+		return name, err
+	case shareKindCollection:
+		if share.Label != "" {
+			return share.Label, nil
+		}
+		return "shared-files", nil
+	default:
+		return share.Filename, nil
+	}
+}
+
+// shareFile is a file listed on the share page of a folder or collection.
+type shareFile struct {
+	ID          int64  `json:"id"`
+	Name        string `json:"name"`
+	Filesize    int64  `json:"filesize"`
+	ContentType string `json:"content_type"`
+	Inline      bool   `json:"inline"`
+}
+
+func shareFileList(entries []archiveEntry) []shareFile {
+	files := []shareFile{}
+	for _, entry := range entries {
+		files = append(files, shareFile{
+			ID:          entry.FileID,
+			Name:        entry.Name,
+			Filesize:    entry.Size,
+			ContentType: entry.ContentType,
+			Inline:      isInlineContentType(entry.ContentType),
+		})
+	}
+	return files
+}
+
+// shareItem returns the file a share download or view request is for: the
+// file of a file share, or the file of a folder or collection share given by
+// the item parameter. It writes the error response and returns nil if there
+// is no such file.
+func shareItem(db *sql.DB, w http.ResponseWriter, r *http.Request, share *shareRecord) *archiveEntry {
+	if share.Kind == shareKindFile {
+		return &archiveEntry{
+			FileID:      share.FileID,
+			Name:        share.Filename,
+			Size:        share.Filesize,
+			ContentType: share.ContentType,
+		}
+	}
+
+	itemID, err := strconv.ParseInt(r.URL.Query().Get("item"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid item", http.StatusBadRequest)
+		return nil
+	}
+	entries, err := shareEntries(db, share)
+	if err != nil {
+		writeShareError(w, err)
+		return nil
+	}
+	for i := range entries {
+		if entries[i].FileID == itemID {
+			return &entries[i]
+		}
+	}
+	http.Error(w, "File not found", http.StatusNotFound)
+	return nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// Share access log actions
+	shareActionInfo     = "info"
+	shareActionDownload = "download"
+	shareActionView     = "view"
+
+	defaultShareAccessLimit = 50
+	maxShareAccessLimit     = 500
+)
+
+// ShareAccess is one entry of a share's access log.
+type ShareAccess struct {
+	ID         int64     `json:"id"`
+	ShareID    int64     `json:"share_id"`
+	FileID     *int64    `json:"file_id"`
+	Action     string    `json:"action"`
+	AccessedAt time.Time `json:"accessed_at"`
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"user_agent"`
+	Bytes      int64     `json:"bytes"`
+	Completed  bool      `json:"completed"`
+}
+
+// ShareStats summarises the access log of a share.
+type ShareStats struct {
+	ShareID            int64      `json:"share_id"`
+	Views              int64      `json:"views"`
+	Downloads          int64      `json:"downloads"`
+	CompletedDownloads int64      `json:"completed_downloads"`
+	AbortedDownloads   int64      `json:"aborted_downloads"`
+	BytesServed        int64      `json:"bytes_served"`
+	UniqueVisitors     int64      `json:"unique_visitors"`
+	FirstAccessAt      *time.Time `json:"first_access_at"`
+	LastAccessAt       *time.Time `json:"last_access_at"`
+}
+
+// logShareAccess records a visit to a share link. fileID is the file that
+// was served, or nil for the share page and download-all archives. Failures
+// are only logged, so they never break the download itself.
+func logShareAccess(db *sql.DB, r *http.Request, share *shareRecord, action string, fileID *int64, bytes int64, completed bool) {
+	_, err := db.Exec(`INSERT INTO share_access (share_id, file_id, action, accessed_at, ip, user_agent, bytes, completed)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		share.ID, fileID, action, time.Now().UTC(), clientIP(r), r.UserAgent(), bytes, completed)
+	if err != nil {
+		log.Printf("Failed to log access to share %d: %v", share.ID, err)
+	}
+}
+
+// parseShareID reads the share ID from the request path and checks that the
+// share exists and that the user may manage it, writing the error response
+// if not. Shares of other users are reported as not found.
+func parseShareID(db *sql.DB, w http.ResponseWriter, r *http.Request, fail errorWriter) (int64, bool) {
+	shareID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		fail(w, "Invalid share ID", http.StatusBadRequest)
+		return 0, false
+	}
+
+	var createdBy sql.NullInt64
+	err = db.QueryRow("SELECT created_by FROM shares WHERE id = ?", shareID).Scan(&createdBy)
+	if err == sql.ErrNoRows || (err == nil && !canManageCreated(currentUser(r), createdBy)) {
+		fail(w, "Share not found", http.StatusNotFound)
+		return 0, false
+	}
+	if err != nil {
+		log.Printf("Failed to query share %d: %v", shareID, err)
+		fail(w, "Failed to query share", http.StatusInternalServerError)
+		return 0, false
+	}
+	return shareID, true
+}
+
+// shareStats computes the statistics of a share from its access log.
+func shareStats(db *sql.DB, shareID int64) (ShareStats, error) {
+	stats := ShareStats{ShareID: shareID}
+	err := db.QueryRow(`SELECT
+			COUNT(CASE WHEN action = ? THEN 1 END),
+			COUNT(CASE WHEN action != ? THEN 1 END),
+			COUNT(CASE WHEN action != ? AND completed THEN 1 END),
+			COUNT(CASE WHEN action != ? AND NOT completed THEN 1 END),
+			COALESCE(SUM(bytes), 0),
+			COUNT(DISTINCT ip)
+		FROM share_access WHERE share_id = ?`,
+		shareActionInfo, shareActionInfo, shareActionInfo, shareActionInfo, shareID).
+		Scan(&stats.Views, &stats.Downloads, &stats.CompletedDownloads, &stats.AbortedDownloads,
+			&stats.BytesServed, &stats.UniqueVisitors)
+	if err != nil {
+		return stats, err
+	}
+
+	// Selected as a plain column rather than with MIN and MAX, so the driver
+	// still parses it as a time.
+	for _, bound := range []struct {
+		order string
+		dst   **time.Time
+	}{{"ASC", &stats.FirstAccessAt}, {"DESC", &stats.LastAccessAt}} {
+		var accessedAt time.Time
+		err := db.QueryRow("SELECT accessed_at FROM share_access WHERE share_id = ? ORDER BY accessed_at "+bound.order+" LIMIT 1", shareID).
+			Scan(&accessedAt)
+		if err == sql.ErrNoRows {
+			break
+		}
+		if err != nil {
+			return stats, err
+		}
+		*bound.dst = &accessedAt
+	}
+	return stats, nil
+}
+
+// shareStatsHandler returns the view and download statistics of a share.
+func shareStatsHandler(db *sql.DB, fail errorWriter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		shareID, ok := parseShareID(db, w, r, fail)
+		if !ok {
+			return
+		}
+
+		stats, err := shareStats(db, shareID)
+		if err != nil {
+			log.Printf("Failed to query statistics of share %d: %v", shareID, err)
+			fail(w, "Failed to query share statistics", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stats)
+	}
+}
+
+// shareAccessHandler lists the most recent accesses to a share, newest first.
+// The limit query parameter caps the number of entries.
+func shareAccessHandler(db *sql.DB, fail errorWriter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		shareID, ok := parseShareID(db, w, r, fail)
+		if !ok {
+			return
+		}
+
+		limit := defaultShareAccessLimit
+		if value := r.URL.Query().Get("limit"); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 || n > maxShareAccessLimit {
+				fail(w, "Invalid limit", http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+
+		rows, err := db.Query(`SELECT id, share_id, file_id, action, accessed_at, ip, user_agent, bytes, completed
+			FROM share_access WHERE share_id = ? ORDER BY accessed_at DESC, id DESC LIMIT ?`, shareID, limit)
+		if err != nil {
+			log.Printf("Failed to query access log of share %d: %v", shareID, err)
+			fail(w, "Failed to query share access log", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		accesses := []ShareAccess{}
+		for rows.Next() {
+			var access ShareAccess
+			var fileID sql.NullInt64
+			if err := rows.Scan(&access.ID, &access.ShareID, &fileID, &access.Action, &access.AccessedAt,
+				&access.IP, &access.UserAgent, &access.Bytes, &access.Completed); err != nil {
+				log.Printf("Failed to scan share access row: %v", err)
+				fail(w, "Failed to query share access log", http.StatusInternalServerError)
+				return
+			}
+			if fileID.Valid {
+				access.FileID = &fileID.Int64
+			}
+			accesses = append(accesses, access)
+		}
+		if err := rows.Err(); err != nil {
+			log.Printf("Failed to read share access rows: %v", err)
+			fail(w, "Failed to query share access log", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"accesses": accesses})
+	}
+}
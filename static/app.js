@@ -20,8 +20,52 @@ document.addEventListener('DOMContentLoaded', () => {
     const cancelDeleteBtn = document.getElementById('cancelDeleteBtn');
     const confirmDeleteBtn = document.getElementById('confirmDeleteBtn');
 
+    // Folder Elements
+    const breadcrumb = document.getElementById('breadcrumb');
+    const newFolderBtn = document.getElementById('newFolderBtn');
+    const moveModal = document.getElementById('moveModal');
+    const moveFilenameSpan = document.getElementById('moveFilename');
+    const moveFolderSelect = document.getElementById('moveFolderSelect');
+    const closeMoveModalBtn = document.getElementById('closeMoveModalBtn');
+    const confirmMoveBtn = document.getElementById('confirmMoveBtn');
+
     let searchTimeout;
     let fileToDelete = { id: null, filename: null };
+    let fileToMove = { id: null, filename: null };
+    // Tag & Edit Elements
+    const uploadTagsInput = document.getElementById('uploadTags');
+    const uploadDescriptionInput = document.getElementById('uploadDescription');
+    const tagFilter = document.getElementById('tagFilter');
+    const activeTagLabel = document.getElementById('activeTagLabel');
+    const clearTagFilter = document.getElementById('clearTagFilter');
+    const editModal = document.getElementById('editModal');
+    const editFilenameSpan = document.getElementById('editFilename');
+    const editNameInput = document.getElementById('editName');
+    const editTagsInput = document.getElementById('editTags');
+    const editDescriptionInput = document.getElementById('editDescription');
+    const closeEditModalBtn = document.getElementById('closeEditModalBtn');
+    const saveEditBtn = document.getElementById('saveEditBtn');
+
+    // Paging Elements
+    const sortSelect = document.getElementById('sortSelect');
+    const ownerSelect = document.getElementById('ownerSelect');
+    const loadMoreBtn = document.getElementById('loadMoreBtn');
+    const fileCount = document.getElementById('fileCount');
+    const pageSize = 50;
+    const downloadSelectedBtn = document.getElementById('downloadSelectedBtn');
+    const moveSelectedBtn = document.getElementById('moveSelectedBtn');
+    const tagSelectedBtn = document.getElementById('tagSelectedBtn');
+    const shareSelectedBtn = document.getElementById('shareSelectedBtn');
+    const deleteSelectedBtn = document.getElementById('deleteSelectedBtn');
+    const selectedFileIds = new Set();
+    let nextCursor = null;
+
+    let fileToEdit = { id: null };
+    let activeTag = null;
+    let filesById = {};
+    let currentFolderId = null; // null is the top level
+    let allFolders = [];
+    let currentUser = null;
 
     // --- Toast Notification ---
     function showToast(message, type = 'success') {
@@ -107,46 +151,404 @@ document.addEventListener('DOMContentLoaded', () => {
         }
     }
 
-    async function fetchFiles(searchTerm = '') {
+    async function fetchFolders() {
+        const response = await fetch('/api/folders');
+        if (!response.ok) throw new Error('无法获取文件夹列表');
+        allFolders = await response.json();
+    }
+
+    async function fetchFiles(searchTerm = '', append = false) {
         try {
-            const url = searchTerm ? `/api/files?search=${encodeURIComponent(searchTerm)}` : '/api/files';
-            const response = await fetch(url);
+            // Searches cover all folders; browsing shows the current folder only.
+            const folderParam = currentFolderId === null ? 'root' : currentFolderId;
+            // A tag filter, like a search, looks across all folders.
+            const params = new URLSearchParams();
+            if (searchTerm) params.set('search', searchTerm);
+            if (activeTag) params.set('tag', activeTag);
+            if (!searchTerm && !activeTag) params.set('folder_id', folderParam);
+            // Keep relevance ordering for searches unless a sort was picked.
+            if (sortSelect.value || !searchTerm) params.set('sort', sortSelect.value || 'date');
+            if (ownerSelect.value) params.set('owner_id', ownerSelect.value);
+            // Passing limit asks for a page with its total and next cursor.
+            params.set('limit', pageSize);
+            if (append && nextCursor) params.set('cursor', nextCursor);
+            const url = `/api/files?${params}`;
+            const [response] = await Promise.all([fetch(url), append ? null : fetchFolders()]);
             if (!response.ok) throw new Error('无法获取文件列表');
             
-            const files = await response.json();
-            renderFileList(files);
+            const page = await response.json();
+            nextCursor = page.next_cursor || null;
+            loadMoreBtn.classList.toggle('hidden', !nextCursor);
+            fileCount.textContent = `共 ${page.total} 个文件`;
+
+            if (append) {
+                page.files.forEach(file => fileListBody.appendChild(renderFileRow(file)));
+                return;
+            }
+            const folders = searchTerm || activeTag ? [] : allFolders.filter(f => f.parent_id === currentFolderId);
+            renderBreadcrumb();
+            renderFileList(page.files, folders);
         } catch (error) {
             console.error('获取文件时出错:', error);
-            fileListBody.innerHTML = `<tr><td colspan="4" style="text-align: center;">加载文件失败。</td></tr>`;
+            fileListBody.innerHTML = `<tr><td colspan="5" style="text-align: center;">加载文件失败。</td></tr>`;
         }
     }
 
     // --- UI Rendering ---
-    function renderFileList(files) {
+    function folderPath(folderId) {
+        const path = [];
+        let folder = allFolders.find(f => f.id === folderId);
+        while (folder) {
+            path.unshift(folder);
+            folder = allFolders.find(f => f.id === folder.parent_id);
+        }
+        return path;
+    }
+
+    function renderBreadcrumb() {
+        breadcrumb.innerHTML = '';
+        const root = document.createElement('a');
+        root.textContent = '全部文件';
+        root.addEventListener('click', () => openFolder(null));
+        breadcrumb.appendChild(root);
+
+        folderPath(currentFolderId).forEach(folder => {
+            breadcrumb.appendChild(document.createTextNode(' / '));
+            const link = document.createElement('a');
+            link.textContent = folder.name;
+            link.addEventListener('click', () => openFolder(folder.id));
+            breadcrumb.appendChild(link);
+        });
+    }
+
+    function openFolder(folderId) {
+        currentFolderId = folderId;
+        searchInput.value = '';
+        fetchFiles();
+    }
+
+    function renderFileList(files, folders = []) {
         fileListBody.innerHTML = '';
-        if (files && files.length > 0) {
-            files.forEach(file => {
-                const row = document.createElement('tr');
-                const uploadDate = new Date(file.upload_timestamp).toLocaleString('zh-CN');
-                const fileSize = (file.filesize / 1024 / 1024).toFixed(2) + ' MB';
-
-                row.innerHTML = `
-                    <td data-label="文件名">${file.filename}</td>
-                    <td data-label="大小">${fileSize}</td>
-                    <td data-label="上传日期">${uploadDate}</td>
-                    <td class="actions" data-label="操作">
-                        <button class="download-btn" onclick="downloadFile(${file.id})">下载</button>
-                        <button class="share-btn" onclick="shareFile(${file.id}, '${file.filename}')">分享</button>
-                        <button class="delete-btn" onclick="deleteFile(${file.id}, '${file.filename}')">删除</button>
-                    </td>
-                `;
-                fileListBody.appendChild(row);
+        folders.forEach(folder => {
+            const row = document.createElement('tr');
+            row.className = 'folder-row';
+            row.innerHTML = `
+                <td data-label="文件名"><a class="folder-link"></a></td>
+                <td data-label="大小">-</td>
+                <td data-label="上传者">-</td>
+                <td data-label="上传日期">${new Date(folder.created_at).toLocaleString('zh-CN')}</td>
+                <td class="actions" data-label="操作">
+                    <button class="download-btn download-folder-btn">打包下载</button>
+                    ${canWrite() ? `
+                    <button class="share-btn share-folder-btn">分享</button>
+                    <button class="share-btn rename-folder-btn">重命名</button>
+                    <button class="delete-btn delete-folder-btn">删除</button>` : ''}
+                </td>
+            `;
+            const link = row.querySelector('.folder-link');
+            link.textContent = `📁 ${folder.name}`;
+            link.addEventListener('click', () => openFolder(folder.id));
+            row.querySelector('.download-folder-btn').addEventListener('click', () => {
+                window.location.href = `/api/files/archive?folder_id=${folder.id}`;
             });
+            if (canWrite()) {
+                row.querySelector('.share-folder-btn').addEventListener('click', () => {
+                    showShareModal({ folder_id: folder.id }, `📁 ${folder.name}`, `folder_id=${folder.id}`);
+                });
+                row.querySelector('.rename-folder-btn').addEventListener('click', () => renameFolder(folder));
+                row.querySelector('.delete-folder-btn').addEventListener('click', () => deleteFolder(folder));
+            }
+            fileListBody.appendChild(row);
+        });
+
+        if (files && files.length > 0) {
+            files.forEach(file => fileListBody.appendChild(renderFileRow(file)));
+        } else if (folders.length === 0) {
+            fileListBody.innerHTML = `<tr><td colspan="5" style="text-align: center;">没有找到文件。</td></tr>`;
+        }
+    }
+
+    function renderFileRow(file) {
+        const row = document.createElement('tr');
+        const uploadDate = new Date(file.upload_timestamp).toLocaleString('zh-CN');
+        const fileSize = (file.filesize / 1024 / 1024).toFixed(2) + ' MB';
+
+        let preview = '';
+        if (file.has_preview) {
+            preview = `<img class="file-thumb" src="/api/files/${file.id}/preview" alt="" loading="lazy">`;
+        } else if (file.has_thumbnail) {
+            preview = `<img class="file-thumb" src="/api/files/${file.id}/thumbnail?size=small" alt="" loading="lazy">`;
+        }
+
+        filesById[file.id] = file;
+
+        row.innerHTML = `
+            <td data-label="文件名"><div class="file-name-cell"><input type="checkbox" class="file-select" ${selectedFileIds.has(file.id) ? 'checked' : ''}>${preview}<div><span class="file-name-text"></span><div class="tags"></div></div></div></td>
+            <td data-label="大小">${fileSize}</td>
+            <td data-label="上传者">${file.owner || '-'}</td>
+            <td data-label="上传日期">${uploadDate}</td>
+            <td class="actions" data-label="操作">
+                ${file.inline ? `<button class="view-btn" onclick="viewFile(${file.id})">预览</button>` : ''}
+                <button class="download-btn" onclick="downloadFile(${file.id})">下载</button>
+                ${canWrite() ? `<button class="share-btn share-file-btn">分享</button>` : ''}
+                ${canModify(file) ? `
+                <button class="move-btn move-file-btn">移动</button>
+                <button class="edit-btn" onclick="editFile(${file.id})">编辑</button>
+                <button class="delete-btn delete-file-btn">删除</button>` : ''}
+            </td>
+        `;
+        // Filenames, descriptions and tags come from users, so they are set as
+        // text rather than markup.
+        row.querySelector('.file-name-text').textContent = file.filename;
+        const tags = row.querySelector('.tags');
+        if (file.description) {
+            const description = document.createElement('div');
+            description.className = 'file-description';
+            description.textContent = file.description;
+            tags.before(description);
+        }
+        (file.tags || []).forEach(tag => {
+            const chip = document.createElement('span');
+            chip.className = 'tag';
+            chip.setAttribute('data-tag', tag);
+            chip.textContent = tag;
+            chip.addEventListener('click', () => setTagFilter(tag));
+            tags.appendChild(chip);
+        });
+        if (canWrite()) {
+            row.querySelector('.share-file-btn').addEventListener('click', () => shareFile(file.id, file.filename));
+        }
+        if (canModify(file)) {
+            row.querySelector('.move-file-btn').addEventListener('click', () => moveFile(file.id, file.filename));
+            row.querySelector('.delete-file-btn').addEventListener('click', () => deleteFile(file.id, file.filename));
+        }
+        row.querySelector('.file-select').addEventListener('change', (e) => {
+            if (e.target.checked) {
+                selectedFileIds.add(file.id);
+            } else {
+                selectedFileIds.delete(file.id);
+            }
+            updateSelectionUI();
+        });
+        return row;
+    }
+
+    // --- Folders ---
+    async function sendFolderRequest(url, method, body) {
+        const response = await fetch(url, {
+            method: method,
+            headers: { 'Content-Type': 'application/json' },
+            body: body ? JSON.stringify(body) : undefined
+        });
+        if (!response.ok) throw new Error((await response.text()).trim() || '操作失败');
+    }
+
+    newFolderBtn.addEventListener('click', async () => {
+        const name = prompt('请输入文件夹名称');
+        if (!name) return;
+        try {
+            await sendFolderRequest('/api/folders', 'POST', { name: name, parent_id: currentFolderId });
+            showToast('文件夹已创建。');
+            fetchFiles();
+        } catch (error) {
+            showToast(`创建失败: ${error.message}`, 'error');
+        }
+    });
+
+    async function renameFolder(folder) {
+        const name = prompt('请输入新的文件夹名称', folder.name);
+        if (!name || name === folder.name) return;
+        try {
+            await sendFolderRequest(`/api/folders/${folder.id}`, 'PATCH', { name: name });
+            showToast('文件夹已重命名。');
+            fetchFiles();
+        } catch (error) {
+            showToast(`重命名失败: ${error.message}`, 'error');
+        }
+    }
+
+    async function deleteFolder(folder) {
+        if (!confirm(`确定要删除文件夹 ${folder.name} 吗？只能删除空文件夹。`)) return;
+        try {
+            await sendFolderRequest(`/api/folders/${folder.id}`, 'DELETE');
+            showToast('文件夹已删除。');
+            fetchFiles();
+        } catch (error) {
+            showToast(`删除失败: ${error.message}`, 'error');
+        }
+    }
+
+    // --- Selection ---
+    function updateSelectionUI() {
+        // Read-only users can only download what they select.
+        document.querySelectorAll('.selection-action').forEach(btn => {
+            btn.classList.toggle('hidden', selectedFileIds.size === 0 || (btn !== downloadSelectedBtn && !canWrite()));
+        });
+        downloadSelectedBtn.textContent = `下载所选 (${selectedFileIds.size})`;
+    }
+
+    downloadSelectedBtn.addEventListener('click', () => {
+        if (selectedFileIds.size === 0) return;
+        window.location.href = `/api/files/archive?ids=${[...selectedFileIds].join(',')}`;
+    });
+
+    // --- Bulk Operations ---
+    // runBulkJob starts a bulk job on the selected files and polls it until it
+    // has finished, then reports how many files succeeded.
+    async function runBulkJob(request, label) {
+        const response = await fetch('/api/bulk', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ ...request, file_ids: [...selectedFileIds] })
+        });
+        if (!response.ok) throw new Error((await response.text()).trim() || `${label}失败`);
+        const { status_url } = await response.json();
+
+        let job;
+        do {
+            await new Promise(resolve => setTimeout(resolve, 500));
+            const statusResponse = await fetch(status_url);
+            if (!statusResponse.ok) throw new Error('无法获取任务状态');
+            job = await statusResponse.json();
+        } while (job.status !== 'completed');
+
+        if (job.failed > 0) {
+            showToast(`${label}: ${job.succeeded} 个成功，${job.failed} 个失败。`, 'error');
         } else {
-            fileListBody.innerHTML = `<tr><td colspan="4" style="text-align: center;">没有找到文件。</td></tr>`;
+            showToast(`${label}: ${job.succeeded} 个文件已完成。`);
         }
+        selectedFileIds.clear();
+        updateSelectionUI();
+        fetchFiles(searchInput.value);
     }
 
+    deleteSelectedBtn.addEventListener('click', async () => {
+        if (!confirm(`确定要删除所选的 ${selectedFileIds.size} 个文件吗？此操作无法撤销。`)) return;
+        try {
+            await runBulkJob({ action: 'delete' }, '批量删除');
+        } catch (error) {
+            showToast(`批量删除失败: ${error.message}`, 'error');
+        }
+    });
+
+    tagSelectedBtn.addEventListener('click', async () => {
+        const input = prompt('为所选文件添加标签 (用逗号分隔):');
+        if (!input) return;
+        try {
+            await runBulkJob({ action: 'tag', tags: input.split(',') }, '添加标签');
+        } catch (error) {
+            showToast(`添加标签失败: ${error.message}`, 'error');
+        }
+    });
+
+    moveSelectedBtn.addEventListener('click', () => {
+        showMoveModal(null, `${selectedFileIds.size} 个文件`);
+    });
+
+    // Sharing a selection creates one collection link for all of its files.
+    shareSelectedBtn.addEventListener('click', () => {
+        if (selectedFileIds.size === 0) return;
+        showShareModal({ file_ids: [...selectedFileIds] }, `${selectedFileIds.size} 个文件`, null);
+    });
+
+    // --- Tags ---
+    function setTagFilter(tag) {
+        activeTag = tag;
+        if (tag) {
+            activeTagLabel.textContent = tag;
+            tagFilter.classList.remove('hidden');
+        } else {
+            tagFilter.classList.add('hidden');
+        }
+        fetchFiles(searchInput.value);
+    }
+
+    clearTagFilter.addEventListener('click', () => setTagFilter(null));
+
+    // --- Edit Modal ---
+    function showEditModal(fileId) {
+        const file = filesById[fileId];
+        fileToEdit = { id: fileId };
+        editFilenameSpan.textContent = file.filename;
+        editNameInput.value = file.filename;
+        editTagsInput.value = (file.tags || []).join(', ');
+        editDescriptionInput.value = file.description || '';
+        showModal(editModal);
+    }
+
+    closeEditModalBtn.addEventListener('click', () => hideModal(editModal));
+    editModal.addEventListener('click', (e) => {
+        if (e.target === editModal) hideModal(editModal);
+    });
+    saveEditBtn.addEventListener('click', async () => {
+        try {
+            const response = await fetch(`/api/files/${fileToEdit.id}`, {
+                method: 'PATCH',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({
+                    filename: editNameInput.value,
+                    tags: editTagsInput.value.split(','),
+                    description: editDescriptionInput.value
+                })
+            });
+            if (!response.ok) throw new Error((await response.text()).trim() || '保存失败');
+            showToast('文件信息已保存。');
+            hideModal(editModal);
+            fetchFiles(searchInput.value);
+        } catch (error) {
+            showToast(`保存失败: ${error.message}`, 'error');
+        }
+    });
+
+    // --- Move Modal ---
+    function showMoveModal(fileId, filename) {
+        fileToMove = { id: fileId, filename: filename };
+        moveFilenameSpan.textContent = filename;
+        moveFolderSelect.innerHTML = '<option value="">全部文件 (根目录)</option>';
+        allFolders
+            .map(folder => ({ id: folder.id, path: folderPath(folder.id).map(f => f.name).join(' / ') }))
+            .sort((a, b) => a.path.localeCompare(b.path))
+            .forEach(folder => {
+                const option = document.createElement('option');
+                option.value = folder.id;
+                option.textContent = folder.path;
+                moveFolderSelect.appendChild(option);
+            });
+        moveFolderSelect.value = currentFolderId === null ? '' : currentFolderId;
+        showModal(moveModal);
+    }
+
+    closeMoveModalBtn.addEventListener('click', () => hideModal(moveModal));
+    moveModal.addEventListener('click', (e) => {
+        if (e.target === moveModal) hideModal(moveModal);
+    });
+    confirmMoveBtn.addEventListener('click', async () => {
+        const folderId = moveFolderSelect.value === '' ? null : Number(moveFolderSelect.value);
+        // Without a file ID the modal was opened to move the selection.
+        if (fileToMove.id === null) {
+            hideModal(moveModal);
+            try {
+                await runBulkJob({ action: 'move', folder_id: folderId }, '批量移动');
+            } catch (error) {
+                showToast(`批量移动失败: ${error.message}`, 'error');
+            }
+            return;
+        }
+        try {
+            const response = await fetch(`/api/files/${fileToMove.id}`, {
+                method: 'PATCH',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({ folder_id: folderId })
+            });
+            if (!response.ok) throw new Error((await response.text()).trim() || '移动失败');
+            showToast('文件已移动。');
+            hideModal(moveModal);
+            fetchFiles(searchInput.value);
+        } catch (error) {
+            showToast(`移动失败: ${error.message}`, 'error');
+        }
+    });
+
     // --- Event Handlers ---
     async function uploadFile() {
   const file = fileInput.files[0];
@@ -162,6 +564,11 @@ document.addEventListener('DOMContentLoaded', () => {
 
         const formData = new FormData();
         formData.append('image', file);
+        if (currentFolderId !== null) {
+            formData.append('folder_id', currentFolderId);
+        }
+        formData.append('tags', uploadTagsInput.value);
+        formData.append('description', uploadDescriptionInput.value);
 
         try {
             const response = await fetch('/api/upload', {
@@ -174,8 +581,10 @@ document.addEventListener('DOMContentLoaded', () => {
 
             fileInput.value = '';
             fileNameSpan.textContent = '未选择任何文件';
+            uploadTagsInput.value = '';
+            uploadDescriptionInput.value = '';
             hideModal(uploadModal);
-            fetchFiles();
+            fetchFiles(searchInput.value);
             showToast('文件上传成功！');
 
         } catch (error) {
@@ -220,6 +629,18 @@ document.addEventListener('DOMContentLoaded', () => {
         window.location.href = `/api/download/${fileId}`;
     }
 
+    window.viewFile = function(fileId) {
+        window.open(`/api/files/${fileId}/view`, '_blank');
+    }
+
+    window.editFile = function(fileId) {
+        showEditModal(fileId);
+    }
+
+    window.moveFile = function(fileId, filename) {
+        showMoveModal(fileId, filename);
+    }
+
     window.deleteFile = function(fileId, filename) {
         showDeleteModal(fileId, filename);
     }
@@ -228,52 +649,191 @@ document.addEventListener('DOMContentLoaded', () => {
     const shareModal = document.getElementById('shareModal');
     const closeShareModalBtn = document.getElementById('closeShareModalBtn');
     const shareFilenameSpan = document.getElementById('shareFilename');
+    const shareLabelInput = document.getElementById('shareLabel');
     const sharePasswordInput = document.getElementById('sharePassword');
+    const shareExpirySelect = document.getElementById('shareExpiry');
+    const shareMaxDownloadsInput = document.getElementById('shareMaxDownloads');
+    const shareAllowedIpsInput = document.getElementById('shareAllowedIps');
+    const shareBurnGroup = document.getElementById('shareBurnGroup');
+    const shareBurnSelect = document.getElementById('shareBurn');
+    const shareLimitsText = document.getElementById('shareLimits');
     const generateShareLinkBtn = document.getElementById('generateShareLinkBtn');
     const shareResultDiv = document.getElementById('shareResult');
     const shareLinkInput = document.getElementById('shareLink');
     const copyShareLinkBtn = document.getElementById('copyShareLinkBtn');
     const directDownloadLinkInput = document.getElementById('directDownloadLink');
     const copyDirectDownloadLinkBtn = document.getElementById('copyDirectDownloadLinkBtn');
-    let fileToShare = { id: null, filename: null, share_token: null };
+    const shareListDiv = document.getElementById('shareList');
+    const directDownloadGroup = document.getElementById('directDownloadGroup');
+    // shareTarget is what the share modal creates links for: target holds the
+    // file_id, folder_id or file_ids sent to the server, and listQuery selects
+    // the existing links shown (null for a new collection, which has none).
+    let shareTarget = { target: null, listQuery: null, name: null, share_token: null };
 
     // --- Share Modal ---
-    async function showShareModal(fileId, filename) {
-        fileToShare = { id: fileId, filename: filename, share_token: null };
-        shareFilenameSpan.textContent = filename;
-        shareFilenameSpan.title = filename;
+    async function showShareModal(target, name, listQuery) {
+        shareTarget = { target: target, listQuery: listQuery, name: name, share_token: null };
+        shareFilenameSpan.textContent = name;
+        shareFilenameSpan.title = name;
+        shareLabelInput.value = '';
         sharePasswordInput.value = '';
+        shareExpirySelect.value = '';
+        shareMaxDownloadsInput.value = '';
+        shareMaxDownloadsInput.disabled = false;
+        shareAllowedIpsInput.value = '';
+        shareBurnSelect.value = '';
+        // Only single files can be shared for one download.
+        shareBurnGroup.classList.toggle('hidden', target.file_id === undefined);
+        shareLimitsText.textContent = '';
         shareResultDiv.classList.add('hidden');
         shareLinkInput.value = '';
         directDownloadLinkInput.value = '';
+        shareListDiv.innerHTML = '';
         showModal(shareModal);
+        loadShareList();
+    }
 
+    // loadShareList shows every link of the file or folder being shared,
+    // newest first.
+    async function loadShareList() {
+        if (!shareTarget.listQuery) return;
         try {
-            const response = await fetch(`/api/file/share-details?id=${fileId}`);
-            if (response.ok) {
-                const details = await response.json();
-                if (details.share_token) {
-                    fileToShare.share_token = details.share_token;
-                    sharePasswordInput.value = details.share_password;
-                    updateShareLinks(details.share_token, details.share_password);
-                    showToast('已加载已有的分享链接');
-                }
+            const response = await fetch(`/api/shares?${shareTarget.listQuery}`);
+            if (!response.ok) throw new Error((await response.text()).trim());
+            const { shares } = await response.json();
+
+            shareListDiv.innerHTML = '';
+            if (shares.length > 0) {
+                const heading = document.createElement('label');
+                heading.textContent = '已有链接';
+                shareListDiv.appendChild(heading);
             }
+            shares.forEach(share => shareListDiv.appendChild(renderShareRow(share)));
         } catch (error) {
-            console.error('获取分享详情时出错:', error);
+            console.error('获取分享链接时出错:', error);
+        }
+    }
+
+    function renderShareRow(share) {
+        const row = document.createElement('div');
+        row.className = 'share-row' + (share.active ? '' : ' inactive');
+        row.innerHTML = `
+            <div>
+                <div class="share-row-label"></div>
+                <div class="share-limits">${describeShareLimits(share)}</div>
+                <div class="share-access hidden"></div>
+            </div>
+            <div class="share-row-actions">
+                <button class="btn-secondary access-share-btn">记录</button>
+                <button class="btn-secondary copy-share-btn">复制</button>
+                ${share.revoked_at === null ? '<button class="btn-secondary revoke-share-btn">撤销</button>' : ''}
+            </div>
+        `;
+        row.querySelector('.share-row-label').textContent =
+            `${share.label || '未命名链接'} · 创建于 ${new Date(share.created_at).toLocaleString()}`;
+        row.querySelector('.copy-share-btn').addEventListener('click', () => {
+            navigator.clipboard.writeText(shareUrl(share.share_token))
+                .then(() => showToast('分享页面链接已复制！'))
+                .catch(() => showToast('复制失败', 'error'));
+        });
+        const revokeBtn = row.querySelector('.revoke-share-btn');
+        if (revokeBtn) {
+            revokeBtn.addEventListener('click', () => revokeShare(share));
         }
+        row.querySelector('.access-share-btn').addEventListener('click', () => {
+            toggleShareAccess(share, row.querySelector('.share-access'));
+        });
+        return row;
+    }
+
+    // toggleShareAccess shows or hides the statistics and recent visits of a
+    // share link below its row.
+    async function toggleShareAccess(share, container) {
+        if (!container.classList.contains('hidden')) {
+            container.classList.add('hidden');
+            return;
+        }
+        try {
+            const [statsResponse, accessResponse] = await Promise.all([
+                fetch(`/api/shares/${share.id}/stats`),
+                fetch(`/api/shares/${share.id}/access?limit=20`)
+            ]);
+            if (!statsResponse.ok || !accessResponse.ok) throw new Error('无法获取访问记录');
+            const stats = await statsResponse.json();
+            const { accesses } = await accessResponse.json();
+
+            const actions = { info: '访问页面', download: '下载', view: '预览' };
+            container.innerHTML = '';
+            const summary = document.createElement('div');
+            summary.textContent = `页面访问 ${stats.views} 次，下载 ${stats.downloads} 次 ` +
+                `(完成 ${stats.completed_downloads}，中断 ${stats.aborted_downloads})，` +
+                `共传输 ${(stats.bytes_served / 1024 / 1024).toFixed(2)} MB，${stats.unique_visitors} 个 IP。`;
+            container.appendChild(summary);
+            accesses.forEach(access => {
+                const line = document.createElement('div');
+                line.textContent = `${new Date(access.accessed_at).toLocaleString()} · ${access.ip} · ` +
+                    `${actions[access.action] || access.action}${access.completed ? '' : ' (中断)'}`;
+                line.title = access.user_agent;
+                container.appendChild(line);
+            });
+            container.classList.remove('hidden');
+        } catch (error) {
+            showToast(error.message, 'error');
+        }
+    }
+
+    async function revokeShare(share) {
+        if (!confirm('确定要撤销此分享链接吗？撤销后该链接将无法再访问。')) return;
+        try {
+            const response = await fetch(`/api/shares/${share.id}`, { method: 'DELETE' });
+            if (!response.ok) throw new Error((await response.text()).trim() || '撤销失败');
+            showToast('分享链接已撤销。');
+            if (share.share_token === shareTarget.share_token) {
+                shareResultDiv.classList.add('hidden');
+            }
+            loadShareList();
+            fetchFiles(searchInput.value);
+        } catch (error) {
+            showToast(`撤销失败: ${error.message}`, 'error');
+        }
+    }
+
+    function formatDuration(seconds) {
+        if (seconds >= 86400) return `${Math.floor(seconds / 86400)} 天`;
+        if (seconds >= 3600) return `${Math.floor(seconds / 3600)} 小时`;
+        return `${Math.max(1, Math.floor(seconds / 60))} 分钟`;
+    }
+
+    // describeShareLimits summarises the remaining time and downloads of a share.
+    function describeShareLimits(details) {
+        if (details.revoked_at) return '已撤销。';
+        if (!details.active) return '已失效 (已过期或下载次数已用完)。';
+        const parts = [];
+        if (details.password_protected) parts.push('需要密码');
+        if (details.burn_after_download === 'link') parts.push('下载一次后失效');
+        if (details.burn_after_download === 'file') parts.push('下载一次后删除文件');
+        if (details.allowed_ips && details.allowed_ips.length > 0) parts.push(`仅限 ${details.allowed_ips.join(', ')}`);
+        parts.push(details.expires_at === null ? '永久有效' : `剩余有效期 ${formatDuration(details.expires_in)}`);
+        parts.push(details.max_downloads === null
+            ? `已下载 ${details.download_count} 次，不限次数`
+            : `剩余下载次数 ${details.remaining_downloads} / ${details.max_downloads}`);
+        return parts.join('，') + '。';
+    }
+
+    function shareUrl(shareToken) {
+        const host = window.appConfig && window.appConfig.host ? window.appConfig.host : window.location.origin;
+        return `${host}/share.html?file=${shareToken}`;
     }
 
     function updateShareLinks(shareToken, password) {
         const host = window.appConfig && window.appConfig.host ? window.appConfig.host : window.location.origin;
-        const shareLink = `${host}/share.html?file=${shareToken}`;
-        shareLinkInput.value = shareLink;
+        shareLinkInput.value = shareUrl(shareToken);
 
-        let directLink = `${host}/api/share/download?file=${shareToken}`;
-        if (password) {
-            directLink += `&password=${encodeURIComponent(password)}`;
-        }
-        directDownloadLinkInput.value = directLink;
+        // Password protected files can only be downloaded through the share
+        // page, which checks the password without putting it in the URL.
+        // Folders and collections are downloaded as one ZIP archive.
+        directDownloadLinkInput.value = `${host}/api/share/download?file=${shareToken}`;
+        directDownloadGroup.classList.toggle('hidden', Boolean(password));
 
         shareResultDiv.classList.remove('hidden');
     }
@@ -283,20 +843,53 @@ document.addEventListener('DOMContentLoaded', () => {
         if (e.target === shareModal) hideModal(shareModal);
     });
 
+    // A one-time share always allows exactly one download.
+    shareBurnSelect.addEventListener('change', () => {
+        shareMaxDownloadsInput.disabled = shareBurnSelect.value !== '';
+        if (shareMaxDownloadsInput.disabled) shareMaxDownloadsInput.value = '1';
+    });
+
     generateShareLinkBtn.addEventListener('click', async () => {
         const password = sharePasswordInput.value;
+        const request = { ...shareTarget.target, label: shareLabelInput.value, password: password };
+        if (shareExpirySelect.value) {
+            request.expires_at = new Date(Date.now() + Number(shareExpirySelect.value) * 1000).toISOString();
+        }
+        const allowedIps = shareAllowedIpsInput.value.split(/[,，\s]+/).filter(ip => ip !== '');
+        if (allowedIps.length > 0) {
+            request.allowed_ips = allowedIps;
+        }
+        if (shareBurnSelect.value) {
+            request.burn_after_download = shareBurnSelect.value;
+        } else if (shareMaxDownloadsInput.value) {
+            request.max_downloads = Number(shareMaxDownloadsInput.value);
+        }
         try {
             const response = await fetch('/api/share', {
                 method: 'POST',
                 headers: { 'Content-Type': 'application/json' },
-                body: JSON.stringify({ file_id: fileToShare.id, password: password })
+                body: JSON.stringify(request)
             });
+            if (!response.ok) throw new Error((await response.text()).trim() || '生成链接失败');
             const result = await response.json();
-            if (!response.ok) throw new Error(result.message || '生成链接失败');
 
-            fileToShare.share_token = result.share_token;
+            shareTarget.share_token = result.share_token;
             updateShareLinks(result.share_token, password);
-            showToast('分享链接已生成/更新！');
+            shareLimitsText.textContent = describeShareLimits({
+                active: true,
+                revoked_at: null,
+                password_protected: password !== '',
+                burn_after_download: shareBurnSelect.value,
+                allowed_ips: allowedIps,
+                expires_at: request.expires_at || null,
+                expires_in: Number(shareExpirySelect.value),
+                max_downloads: request.burn_after_download ? 1 : request.max_downloads || null,
+                remaining_downloads: request.burn_after_download ? 1 : request.max_downloads,
+                download_count: 0
+            });
+            showToast('分享链接已生成！');
+            loadShareList();
+            fetchFiles(searchInput.value);
         } catch (error) {
             showToast(`生成链接失败: ${error.message}`, 'error');
         }
@@ -319,10 +912,614 @@ document.addEventListener('DOMContentLoaded', () => {
     });
 
     window.shareFile = function(fileId, filename) {
-        showShareModal(fileId, filename);
+        showShareModal({ file_id: fileId }, filename, `file_id=${fileId}`);
+    }
+
+    // --- Upload Request Modal ---
+    const uploadRequestModal = document.getElementById('uploadRequestModal');
+    const showUploadRequestModalBtn = document.getElementById('showUploadRequestModalBtn');
+    const closeUploadRequestModalBtn = document.getElementById('closeUploadRequestModalBtn');
+    const uploadRequestFolderSpan = document.getElementById('uploadRequestFolder');
+    const uploadRequestLabelInput = document.getElementById('uploadRequestLabel');
+    const uploadRequestPasswordInput = document.getElementById('uploadRequestPassword');
+    const uploadRequestExpirySelect = document.getElementById('uploadRequestExpiry');
+    const uploadRequestMaxSizeInput = document.getElementById('uploadRequestMaxSize');
+    const uploadRequestMaxFilesInput = document.getElementById('uploadRequestMaxFiles');
+    const generateUploadRequestBtn = document.getElementById('generateUploadRequestBtn');
+    const uploadRequestListDiv = document.getElementById('uploadRequestList');
+
+    showUploadRequestModalBtn.addEventListener('click', () => {
+        const path = folderPath(currentFolderId);
+        uploadRequestFolderSpan.textContent = path.length > 0 ? path[path.length - 1].name : '全部文件';
+        uploadRequestLabelInput.value = '';
+        uploadRequestPasswordInput.value = '';
+        uploadRequestExpirySelect.value = '';
+        uploadRequestMaxSizeInput.value = '';
+        uploadRequestMaxFilesInput.value = '';
+        uploadRequestListDiv.innerHTML = '';
+        showModal(uploadRequestModal);
+        loadUploadRequests();
+    });
+
+    closeUploadRequestModalBtn.addEventListener('click', () => hideModal(uploadRequestModal));
+    uploadRequestModal.addEventListener('click', (e) => {
+        if (e.target === uploadRequestModal) hideModal(uploadRequestModal);
+    });
+
+    // loadUploadRequests shows the upload links of the current folder.
+    async function loadUploadRequests() {
+        try {
+            const folderParam = currentFolderId === null ? 'root' : currentFolderId;
+            const response = await fetch(`/api/upload-requests?folder_id=${folderParam}`);
+            if (!response.ok) throw new Error((await response.text()).trim());
+            const { upload_requests } = await response.json();
+
+            uploadRequestListDiv.innerHTML = '';
+            if (upload_requests.length > 0) {
+                const heading = document.createElement('label');
+                heading.textContent = '已有上传链接';
+                uploadRequestListDiv.appendChild(heading);
+            }
+            upload_requests.forEach(request => uploadRequestListDiv.appendChild(renderUploadRequestRow(request)));
+        } catch (error) {
+            console.error('获取上传链接时出错:', error);
+        }
+    }
+
+    function describeUploadRequest(request) {
+        if (request.revoked_at) return '已撤销。';
+        if (!request.active) return '已失效 (已过期或文件数量已满)。';
+        const parts = [];
+        if (request.password_protected) parts.push('需要密码');
+        parts.push(request.expires_at === null ? '永久有效' : `有效期至 ${new Date(request.expires_at).toLocaleString()}`);
+        if (request.max_file_size !== null) {
+            parts.push(`单个文件不超过 ${(request.max_file_size / 1024 / 1024).toFixed(0)} MB`);
+        }
+        parts.push(request.max_files === null
+            ? `已收到 ${request.upload_count} 个文件`
+            : `已收到 ${request.upload_count} / ${request.max_files} 个文件`);
+        return parts.join('，') + '。';
+    }
+
+    function renderUploadRequestRow(request) {
+        const row = document.createElement('div');
+        row.className = 'share-row' + (request.active ? '' : ' inactive');
+        row.innerHTML = `
+            <div>
+                <div class="share-row-label"></div>
+                <div class="share-limits">${describeUploadRequest(request)}</div>
+            </div>
+            <div class="share-row-actions">
+                <button class="btn-secondary copy-share-btn">复制</button>
+                ${request.revoked_at === null ? '<button class="btn-secondary revoke-share-btn">撤销</button>' : ''}
+            </div>
+        `;
+        row.querySelector('.share-row-label').textContent =
+            `${request.label || '未命名链接'} · 创建于 ${new Date(request.created_at).toLocaleString()}`;
+        row.querySelector('.copy-share-btn').addEventListener('click', () => {
+            navigator.clipboard.writeText(uploadRequestUrl(request.token))
+                .then(() => showToast('上传链接已复制！'))
+                .catch(() => showToast('复制失败', 'error'));
+        });
+        const revokeBtn = row.querySelector('.revoke-share-btn');
+        if (revokeBtn) {
+            revokeBtn.addEventListener('click', () => revokeUploadRequest(request));
+        }
+        return row;
+    }
+
+    function uploadRequestUrl(token) {
+        const host = window.appConfig && window.appConfig.host ? window.appConfig.host : window.location.origin;
+        return `${host}/upload.html?token=${token}`;
+    }
+
+    async function revokeUploadRequest(request) {
+        if (!confirm('确定要撤销此上传链接吗？已上传的文件会保留。')) return;
+        try {
+            const response = await fetch(`/api/upload-requests/${request.id}`, { method: 'DELETE' });
+            if (!response.ok) throw new Error((await response.text()).trim() || '撤销失败');
+            showToast('上传链接已撤销。');
+            loadUploadRequests();
+        } catch (error) {
+            showToast(`撤销失败: ${error.message}`, 'error');
+        }
     }
 
+    generateUploadRequestBtn.addEventListener('click', async () => {
+        const request = {
+            folder_id: currentFolderId,
+            label: uploadRequestLabelInput.value,
+            password: uploadRequestPasswordInput.value
+        };
+        if (uploadRequestExpirySelect.value) {
+            request.expires_at = new Date(Date.now() + Number(uploadRequestExpirySelect.value) * 1000).toISOString();
+        }
+        if (uploadRequestMaxSizeInput.value) {
+            request.max_file_size = Number(uploadRequestMaxSizeInput.value) * 1024 * 1024;
+        }
+        if (uploadRequestMaxFilesInput.value) {
+            request.max_files = Number(uploadRequestMaxFilesInput.value);
+        }
+        try {
+            const response = await fetch('/api/upload-requests', {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify(request)
+            });
+            if (!response.ok) throw new Error((await response.text()).trim() || '生成链接失败');
+            const result = await response.json();
+            navigator.clipboard.writeText(uploadRequestUrl(result.token))
+                .then(() => showToast('上传链接已生成并复制！'))
+                .catch(() => showToast('上传链接已生成！'));
+            loadUploadRequests();
+        } catch (error) {
+            showToast(`生成链接失败: ${error.message}`, 'error');
+        }
+    });
+
+    // --- Users ---
+    const currentUserLabel = document.getElementById('currentUserLabel');
+    const changePasswordLink = document.getElementById('changePasswordLink');
+    const showUserModalLink = document.getElementById('showUserModalLink');
+    const userModal = document.getElementById('userModal');
+    const closeUserModalBtn = document.getElementById('closeUserModalBtn');
+    const newUsernameInput = document.getElementById('newUsername');
+    const newUserPasswordInput = document.getElementById('newUserPassword');
+    const newUserRoleSelect = document.getElementById('newUserRole');
+    const createUserBtn = document.getElementById('createUserBtn');
+    const userListDiv = document.getElementById('userList');
+    const roleNames = { admin: '管理员', member: '成员', readonly: '只读' };
+
+    // canWrite reports whether the logged in user may upload, share and
+    // organise files; canModify whether they may change the given file.
+    function canWrite() {
+        return currentUser !== null && currentUser.role !== 'readonly';
+    }
+
+    function canModify(file) {
+        if (currentUser === null) return false;
+        return currentUser.role === 'admin' || (currentUser.role === 'member' && file.owner_id === currentUser.id);
+    }
+
+    async function fetchCurrentUser() {
+        const response = await fetch('/api/me');
+        if (!response.ok) throw new Error('无法获取当前用户');
+        currentUser = await response.json();
+        currentUserLabel.textContent = `${currentUser.username} (${roleNames[currentUser.role] || currentUser.role})`;
+        showUserModalLink.classList.toggle('hidden', currentUser.role !== 'admin');
+        showApiKeyModalLink.classList.toggle('hidden', currentUser.role !== 'admin');
+        document.querySelectorAll('.requires-write').forEach(el => el.classList.toggle('hidden', !canWrite()));
+    }
+
+    async function sendUserRequest(url, method, body) {
+        const response = await fetch(url, {
+            method: method,
+            headers: { 'Content-Type': 'application/json' },
+            body: body ? JSON.stringify(body) : undefined
+        });
+        if (!response.ok) throw new Error((await response.text()).trim() || '操作失败');
+        return response.json();
+    }
+
+    changePasswordLink.addEventListener('click', async () => {
+        const currentPassword = prompt('请输入当前密码');
+        if (currentPassword === null) return;
+        const password = prompt('请输入新密码');
+        if (!password) return;
+        try {
+            await sendUserRequest(`/api/users/${currentUser.id}`, 'PATCH', { password: password, current_password: currentPassword });
+            showToast('密码已修改。');
+        } catch (error) {
+            showToast(`修改失败: ${error.message}`, 'error');
+        }
+    });
+
+    async function loadUsers() {
+        try {
+            const { users } = await sendUserRequest('/api/users', 'GET');
+            userListDiv.innerHTML = '';
+            users.forEach(user => userListDiv.appendChild(renderUserRow(user)));
+        } catch (error) {
+            showToast(`获取用户失败: ${error.message}`, 'error');
+        }
+    }
+
+    function renderUserRow(user) {
+        const row = document.createElement('div');
+        row.className = 'share-row';
+        row.innerHTML = `
+            <div>
+                <div class="share-row-label"></div>
+                <div class="share-limits">创建于 ${new Date(user.created_at).toLocaleString()}</div>
+            </div>
+            <div class="share-row-actions">
+                <select class="user-role-select">
+                    ${Object.entries(roleNames).map(([role, name]) => `<option value="${role}">${name}</option>`).join('')}
+                </select>
+                <button class="btn-secondary reset-password-btn">重置密码</button>
+                ${user.totp_enabled ? '<button class="btn-secondary reset-totp-btn">重置两步验证</button>' : ''}
+                ${user.id === currentUser.id ? '' : '<button class="btn-secondary delete-user-btn">删除</button>'}
+            </div>
+        `;
+        row.querySelector('.share-row-label').textContent = user.username;
+        const roleSelect = row.querySelector('.user-role-select');
+        roleSelect.value = user.role;
+        roleSelect.addEventListener('change', async () => {
+            try {
+                await sendUserRequest(`/api/users/${user.id}`, 'PATCH', { role: roleSelect.value });
+                showToast(`${user.username} 的角色已修改。`);
+            } catch (error) {
+                showToast(`修改失败: ${error.message}`, 'error');
+            }
+            loadUsers();
+        });
+        row.querySelector('.reset-password-btn').addEventListener('click', async () => {
+            const password = prompt(`请输入 ${user.username} 的新密码`);
+            if (!password) return;
+            try {
+                await sendUserRequest(`/api/users/${user.id}`, 'PATCH', { password: password });
+                showToast('密码已重置。');
+            } catch (error) {
+                showToast(`重置失败: ${error.message}`, 'error');
+            }
+        });
+        const resetTotpBtn = row.querySelector('.reset-totp-btn');
+        if (resetTotpBtn) {
+            resetTotpBtn.addEventListener('click', async () => {
+                if (!confirm(`确定要关闭 ${user.username} 的两步验证吗？`)) return;
+                try {
+                    await sendUserRequest(`/api/users/${user.id}/totp`, 'DELETE');
+                    showToast('两步验证已重置。');
+                    loadUsers();
+                } catch (error) {
+                    showToast(`重置失败: ${error.message}`, 'error');
+                }
+            });
+        }
+        const deleteBtn = row.querySelector('.delete-user-btn');
+        if (deleteBtn) {
+            deleteBtn.addEventListener('click', async () => {
+                if (!confirm(`确定要删除用户 ${user.username} 吗？其上传的文件会保留。`)) return;
+                try {
+                    await sendUserRequest(`/api/users/${user.id}`, 'DELETE');
+                    showToast('用户已删除。');
+                    loadUsers();
+                } catch (error) {
+                    showToast(`删除失败: ${error.message}`, 'error');
+                }
+            });
+        }
+        return row;
+    }
+
+    showUserModalLink.addEventListener('click', () => {
+        newUsernameInput.value = '';
+        newUserPasswordInput.value = '';
+        newUserRoleSelect.value = 'member';
+        userListDiv.innerHTML = '';
+        showModal(userModal);
+        loadUsers();
+    });
+    closeUserModalBtn.addEventListener('click', () => hideModal(userModal));
+    userModal.addEventListener('click', (e) => {
+        if (e.target === userModal) hideModal(userModal);
+    });
+    createUserBtn.addEventListener('click', async () => {
+        try {
+            await sendUserRequest('/api/users', 'POST', {
+                username: newUsernameInput.value.trim(),
+                password: newUserPasswordInput.value,
+                role: newUserRoleSelect.value
+            });
+            showToast('用户已添加。');
+            newUsernameInput.value = '';
+            newUserPasswordInput.value = '';
+            loadUsers();
+        } catch (error) {
+            showToast(`添加失败: ${error.message}`, 'error');
+        }
+    });
+
+    // --- Two-Factor Authentication ---
+    const showTotpModalLink = document.getElementById('showTotpModalLink');
+    const totpModal = document.getElementById('totpModal');
+    const closeTotpModalBtn = document.getElementById('closeTotpModalBtn');
+    const totpStatus = document.getElementById('totpStatus');
+    const totpSetupDiv = document.getElementById('totpSetup');
+    const totpQrCode = document.getElementById('totpQrCode');
+    const totpSecretInput = document.getElementById('totpSecret');
+    const totpEnableCodeInput = document.getElementById('totpEnableCode');
+    const totpEnableBtn = document.getElementById('totpEnableBtn');
+    const totpRecoveryCodesDiv = document.getElementById('totpRecoveryCodes');
+    const totpRecoveryCodeList = document.getElementById('totpRecoveryCodeList');
+    const totpStartBtn = document.getElementById('totpStartBtn');
+    const totpRegenerateBtn = document.getElementById('totpRegenerateBtn');
+    const totpDisableBtn = document.getElementById('totpDisableBtn');
+
+    function renderTotpStatus() {
+        const enabled = currentUser.totp_enabled;
+        totpStatus.textContent = enabled
+            ? '两步验证已开启，登录时需要输入验证器中的验证码。'
+            : '两步验证未开启。开启后，登录时除密码外还需要输入验证器中的验证码。';
+        totpStartBtn.classList.toggle('hidden', enabled);
+        totpRegenerateBtn.classList.toggle('hidden', !enabled);
+        totpDisableBtn.classList.toggle('hidden', !enabled);
+    }
+
+    function showRecoveryCodes(codes) {
+        totpRecoveryCodeList.textContent = codes.join('\n');
+        totpRecoveryCodesDiv.classList.remove('hidden');
+    }
+
+    showTotpModalLink.addEventListener('click', () => {
+        totpSetupDiv.classList.add('hidden');
+        totpRecoveryCodesDiv.classList.add('hidden');
+        renderTotpStatus();
+        showModal(totpModal);
+    });
+    closeTotpModalBtn.addEventListener('click', () => hideModal(totpModal));
+    totpModal.addEventListener('click', (e) => {
+        if (e.target === totpModal) hideModal(totpModal);
+    });
+    totpStartBtn.addEventListener('click', async () => {
+        try {
+            const setup = await sendUserRequest('/api/me/totp/setup', 'POST');
+            totpQrCode.src = setup.qr_code;
+            totpSecretInput.value = setup.secret;
+            totpEnableCodeInput.value = '';
+            totpSetupDiv.classList.remove('hidden');
+            totpStartBtn.classList.add('hidden');
+            totpEnableCodeInput.focus();
+        } catch (error) {
+            showToast(`设置失败: ${error.message}`, 'error');
+        }
+    });
+    totpEnableBtn.addEventListener('click', async () => {
+        try {
+            const result = await sendUserRequest('/api/me/totp/enable', 'POST', { code: totpEnableCodeInput.value.trim() });
+            currentUser.totp_enabled = true;
+            totpSetupDiv.classList.add('hidden');
+            renderTotpStatus();
+            showRecoveryCodes(result.recovery_codes);
+            showToast('两步验证已开启。');
+        } catch (error) {
+            showToast(`开启失败: ${error.message}`, 'error');
+        }
+    });
+    totpRegenerateBtn.addEventListener('click', async () => {
+        const code = prompt('请输入验证器中的验证码');
+        if (!code) return;
+        try {
+            const result = await sendUserRequest('/api/me/totp/recovery-codes', 'POST', { code: code.trim() });
+            showRecoveryCodes(result.recovery_codes);
+            showToast('已生成新的恢复码，旧的恢复码已失效。');
+        } catch (error) {
+            showToast(`生成失败: ${error.message}`, 'error');
+        }
+    });
+    totpDisableBtn.addEventListener('click', async () => {
+        let password = '';
+        if (currentUser.has_password) {
+            password = prompt('请输入当前密码');
+            if (password === null) return;
+        }
+        const code = prompt('请输入验证器中的验证码或恢复码');
+        if (!code) return;
+        try {
+            await sendUserRequest('/api/me/totp/disable', 'POST', { password: password, code: code.trim() });
+            currentUser.totp_enabled = false;
+            totpRecoveryCodesDiv.classList.add('hidden');
+            renderTotpStatus();
+            showToast('两步验证已关闭。');
+        } catch (error) {
+            showToast(`关闭失败: ${error.message}`, 'error');
+        }
+    });
+
+    // --- Single Sign-On ---
+    // Linking goes through the identity provider, which redirects back here
+    // with the outcome in the query string.
+    const linkSsoLink = document.getElementById('linkSsoLink');
+    const ssoMessages = {
+        denied: '该单点登录账号不允许关联',
+        taken: '该单点登录账号已关联到其他用户',
+        expired: '关联已超时，请重试',
+        failed: '关联单点登录失败'
+    };
+    fetch('/api/login/options')
+        .then(response => response.json())
+        .then(options => linkSsoLink.classList.toggle('hidden', !options.sso))
+        .catch(() => {});
+    linkSsoLink.addEventListener('click', () => {
+        window.location.href = '/api/oidc/link';
+    });
+    const ssoParams = new URLSearchParams(window.location.search);
+    if (ssoParams.get('sso') === 'linked') {
+        showToast('已关联单点登录，之后可以使用单点登录。');
+    } else if (ssoParams.has('sso_error')) {
+        showToast(ssoMessages[ssoParams.get('sso_error')] || ssoMessages.failed, 'error');
+    }
+    if (ssoParams.has('sso') || ssoParams.has('sso_error')) {
+        history.replaceState(null, '', '/');
+    }
+
+    // --- API Keys ---
+    const showApiKeyModalLink = document.getElementById('showApiKeyModalLink');
+    const apiKeyModal = document.getElementById('apiKeyModal');
+    const closeApiKeyModalBtn = document.getElementById('closeApiKeyModalBtn');
+    const apiKeyNameInput = document.getElementById('apiKeyName');
+    const apiKeyScopesDiv = document.getElementById('apiKeyScopes');
+    const apiKeyExpirySelect = document.getElementById('apiKeyExpiry');
+    const createApiKeyBtn = document.getElementById('createApiKeyBtn');
+    const apiKeyResultDiv = document.getElementById('apiKeyResult');
+    const apiKeyValueInput = document.getElementById('apiKeyValue');
+    const copyApiKeyBtn = document.getElementById('copyApiKeyBtn');
+    const apiKeyListDiv = document.getElementById('apiKeyList');
+    const scopeNames = { upload: '上传', download: '下载', list: '列出', delete: '删除', share: '分享' };
+
+    async function loadApiKeys() {
+        try {
+            const { api_keys } = await sendUserRequest('/api/api-keys', 'GET');
+            apiKeyListDiv.innerHTML = '';
+            api_keys.forEach(key => apiKeyListDiv.appendChild(renderApiKeyRow(key)));
+        } catch (error) {
+            showToast(`获取 API 密钥失败: ${error.message}`, 'error');
+        }
+    }
+
+    function renderApiKeyRow(key) {
+        const row = document.createElement('div');
+        row.className = 'share-row' + (key.active ? '' : ' inactive');
+        const parts = [key.scopes.map(scope => scopeNames[scope] || scope).join('、')];
+        if (key.expires_at) parts.push(`${new Date(key.expires_at).toLocaleString()} 过期`);
+        parts.push(key.last_used_at ? `最近使用: ${new Date(key.last_used_at).toLocaleString()} (${key.last_used_ip})` : '从未使用');
+        if (key.revoked_at) parts.push('已撤销');
+        row.innerHTML = `
+            <div>
+                <div class="share-row-label"></div>
+                <div class="share-limits">${parts.join(' · ')}</div>
+            </div>
+            <div class="share-row-actions">
+                ${key.revoked_at === null ? '<button class="btn-secondary revoke-share-btn">撤销</button>' : ''}
+            </div>
+        `;
+        row.querySelector('.share-row-label').textContent = `${key.name} · ${key.prefix}…`;
+        const revokeBtn = row.querySelector('.revoke-share-btn');
+        if (revokeBtn) {
+            revokeBtn.addEventListener('click', async () => {
+                if (!confirm(`确定要撤销密钥 ${key.name} 吗？使用它的程序将无法再访问。`)) return;
+                try {
+                    await sendUserRequest(`/api/api-keys/${key.id}`, 'DELETE');
+                    showToast('API 密钥已撤销。');
+                    loadApiKeys();
+                } catch (error) {
+                    showToast(`撤销失败: ${error.message}`, 'error');
+                }
+            });
+        }
+        return row;
+    }
+
+    showApiKeyModalLink.addEventListener('click', () => {
+        apiKeyNameInput.value = '';
+        apiKeyExpirySelect.value = '';
+        apiKeyResultDiv.classList.add('hidden');
+        apiKeyValueInput.value = '';
+        apiKeyListDiv.innerHTML = '';
+        showModal(apiKeyModal);
+        loadApiKeys();
+    });
+    closeApiKeyModalBtn.addEventListener('click', () => hideModal(apiKeyModal));
+    apiKeyModal.addEventListener('click', (e) => {
+        if (e.target === apiKeyModal) hideModal(apiKeyModal);
+    });
+    copyApiKeyBtn.addEventListener('click', () => {
+        navigator.clipboard.writeText(apiKeyValueInput.value)
+            .then(() => showToast('API 密钥已复制！'))
+            .catch(() => showToast('复制失败', 'error'));
+    });
+    createApiKeyBtn.addEventListener('click', async () => {
+        const request = {
+            name: apiKeyNameInput.value.trim(),
+            scopes: [...apiKeyScopesDiv.querySelectorAll('input:checked')].map(input => input.value)
+        };
+        if (apiKeyExpirySelect.value) {
+            request.expires_at = new Date(Date.now() + Number(apiKeyExpirySelect.value) * 1000).toISOString();
+        }
+        try {
+            const result = await sendUserRequest('/api/api-keys', 'POST', request);
+            apiKeyValueInput.value = result.key;
+            apiKeyResultDiv.classList.remove('hidden');
+            apiKeyNameInput.value = '';
+            showToast('API 密钥已生成。');
+            loadApiKeys();
+        } catch (error) {
+            showToast(`生成失败: ${error.message}`, 'error');
+        }
+    });
+
+    // --- Sessions ---
+    const showSessionModalLink = document.getElementById('showSessionModalLink');
+    const logoutLink = document.getElementById('logoutLink');
+    const sessionModal = document.getElementById('sessionModal');
+    const closeSessionModalBtn = document.getElementById('closeSessionModalBtn');
+    const sessionListDiv = document.getElementById('sessionList');
+    const logoutAllBtn = document.getElementById('logoutAllBtn');
+
+    async function loadSessions() {
+        try {
+            const { sessions } = await sendUserRequest('/api/sessions', 'GET');
+            sessionListDiv.innerHTML = '';
+            sessions.forEach(session => sessionListDiv.appendChild(renderSessionRow(session)));
+        } catch (error) {
+            showToast(`获取登录设备失败: ${error.message}`, 'error');
+        }
+    }
+
+    function renderSessionRow(session) {
+        const row = document.createElement('div');
+        row.className = 'share-row';
+        row.innerHTML = `
+            <div>
+                <div class="share-row-label"></div>
+                <div class="share-limits"></div>
+            </div>
+            <div class="share-row-actions">
+                <button class="btn-secondary revoke-share-btn">${session.current ? '退出' : '移除'}</button>
+            </div>
+        `;
+        row.querySelector('.share-row-label').textContent =
+            `${session.current ? '当前设备 · ' : ''}${session.user_agent || '未知设备'}`;
+        row.querySelector('.share-limits').textContent =
+            `${session.ip} · 登录于 ${new Date(session.created_at).toLocaleString()} · 最近活动 ${new Date(session.last_seen_at).toLocaleString()}`;
+        row.querySelector('.revoke-share-btn').addEventListener('click', async () => {
+            try {
+                await sendUserRequest(`/api/sessions/${session.id}`, 'DELETE');
+                if (session.current) {
+                    window.location.href = '/login.html';
+                    return;
+                }
+                showToast('已移除该设备的登录。');
+                loadSessions();
+            } catch (error) {
+                showToast(`移除失败: ${error.message}`, 'error');
+            }
+        });
+        return row;
+    }
+
+    showSessionModalLink.addEventListener('click', () => {
+        sessionListDiv.innerHTML = '';
+        showModal(sessionModal);
+        loadSessions();
+    });
+    closeSessionModalBtn.addEventListener('click', () => hideModal(sessionModal));
+    sessionModal.addEventListener('click', (e) => {
+        if (e.target === sessionModal) hideModal(sessionModal);
+    });
+    logoutAllBtn.addEventListener('click', async () => {
+        if (!confirm('确定要退出所有设备上的登录吗？')) return;
+        try {
+            await sendUserRequest('/api/logout-all', 'POST');
+            window.location.href = '/login.html';
+        } catch (error) {
+            showToast(`退出失败: ${error.message}`, 'error');
+        }
+    });
+    logoutLink.addEventListener('click', async () => {
+        try {
+            await sendUserRequest('/api/logout', 'POST');
+            window.location.href = '/login.html';
+        } catch (error) {
+            showToast(`退出失败: ${error.message}`, 'error');
+        }
+    });
+
+    sortSelect.addEventListener('change', () => fetchFiles(searchInput.value));
+    ownerSelect.addEventListener('change', () => fetchFiles(searchInput.value));
+    loadMoreBtn.addEventListener('click', () => fetchFiles(searchInput.value, true));
+
     // --- Initial Load ---
     uploadButton.addEventListener('click', uploadFile);
-    fetchConfig().then(() => fetchFiles());
+    Promise.all([fetchConfig(), fetchCurrentUser()]).then(() => fetchFiles());
 });
\ No newline at end of file
@@ -1,9 +1,14 @@
 document.addEventListener('DOMContentLoaded', () => {
+    const filenameLabel = document.getElementById('filenameLabel');
     const filenameSpan = document.getElementById('filename');
     const filesizeSpan = document.getElementById('filesize');
     const downloadPasswordInput = document.getElementById('downloadPassword');
     const downloadBtn = document.getElementById('downloadBtn');
+    const viewBtn = document.getElementById('viewBtn');
     const errorMessage = document.getElementById('errorMessage');
+    const shareLimitsText = document.getElementById('shareLimits');
+    const shareFilesDiv = document.getElementById('shareFiles');
+    const listFilesBtn = document.getElementById('listFilesBtn');
     const toastContainer = document.getElementById('toastContainer');
 
     const urlParams = new URLSearchParams(window.location.search);
@@ -25,35 +30,152 @@ document.addEventListener('DOMContentLoaded', () => {
         }, 3000); // Toast disappears after 3 seconds
     }
 
+    let passwordRequired = false;
+    let burnAfterDownload = '';
+
+    // Revoked, expired and used up links are answered with 410 Gone.
+    async function goneMessage(response) {
+        const text = (await response.text()).trim();
+        if (text.includes('revoked')) return '此分享链接已被撤销';
+        return text.includes('download limit') ? '此分享链接的下载次数已用完' : '此分享链接已过期';
+    }
+
     async function fetchFileInfo() {
         try {
             const response = await fetch(`/api/share/info?file=${fileToken}`);
+            if (response.status === 410) {
+                throw new Error(await goneMessage(response));
+            }
+            if (response.status === 403) {
+                throw new Error('此分享链接不允许从您所在的网络访问');
+            }
             if (!response.ok) {
                 throw new Error('文件未找到或链接已失效');
             }
             const info = await response.json();
-            filenameSpan.textContent = info.filename;
-            filesizeSpan.textContent = (info.filesize / 1024 / 1024).toFixed(2) + ' MB';
-            downloadBtn.dataset.filename = info.filename;
+            passwordRequired = info.password_required;
+            burnAfterDownload = info.burn_after_download;
+            if (info.kind === 'file') {
+                filenameSpan.textContent = info.filename;
+                filesizeSpan.textContent = formatSize(info.filesize);
+                downloadBtn.dataset.filename = info.filename;
+            } else {
+                showFileList(info);
+            }
+            const limits = [];
+            if (info.expires_at) {
+                limits.push(`有效期至 ${new Date(info.expires_at).toLocaleString()}`);
+            }
+            if (info.burn_after_download) {
+                limits.push(info.burn_after_download === 'file'
+                    ? '此文件只能下载一次，下载完成后将被删除'
+                    : '此链接只能下载一次');
+            } else if (info.remaining_downloads !== null) {
+                limits.push(`剩余下载次数 ${info.remaining_downloads}`);
+            }
+            shareLimitsText.textContent = limits.join('，');
+            // Viewing would use up the only download of a one-time share.
+            if (info.inline && !info.burn_after_download) {
+                viewBtn.classList.remove('hidden');
+            }
         } catch (error) {
             document.body.innerHTML = `<h1>${error.message}</h1>`;
         }
     }
 
-    downloadBtn.addEventListener('click', async () => {
-        const password = downloadPasswordInput.value;
-        let downloadUrl = `/api/share/download?file=${fileToken}`;
-        if (password) {
-            downloadUrl += `&password=${encodeURIComponent(password)}`;
+    function formatSize(bytes) {
+        return (bytes / 1024 / 1024).toFixed(2) + ' MB';
+    }
+
+    // showFileList shows the contents of a folder or collection share. The
+    // server only lists the files once the password has been given.
+    function showFileList(info) {
+        document.title = info.name;
+        filenameLabel.textContent = '名称:';
+        filenameSpan.textContent = info.name;
+        downloadBtn.dataset.filename = `${info.name}.zip`;
+        downloadBtn.textContent = '全部下载';
+        listFilesBtn.classList.toggle('hidden', Boolean(info.files));
+        if (!info.files) {
+            filesizeSpan.textContent = '输入密码后可查看';
+            return;
+        }
+
+        const total = info.files.reduce((sum, file) => sum + file.filesize, 0);
+        filesizeSpan.textContent = `${info.files.length} 个文件，共 ${formatSize(total)}`;
+        shareFilesDiv.innerHTML = '';
+        info.files.forEach(file => {
+            const row = document.createElement('div');
+            row.className = 'share-row';
+            row.innerHTML = `
+                <div>
+                    <div class="share-row-label"></div>
+                    <div class="share-limits">${formatSize(file.filesize)}</div>
+                </div>
+                <div class="share-row-actions">
+                    ${file.inline ? '<button class="btn-secondary view-item-btn">预览</button>' : ''}
+                    <button class="btn-secondary download-item-btn">下载</button>
+                </div>
+            `;
+            row.querySelector('.share-row-label').textContent = file.name;
+            row.querySelector('.download-item-btn').addEventListener('click', (e) => {
+                download(`/api/share/download?file=${fileToken}&item=${file.id}`, file.name.split('/').pop(), e.target);
+            });
+            const viewItemBtn = row.querySelector('.view-item-btn');
+            if (viewItemBtn) {
+                viewItemBtn.addEventListener('click', () => view(`/api/share/view?file=${fileToken}&item=${file.id}`));
+            }
+            shareFilesDiv.appendChild(row);
+        });
+        shareFilesDiv.classList.remove('hidden');
+    }
+
+    // unlock sends the password in a POST body. The server answers with a
+    // short-lived cookie that lets the following download through, so the
+    // password never appears in a URL.
+    async function unlock() {
+        if (!passwordRequired) return;
+        const response = await fetch('/api/share/unlock', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ file: fileToken, password: downloadPasswordInput.value })
+        });
+        if (response.status === 410) {
+            throw new Error(await goneMessage(response));
+        }
+        if (response.status === 429) {
+            throw new Error(`尝试次数过多，请 ${response.headers.get('Retry-After')} 秒后再试`);
+        }
+        if (!response.ok) {
+            const errorText = (await response.text()).trim();
+            throw new Error(errorText === 'Invalid password' ? '密码无效' : errorText || '验证失败');
+        }
+    }
+
+    listFilesBtn.addEventListener('click', async () => {
+        try {
+            await unlock();
+            await fetchFileInfo();
+        } catch (error) {
+            showToast(error.message, 'error');
         }
+    });
 
+    // download fetches url and saves it as filename, showing progress on the
+    // button that started it.
+    async function download(downloadUrl, filename, button) {
+        const label = button.textContent;
         errorMessage.textContent = '';
-        downloadBtn.textContent = '下载中...';
-        downloadBtn.disabled = true;
+        button.textContent = '下载中...';
+        button.disabled = true;
 
         try {
+            await unlock();
             const response = await fetch(downloadUrl);
 
+            if (response.status === 410) {
+                throw new Error(await goneMessage(response));
+            }
             if (!response.ok) {
                 let errorText = await response.text();
                 if (errorText.trim() === 'Invalid password') {
@@ -67,20 +189,45 @@ document.addEventListener('DOMContentLoaded', () => {
             const a = document.createElement('a');
             a.style.display = 'none';
             a.href = url;
-            a.download = downloadBtn.dataset.filename || 'download';
+            a.download = filename || 'download';
             document.body.appendChild(a);
             a.click();
             window.URL.revokeObjectURL(url);
             document.body.removeChild(a);
+            if (burnAfterDownload) {
+                // The link is gone now, so there is nothing left to show.
+                document.body.innerHTML = '<h1>下载完成，此分享链接已失效</h1>';
+                return;
+            }
             showToast('下载成功！');
+            fetchFileInfo();
 
         } catch (error) {
             showToast(error.message, 'error');
         } finally {
-            downloadBtn.textContent = '下载';
-            downloadBtn.disabled = false;
+            button.textContent = label;
+            button.disabled = false;
         }
+    }
+
+    downloadBtn.addEventListener('click', () => {
+        download(`/api/share/download?file=${fileToken}`, downloadBtn.dataset.filename, downloadBtn);
     });
 
+    async function view(viewUrl) {
+        // Open the window straight away, before the popup blocker forgets
+        // that it came from a click.
+        const viewWindow = window.open('', '_blank');
+        try {
+            await unlock();
+            viewWindow.location = viewUrl;
+        } catch (error) {
+            viewWindow.close();
+            showToast(error.message, 'error');
+        }
+    }
+
+    viewBtn.addEventListener('click', () => view(`/api/share/view?file=${fileToken}`));
+
     fetchFileInfo();
 });
\ No newline at end of file
@@ -0,0 +1,125 @@
+document.addEventListener('DOMContentLoaded', () => {
+    const requestLabel = document.getElementById('requestLabel');
+    const requestLimits = document.getElementById('requestLimits');
+    const fileInput = document.getElementById('fileInput');
+    const passwordGroup = document.getElementById('passwordGroup');
+    const uploadPasswordInput = document.getElementById('uploadPassword');
+    const uploadBtn = document.getElementById('uploadBtn');
+    const uploadedList = document.getElementById('uploadedList');
+    const toastContainer = document.getElementById('toastContainer');
+
+    const urlParams = new URLSearchParams(window.location.search);
+    const token = urlParams.get('token');
+
+    if (!token) {
+        document.body.innerHTML = '<h1>无效的上传链接</h1>';
+        return;
+    }
+
+    let maxFileSize = null;
+
+    function showToast(message, type = 'success') {
+        const toast = document.createElement('div');
+        toast.className = `toast ${type}`;
+        toast.textContent = message;
+        toastContainer.appendChild(toast);
+
+        setTimeout(() => {
+            toast.remove();
+        }, 3000); // Toast disappears after 3 seconds
+    }
+
+    // Revoked, expired and full links are answered with 410 Gone.
+    async function goneMessage(response) {
+        const text = (await response.text()).trim();
+        if (text.includes('revoked')) return '此上传链接已被撤销';
+        return text.includes('file limit') ? '此上传链接已收满文件' : '此上传链接已过期';
+    }
+
+    async function fetchRequestInfo() {
+        try {
+            const response = await fetch(`/api/upload-request/info?token=${token}`);
+            if (response.status === 410) {
+                throw new Error(await goneMessage(response));
+            }
+            if (!response.ok) {
+                throw new Error('上传链接不存在或已失效');
+            }
+            const info = await response.json();
+            requestLabel.textContent = info.label;
+            passwordGroup.classList.toggle('hidden', !info.password_required);
+            maxFileSize = info.max_file_size;
+
+            const limits = [];
+            if (info.expires_at) {
+                limits.push(`有效期至 ${new Date(info.expires_at).toLocaleString()}`);
+            }
+            if (info.max_file_size !== null) {
+                limits.push(`单个文件不超过 ${(info.max_file_size / 1024 / 1024).toFixed(2)} MB`);
+            }
+            if (info.remaining_files !== null) {
+                limits.push(`还可上传 ${info.remaining_files} 个文件`);
+            }
+            requestLimits.textContent = limits.join('，');
+        } catch (error) {
+            document.body.innerHTML = `<h1>${error.message}</h1>`;
+        }
+    }
+
+    async function uploadOne(file) {
+        if (maxFileSize !== null && file.size > maxFileSize) {
+            throw new Error('文件太大');
+        }
+        const formData = new FormData();
+        formData.append('file', file);
+
+        // Headers only carry Latin-1, so the password is URL-encoded.
+        const response = await fetch(`/api/upload-request/upload?token=${token}`, {
+            method: 'POST',
+            headers: { 'X-Upload-Password': encodeURIComponent(uploadPasswordInput.value) },
+            body: formData
+        });
+        if (response.status === 410) {
+            throw new Error(await goneMessage(response));
+        }
+        if (response.status === 429) {
+            throw new Error(`尝试次数过多，请 ${response.headers.get('Retry-After')} 秒后再试`);
+        }
+        if (!response.ok) {
+            const errorText = (await response.text()).trim();
+            if (errorText === 'Invalid password') throw new Error('密码无效');
+            if (response.status === 413) throw new Error('文件太大');
+            throw new Error(errorText || '上传失败');
+        }
+    }
+
+    uploadBtn.addEventListener('click', async () => {
+        const files = [...fileInput.files];
+        if (files.length === 0) {
+            showToast('请选择文件。', 'error');
+            return;
+        }
+
+        uploadBtn.disabled = true;
+        for (const file of files) {
+            uploadBtn.textContent = `正在上传 ${file.name}...`;
+            const row = document.createElement('div');
+            row.className = 'share-row';
+            try {
+                await uploadOne(file);
+                row.textContent = `✓ ${file.name}`;
+            } catch (error) {
+                row.className = 'share-row inactive';
+                row.textContent = `✗ ${file.name}: ${error.message}`;
+            }
+            uploadedList.appendChild(row);
+        }
+        uploadBtn.textContent = '上传';
+        uploadBtn.disabled = false;
+        fileInput.value = '';
+        showToast('上传完成。');
+        fetchRequestInfo();
+    });
+
+    fetchRequestInfo();
+});
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+const (
+	thumbnailDir = "./thumbnails"
+	// Images larger than this are not decoded for thumbnails.
+	maxThumbnailSourceSize = 64 * 1024 * 1024 // 64 MB
+	// Guards against decompression bombs hiding in small files.
+	maxThumbnailSourcePixels = 50 * 1000 * 1000
+)
+
+// thumbnailSizes maps the size names accepted by the thumbnail endpoint to the
+// bounding box of the generated image.
+var thumbnailSizes = map[string]int{
+	"small":  128,
+	"medium": 256,
+	"large":  512,
+}
+
+// thumbnailService generates thumbnails for image files and caches them on
+// local disk. Generation downloads the file once and writes every size.
+type thumbnailService struct {
+	dir    string
+	client *http.Client
+
+	mu      sync.Mutex
+	pending map[int64]*sync.Mutex
+}
+
+// Global thumbnail service
+var thumbnails = &thumbnailService{
+	dir:     thumbnailDir,
+	client:  &http.Client{},
+	pending: make(map[int64]*sync.Mutex),
+}
+
+// thumbnailTypes lists the content types with a registered image decoder.
+// Other images would be downloaded on every request only to fail decoding.
+var thumbnailTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+	"image/webp": true,
+	"image/bmp":  true,
+}
+
+// supportsThumbnail reports whether a thumbnail can be generated for a file
+// with the given content type and size.
+func supportsThumbnail(contentType string, filesize int64) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && thumbnailTypes[mediaType] && filesize > 0 && filesize <= maxThumbnailSourceSize
+}
+
+// path returns the cache location of a thumbnail. Extensions are not part of
+// the name, the content type is sniffed when serving.
+func (s *thumbnailService) path(fileID int64, size string) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%d_%s", fileID, size))
+}
+
+// lock serializes generation for a single file so concurrent requests for a
+// missing thumbnail download the source only once.
+func (s *thumbnailService) lock(fileID int64) func() {
+	s.mu.Lock()
+	m, ok := s.pending[fileID]
+	if !ok {
+		m = &sync.Mutex{}
+		s.pending[fileID] = m
+	}
+	s.mu.Unlock()
+
+	m.Lock()
+	return func() {
+		m.Unlock()
+		s.mu.Lock()
+		delete(s.pending, fileID)
+		s.mu.Unlock()
+	}
+}
+
+// Get returns the thumbnail of a file at the given size, generating and
+// caching all sizes on first use.
+func (s *thumbnailService) Get(db *sql.DB, fileID int64, size string) ([]byte, error) {
+	if data, err := os.ReadFile(s.path(fileID, size)); err == nil {
+		return data, nil
+	}
+
+	unlock := s.lock(fileID)
+	defer unlock()
+
+	// Another request may have generated it while we were waiting.
+	if data, err := os.ReadFile(s.path(fileID, size)); err == nil {
+		return data, nil
+	}
+
+	if err := s.generate(db, fileID); err != nil {
+		return nil, err
+	}
+	return os.ReadFile(s.path(fileID, size))
+}
+
+// generate downloads and decodes an image file and writes its thumbnails.
+func (s *thumbnailService) generate(db *sql.DB, fileID int64) error {
+	buf := new(bytes.Buffer)
+	if _, err := writeFileChunks(buf, s.client, db, fileID); err != nil {
+		return err
+	}
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		return fmt.Errorf("failed to read image header: %w", err)
+	}
+	if cfg.Width*cfg.Height > maxThumbnailSourcePixels {
+		return fmt.Errorf("image is too large for a thumbnail: %dx%d", cfg.Width, cfg.Height)
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		return fmt.Errorf("failed to decode image: %w", err)
+	}
+
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return err
+	}
+
+	for name, size := range thumbnailSizes {
+		thumb := resizeToFit(src, size, size).(*image.NRGBA)
+
+		// Keep transparency where there is any, otherwise JPEG is much smaller.
+		out := new(bytes.Buffer)
+		if thumb.Opaque() {
+			err = jpeg.Encode(out, thumb, &jpeg.Options{Quality: 85})
+		} else {
+			err = png.Encode(out, thumb)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to encode %s thumbnail: %w", name, err)
+		}
+
+		if err := os.WriteFile(s.path(fileID, name), out.Bytes(), 0644); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Generated thumbnails for file ID %d", fileID)
+	return nil
+}
+
+// Remove deletes the cached thumbnails of a file.
+func (s *thumbnailService) Remove(fileID int64) {
+	for name := range thumbnailSizes {
+		if err := os.Remove(s.path(fileID, name)); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to remove %s thumbnail for file ID %d: %v", name, fileID, err)
+		}
+	}
+}
+
+func thumbnailHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fileIDStr := r.PathValue("id")
+		fileID, err := strconv.ParseInt(fileIDStr, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid file ID", http.StatusBadRequest)
+			return
+		}
+
+		size := r.URL.Query().Get("size")
+		if size == "" {
+			size = "small"
+		}
+		if _, ok := thumbnailSizes[size]; !ok {
+			http.Error(w, "Invalid thumbnail size", http.StatusBadRequest)
+			return
+		}
+
+		var contentType string
+		var filesize int64
+		err = db.QueryRow("SELECT content_type, filesize FROM files WHERE id = ?", fileID).Scan(&contentType, &filesize)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "File not found", http.StatusNotFound)
+			} else {
+				log.Printf("Error: Failed to query file ID %d: %v", fileID, err)
+				http.Error(w, "Failed to query file", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		if !supportsThumbnail(contentType, filesize) {
+			http.Error(w, "No thumbnail available for this file", http.StatusNotFound)
+			return
+		}
+
+		data, err := thumbnails.Get(db, fileID, size)
+		if err != nil {
+			log.Printf("Error: Failed to get thumbnail for file ID %d: %v", fileID, err)
+			http.Error(w, "Failed to generate thumbnail", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", http.DetectContentType(data))
+		w.Header().Set("Cache-Control", "private, max-age=86400")
+		w.Write(data)
+	}
+}
@@ -0,0 +1,286 @@
+// Command mockoidc is a minimal OpenID Connect provider for trying out single
+// sign-on locally. It signs in anyone with the email address they type in, so
+// never expose it to a network.
+//
+//	go run ./tools/mockoidc -addr 127.0.0.1:9096 -client-id fileinpic
+//
+// and start fileinpic with OIDC_ISSUER=http://127.0.0.1:9096 and
+// OIDC_CLIENT_ID=fileinpic.
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const keyID = "mockoidc"
+
+// authRequest is an authorization code waiting to be exchanged.
+type authRequest struct {
+	clientID      string
+	redirectURI   string
+	codeChallenge string
+	nonce         string
+	email         string
+	emailVerified bool
+	createdAt     time.Time
+}
+
+type provider struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	email        string
+	key          *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]*authRequest
+}
+
+var authorizePage = template.Must(template.New("authorize").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Mock OIDC login</title></head>
+<body>
+<h1>Mock OIDC login</h1>
+<form method="post">
+{{range $name, $values := .Query}}<input type="hidden" name="{{$name}}" value="{{index $values 0}}">
+{{end}}<label>Email <input type="email" name="email" value="{{.Email}}"></label>
+<label><input type="checkbox" name="email_verified" value="true" checked> Verified</label>
+<button>Sign in</button>
+</form>
+</body>
+</html>
+`))
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:9096", "address to listen on")
+	issuer := flag.String("issuer", "", "issuer URL (default http://<addr>)")
+	clientID := flag.String("client-id", "fileinpic", "accepted client ID")
+	clientSecret := flag.String("client-secret", "", "required client secret, if any")
+	email := flag.String("email", "alice@example.com", "email address filled in on the login form")
+	flag.Parse()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		log.Fatalf("Failed to generate signing key: %v", err)
+	}
+	p := &provider{
+		issuer:       *issuer,
+		clientID:     *clientID,
+		clientSecret: *clientSecret,
+		email:        *email,
+		key:          key,
+		codes:        make(map[string]*authRequest),
+	}
+	if p.issuer == "" {
+		p.issuer = "http://" + *addr
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", p.discovery)
+	mux.HandleFunc("GET /jwks", p.jwks)
+	mux.HandleFunc("GET /authorize", p.authorizeForm)
+	mux.HandleFunc("POST /authorize", p.authorize)
+	mux.HandleFunc("POST /token", p.token)
+
+	log.Printf("Mock OIDC provider %s listening on %s", p.issuer, *addr)
+	log.Fatal(http.ListenAndServe(*addr, mux))
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// tokenError writes an OAuth 2.0 error response.
+func tokenError(w http.ResponseWriter, code, description string) {
+	writeJSON(w, http.StatusBadRequest, map[string]string{"error": code, "error_description": description})
+}
+
+func (p *provider) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                p.issuer,
+		"authorization_endpoint":                p.issuer + "/authorize",
+		"token_endpoint":                        p.issuer + "/token",
+		"jwks_uri":                              p.issuer + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"scopes_supported":                      []string{"openid", "email", "profile"},
+	})
+}
+
+func (p *provider) jwks(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"use": "sig",
+			"alg": "RS256",
+			"kid": keyID,
+			"n":   base64.RawURLEncoding.EncodeToString(p.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(p.key.E)).Bytes()),
+		}},
+	})
+}
+
+// checkAuthRequest validates the parameters of an authorization request.
+func (p *provider) checkAuthRequest(params url.Values) error {
+	if params.Get("response_type") != "code" {
+		return fmt.Errorf("unsupported response_type %q", params.Get("response_type"))
+	}
+	if params.Get("client_id") != p.clientID {
+		return fmt.Errorf("unknown client_id %q", params.Get("client_id"))
+	}
+	if _, err := url.Parse(params.Get("redirect_uri")); err != nil || params.Get("redirect_uri") == "" {
+		return fmt.Errorf("invalid redirect_uri")
+	}
+	if params.Get("code_challenge") == "" || params.Get("code_challenge_method") != "S256" {
+		return fmt.Errorf("PKCE with S256 is required")
+	}
+	return nil
+}
+
+func (p *provider) authorizeForm(w http.ResponseWriter, r *http.Request) {
+	if err := p.checkAuthRequest(r.URL.Query()); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	authorizePage.Execute(w, map[string]interface{}{"Query": r.URL.Query(), "Email": p.email})
+}
+
+// authorize signs in the email address from the form and redirects back to
+// the client with an authorization code.
+func (p *provider) authorize(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form", http.StatusBadRequest)
+		return
+	}
+	if err := p.checkAuthRequest(r.PostForm); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	email := r.PostForm.Get("email")
+	if email == "" {
+		http.Error(w, "Email is required", http.StatusBadRequest)
+		return
+	}
+
+	bytes := make([]byte, 16)
+	rand.Read(bytes)
+	code := hex.EncodeToString(bytes)
+	p.mu.Lock()
+	p.codes[code] = &authRequest{
+		clientID:      r.PostForm.Get("client_id"),
+		redirectURI:   r.PostForm.Get("redirect_uri"),
+		codeChallenge: r.PostForm.Get("code_challenge"),
+		nonce:         r.PostForm.Get("nonce"),
+		email:         email,
+		emailVerified: r.PostForm.Get("email_verified") == "true",
+		createdAt:     time.Now(),
+	}
+	p.mu.Unlock()
+
+	redirect, _ := url.Parse(r.PostForm.Get("redirect_uri"))
+	query := redirect.Query()
+	query.Set("code", code)
+	query.Set("state", r.PostForm.Get("state"))
+	redirect.RawQuery = query.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+// token exchanges an authorization code, checking the PKCE verifier, for an
+// ID token.
+func (p *provider) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		tokenError(w, "invalid_request", "invalid form")
+		return
+	}
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientID, clientSecret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	if clientID != p.clientID || (p.clientSecret != "" && clientSecret != p.clientSecret) {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		tokenError(w, "unsupported_grant_type", "only authorization_code is supported")
+		return
+	}
+
+	p.mu.Lock()
+	req, ok := p.codes[r.PostForm.Get("code")]
+	delete(p.codes, r.PostForm.Get("code"))
+	p.mu.Unlock()
+	if !ok || time.Since(req.createdAt) > time.Minute || req.clientID != clientID ||
+		req.redirectURI != r.PostForm.Get("redirect_uri") {
+		tokenError(w, "invalid_grant", "unknown or expired code")
+		return
+	}
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(sum[:]) != req.codeChallenge {
+		tokenError(w, "invalid_grant", "code_verifier does not match code_challenge")
+		return
+	}
+
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss":            p.issuer,
+		"sub":            "mock|" + req.email,
+		"aud":            clientID,
+		"iat":            now.Unix(),
+		"exp":            now.Add(5 * time.Minute).Unix(),
+		"email":          req.email,
+		"email_verified": req.emailVerified,
+	}
+	if req.nonce != "" {
+		claims["nonce"] = req.nonce
+	}
+	idToken, err := p.sign(claims)
+	if err != nil {
+		log.Printf("Failed to sign ID token: %v", err)
+		http.Error(w, "Failed to sign ID token", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Issued ID token for %s", req.email)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": hex.EncodeToString(sum[:16]),
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     idToken,
+	})
+}
+
+// sign returns claims as an RS256 signed JWT.
+func (p *provider) sign(claims map[string]interface{}) (string, error) {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": keyID})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	sum := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
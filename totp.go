@@ -0,0 +1,444 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/skip2/go-qrcode"
+)
+
+// TOTP parameters (RFC 6238). These are the defaults every authenticator app
+// supports.
+const (
+	totpIssuer = "FileInPic"
+	totpDigits = 6
+	totpPeriod = 30 // seconds
+	// totpSkew is how many periods either side of now are accepted, for
+	// clocks that are slightly off.
+	totpSkew = 1
+
+	recoveryCodeCount = 10
+)
+
+var (
+	errTOTPRequired = errors.New("two-factor code required")
+	errTOTPInvalid  = errors.New("invalid two-factor code")
+)
+
+// base32NoPadding is the encoding of TOTP secrets in provisioning URIs.
+var base32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// generateTOTPSecret returns a new random secret, base32 encoded.
+func generateTOTPSecret() (string, error) {
+	bytes := make([]byte, 20)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return base32NoPadding.EncodeToString(bytes), nil
+}
+
+// totpCode returns the code of a secret for a time step (RFC 4226).
+func totpCode(key []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// verifyTOTP checks a code against a secret and returns the time step it
+// belongs to. Steps up to lastStep are rejected, so a code cannot be used
+// twice.
+func verifyTOTP(secret, code string, lastStep int64) (int64, bool) {
+	key, err := base32NoPadding.DecodeString(secret)
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	now := time.Now().Unix() / totpPeriod
+	for step := now - totpSkew; step <= now+totpSkew; step++ {
+		if step > lastStep && hmac.Equal([]byte(totpCode(key, step)), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// totpURI returns the otpauth:// provisioning URI authenticator apps read
+// from the QR code.
+func totpURI(secret, username string) string {
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", totpIssuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", strconv.Itoa(totpDigits))
+	params.Set("period", strconv.Itoa(totpPeriod))
+	label := url.PathEscape(totpIssuer + ":" + username)
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// generateRecoveryCodes returns a new set of one-time recovery codes, in the
+// form xxxxx-xxxxx.
+func generateRecoveryCodes() ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		bytes := make([]byte, 7)
+		if _, err := rand.Read(bytes); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(base32NoPadding.EncodeToString(bytes))[:10]
+		codes[i] = code[:5] + "-" + code[5:]
+	}
+	return codes, nil
+}
+
+// normalizeRecoveryCode strips what users tend to add when typing a recovery
+// code back in.
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
+// replaceRecoveryCodes stores new recovery codes for a user, invalidating the
+// old ones, and returns them.
+func replaceRecoveryCodes(tx *sql.Tx, userID int64) ([]string, error) {
+	codes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userID); err != nil {
+		return nil, err
+	}
+	for _, code := range codes {
+		if _, err := tx.Exec("INSERT INTO recovery_codes (user_id, code_hash) VALUES (?, ?)",
+			userID, hashToken(normalizeRecoveryCode(code))); err != nil {
+			return nil, err
+		}
+	}
+	return codes, nil
+}
+
+// checkSecondFactor checks the TOTP code or unused recovery code given by a
+// user with two-factor authentication enabled, and uses it up.
+func checkSecondFactor(db *sql.DB, userID int64, code string) error {
+	code = strings.TrimSpace(code)
+	if code == "" {
+		return errTOTPRequired
+	}
+
+	if len(code) == totpDigits {
+		var secret string
+		var lastStep int64
+		err := db.QueryRow("SELECT totp_secret, totp_last_step FROM users WHERE id = ? AND totp_secret IS NOT NULL", userID).
+			Scan(&secret, &lastStep)
+		if err == sql.ErrNoRows {
+			return errTOTPInvalid
+		}
+		if err != nil {
+			return err
+		}
+		step, ok := verifyTOTP(secret, code, lastStep)
+		if !ok {
+			return errTOTPInvalid
+		}
+		// Only one of two requests racing with the same code gets to move
+		// the last step forward.
+		res, err := db.Exec("UPDATE users SET totp_last_step = ? WHERE id = ? AND totp_last_step < ?", step, userID, step)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return errTOTPInvalid
+		}
+		return nil
+	}
+
+	res, err := db.Exec("UPDATE recovery_codes SET used_at = ? WHERE user_id = ? AND code_hash = ? AND used_at IS NULL",
+		time.Now().UTC(), userID, hashToken(normalizeRecoveryCode(code)))
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errTOTPInvalid
+	}
+	log.Printf("User %d used a recovery code", userID)
+	return nil
+}
+
+// writeSecondFactorError reports a failed checkSecondFactor.
+func writeSecondFactorError(w http.ResponseWriter, err error) {
+	switch err {
+	case errTOTPRequired:
+		http.Error(w, "Two-factor code required", http.StatusUnauthorized)
+	case errTOTPInvalid:
+		http.Error(w, "Invalid two-factor code", http.StatusUnauthorized)
+	default:
+		log.Printf("Failed to check two-factor code: %v", err)
+		http.Error(w, "Failed to check two-factor code", http.StatusInternalServerError)
+	}
+}
+
+// totpSetupHandler starts two-factor enrolment for the logged in user. The
+// new secret only takes effect once a code from it is confirmed with
+// totpEnableHandler.
+func totpSetupHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := currentUser(r)
+		if user.TOTPEnabled {
+			http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+			return
+		}
+
+		secret, err := generateTOTPSecret()
+		if err != nil {
+			log.Printf("Failed to generate TOTP secret: %v", err)
+			http.Error(w, "Failed to set up two-factor authentication", http.StatusInternalServerError)
+			return
+		}
+		if _, err := db.Exec("UPDATE users SET totp_pending_secret = ? WHERE id = ?", secret, user.ID); err != nil {
+			log.Printf("Failed to store TOTP secret of user %d: %v", user.ID, err)
+			http.Error(w, "Failed to set up two-factor authentication", http.StatusInternalServerError)
+			return
+		}
+
+		uri := totpURI(secret, user.Username)
+		png, err := qrcode.Encode(uri, qrcode.Medium, 256)
+		if err != nil {
+			log.Printf("Failed to render TOTP QR code: %v", err)
+			http.Error(w, "Failed to set up two-factor authentication", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"secret":  secret,
+			"uri":     uri,
+			"qr_code": "data:image/png;base64," + base64.StdEncoding.EncodeToString(png),
+		})
+	}
+}
+
+// totpEnableHandler turns on two-factor authentication for the logged in
+// user once they confirm a code from the secret of totpSetupHandler. The
+// response holds the recovery codes, which are not shown again.
+func totpEnableHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Code string `json:"code"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		user := currentUser(r)
+		var secret sql.NullString
+		if err := db.QueryRow("SELECT totp_pending_secret FROM users WHERE id = ?", user.ID).Scan(&secret); err != nil {
+			log.Printf("Failed to query TOTP secret of user %d: %v", user.ID, err)
+			http.Error(w, "Failed to enable two-factor authentication", http.StatusInternalServerError)
+			return
+		}
+		if !secret.Valid {
+			http.Error(w, "Two-factor authentication has not been set up", http.StatusConflict)
+			return
+		}
+		step, ok := verifyTOTP(secret.String, strings.TrimSpace(req.Code), 0)
+		if !ok {
+			writeSecondFactorError(w, errTOTPInvalid)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Failed to start transaction: %v", err)
+			http.Error(w, "Failed to enable two-factor authentication", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+		_, err = tx.Exec(`UPDATE users SET totp_secret = totp_pending_secret, totp_pending_secret = NULL, totp_last_step = ?
+			WHERE id = ?`, step, user.ID)
+		var codes []string
+		if err == nil {
+			codes, err = replaceRecoveryCodes(tx, user.ID)
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			log.Printf("Failed to enable TOTP for user %d: %v", user.ID, err)
+			http.Error(w, "Failed to enable two-factor authentication", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("User %q enabled two-factor authentication", user.Username)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "recovery_codes": codes})
+	}
+}
+
+// totpDisableHandler turns off two-factor authentication for the logged in
+// user, who has to give their password and a current code. Users without a
+// password, who log in with single sign-on, only give the code.
+func totpDisableHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Password string `json:"password"`
+			Code     string `json:"code"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		user := currentUser(r)
+		if !user.TOTPEnabled {
+			http.Error(w, "Two-factor authentication is not enabled", http.StatusConflict)
+			return
+		}
+		attempt, ok := beginLoginAttempt(w, r, user.Username)
+		if !ok {
+			return
+		}
+		if user.HasPassword {
+			if _, ok := authenticateUser(db, user.Username, req.Password); !ok {
+				attempt.fail("current password")
+				http.Error(w, "Invalid current password", http.StatusUnauthorized)
+				return
+			}
+		}
+		if err := checkSecondFactor(db, user.ID, req.Code); err != nil {
+			finishSecondFactorAttempt(attempt, err)
+			writeSecondFactorError(w, err)
+			return
+		}
+		attempt.succeed()
+
+		if err := disableTOTP(db, user.ID); err != nil {
+			log.Printf("Failed to disable TOTP for user %d: %v", user.ID, err)
+			http.Error(w, "Failed to disable two-factor authentication", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("User %q disabled two-factor authentication", user.Username)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "message": "Two-factor authentication disabled."})
+	}
+}
+
+// recoveryCodesHandler replaces the recovery codes of the logged in user,
+// who has to give a current code.
+func recoveryCodesHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Code string `json:"code"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		user := currentUser(r)
+		if !user.TOTPEnabled {
+			http.Error(w, "Two-factor authentication is not enabled", http.StatusConflict)
+			return
+		}
+		attempt, ok := beginLoginAttempt(w, r, user.Username)
+		if !ok {
+			return
+		}
+		if err := checkSecondFactor(db, user.ID, req.Code); err != nil {
+			finishSecondFactorAttempt(attempt, err)
+			writeSecondFactorError(w, err)
+			return
+		}
+		attempt.succeed()
+
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Failed to start transaction: %v", err)
+			http.Error(w, "Failed to create recovery codes", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+		codes, err := replaceRecoveryCodes(tx, user.ID)
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			log.Printf("Failed to replace recovery codes of user %d: %v", user.ID, err)
+			http.Error(w, "Failed to create recovery codes", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("User %q created new recovery codes", user.Username)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "recovery_codes": codes})
+	}
+}
+
+// resetTOTPHandler turns off two-factor authentication for a user who lost
+// their authenticator and recovery codes.
+func resetTOTPHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid user ID", http.StatusBadRequest)
+			return
+		}
+		user, err := lookupUser(db, id)
+		if err == errUserNotFound {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to query user %d: %v", id, err)
+			http.Error(w, "Failed to query user", http.StatusInternalServerError)
+			return
+		}
+
+		if err := disableTOTP(db, id); err != nil {
+			log.Printf("Failed to disable TOTP for user %d: %v", id, err)
+			http.Error(w, "Failed to reset two-factor authentication", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Reset two-factor authentication of user %q", user.Username)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "message": "Two-factor authentication reset."})
+	}
+}
+
+// disableTOTP removes the TOTP secret and recovery codes of a user.
+func disableTOTP(db *sql.DB, userID int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, query := range []string{
+		"UPDATE users SET totp_secret = NULL, totp_pending_secret = NULL, totp_last_step = 0 WHERE id = ?",
+		"DELETE FROM recovery_codes WHERE user_id = ?",
+	} {
+		if _, err := tx.Exec(query, userID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
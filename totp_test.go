@@ -0,0 +1,209 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 appendix B, SHA-1, truncated to six digits.
+	key := []byte("12345678901234567890")
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, tt := range tests {
+		if got := totpCode(key, tt.unix/totpPeriod); got != tt.want {
+			t.Errorf("totpCode at %d = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+// withStableStep runs f with the current time step, again if the step
+// changed while f ran, so tests are not thrown off by a period boundary.
+func withStableStep(t *testing.T, f func(now int64) error) {
+	t.Helper()
+	var err error
+	for i := 0; i < 3; i++ {
+		now := time.Now().Unix() / totpPeriod
+		err = f(now)
+		if time.Now().Unix()/totpPeriod == now {
+			break
+		}
+	}
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestVerifyTOTPWindow(t *testing.T) {
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := base32NoPadding.DecodeString(secret)
+
+	tests := []struct {
+		name   string
+		offset int64 // steps from now the code is for
+		last   int64 // last used step, relative to now
+		want   bool
+	}{
+		{"current", 0, -10, true},
+		{"previous step", -1, -10, true},
+		{"next step", 1, -10, true},
+		{"too old", -totpSkew - 1, -10, false},
+		{"too new", totpSkew + 1, -10, false},
+		{"replayed", 0, 0, false},
+		{"older than the last used step", -1, 0, false},
+		{"newer than the last used step", 1, 0, true},
+	}
+	for _, tt := range tests {
+		withStableStep(t, func(now int64) error {
+			step, ok := verifyTOTP(secret, totpCode(key, now+tt.offset), now+tt.last)
+			if ok != tt.want {
+				return fmt.Errorf("%s: verifyTOTP = %v, want %v", tt.name, ok, tt.want)
+			}
+			if ok && step != now+tt.offset {
+				return fmt.Errorf("%s: step %d, want %d", tt.name, step, now+tt.offset)
+			}
+			return nil
+		})
+	}
+
+	for _, code := range []string{"", "12345", "1234567", "abcdef"} {
+		if _, ok := verifyTOTP(secret, code, 0); ok {
+			t.Errorf("verifyTOTP accepted %q", code)
+		}
+	}
+	if _, ok := verifyTOTP("not base32!", "123456", 0); ok {
+		t.Error("verifyTOTP accepted a code for a broken secret")
+	}
+}
+
+func TestNormalizeRecoveryCode(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"abcde-fghij", "abcdefghij"},
+		{"ABCDE-FGHIJ", "abcdefghij"},
+		{"  abcde fghij ", "abcdefghij"},
+		{"abcdefghij", "abcdefghij"},
+	}
+	for _, tt := range tests {
+		if got := normalizeRecoveryCode(tt.in); got != tt.want {
+			t.Errorf("normalizeRecoveryCode(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+// newTOTPUser creates a user with two-factor authentication and returns its
+// ID, secret and recovery codes.
+func newTOTPUser(t *testing.T, db *sql.DB) (int64, string, []string) {
+	t.Helper()
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := db.Exec("INSERT INTO users (username, password, role, totp_secret) VALUES ('totp', '', ?, ?)", roleMember, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userID, _ := res.LastInsertId()
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	codes, err := replaceRecoveryCodes(tx, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	return userID, secret, codes
+}
+
+func TestCheckSecondFactor(t *testing.T) {
+	db := newTestDB(t)
+	userID, secret, codes := newTOTPUser(t, db)
+	key, _ := base32NoPadding.DecodeString(secret)
+
+	if err := checkSecondFactor(db, userID, " "); err != errTOTPRequired {
+		t.Errorf("empty code: %v, want errTOTPRequired", err)
+	}
+
+	withStableStep(t, func(now int64) error {
+		db.Exec("UPDATE users SET totp_last_step = 0 WHERE id = ?", userID)
+		code := totpCode(key, now)
+		if err := checkSecondFactor(db, userID, code); err != nil {
+			return fmt.Errorf("current code: %v", err)
+		}
+		if err := checkSecondFactor(db, userID, code); err != errTOTPInvalid {
+			return fmt.Errorf("replayed code: %v, want errTOTPInvalid", err)
+		}
+		if err := checkSecondFactor(db, userID, totpCode(key, now-1)); err != errTOTPInvalid {
+			return fmt.Errorf("code older than the last one: %v, want errTOTPInvalid", err)
+		}
+		return nil
+	})
+
+	tests := []struct {
+		name string
+		code string
+		want error
+	}{
+		{"recovery code", codes[0], nil},
+		{"used recovery code", codes[0], errTOTPInvalid},
+		{"recovery code typed differently", strings.ToUpper(strings.Replace(codes[1], "-", " ", 1)), nil},
+		{"unknown recovery code", "aaaaa-aaaaa", errTOTPInvalid},
+		{"wrong TOTP code", "000000x", errTOTPInvalid},
+	}
+	for _, tt := range tests {
+		if err := checkSecondFactor(db, userID, tt.code); err != tt.want {
+			t.Errorf("%s: %v, want %v", tt.name, err, tt.want)
+		}
+	}
+
+	// New recovery codes replace the old ones.
+	tx, _ := db.Begin()
+	newCodes, err := replaceRecoveryCodes(tx, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.Commit()
+	if err := checkSecondFactor(db, userID, codes[2]); err != errTOTPInvalid {
+		t.Errorf("replaced recovery code: %v, want errTOTPInvalid", err)
+	}
+	if err := checkSecondFactor(db, userID, newCodes[2]); err != nil {
+		t.Errorf("new recovery code: %v", err)
+	}
+}
+
+func TestGenerateRecoveryCodes(t *testing.T) {
+	codes, err := generateRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != recoveryCodeCount {
+		t.Fatalf("got %d codes, want %d", len(codes), recoveryCodeCount)
+	}
+	seen := make(map[string]bool)
+	for _, code := range codes {
+		if len(code) != 11 || code[5] != '-' {
+			t.Errorf("code %q is not in the form xxxxx-xxxxx", code)
+		}
+		if seen[code] {
+			t.Errorf("code %q repeated", code)
+		}
+		seen[code] = true
+	}
+}
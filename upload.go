@@ -16,6 +16,59 @@ const (
 	chunkSize     = 6 * 1024 * 1024 // 6 MB
 )
 
+// storeFileChunks splits the content read from src into chunks, hides each one
+// behind a carrier PNG on the image host and records the chunks for fileID.
+// The content type and preview flag of the file are set from the first chunk.
+func storeFileChunks(db *sql.DB, src io.Reader, fileID int64, filename string, filesize int64, authToken string) error {
+	numChunks := int(math.Ceil(float64(filesize) / float64(chunkSize)))
+	log.Printf("Splitting into %d chunks", numChunks)
+	chunkBuffer := make([]byte, chunkSize)
+
+	for i := 0; i < numChunks; i++ {
+		// Read a chunk from the file stream
+		bytesRead, err := io.ReadFull(src, chunkBuffer)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return fmt.Errorf("failed to read chunk %d: %w", i+1, err)
+		}
+
+		// This is the actual chunk data for this iteration
+		chunkData := chunkBuffer[:bytesRead]
+
+		// Create carrier PNG (a thumbnail of the image itself when possible)
+		carrierData, isPreview, err := createChunkCarrier(filename, chunkData, i, numChunks)
+		if err != nil {
+			return fmt.Errorf("failed to create carrier PNG: %w", err)
+		}
+
+		// Combine carrier and chunk
+		combinedData := append(carrierData, chunkData...)
+
+		// Upload to external API
+		imagePath, err := uploadCombinedData(combinedData, authToken)
+		if err != nil {
+			return fmt.Errorf("failed to upload chunk %d: %w", i+1, err)
+		}
+		log.Printf("Uploaded chunk %d, image path: %s", i+1, imagePath)
+
+		// Save chunk info to DB
+		_, err = db.Exec("INSERT INTO chunks (file_id, chunk_order, image_path) VALUES (?, ?, ?)",
+			fileID, i, imagePath)
+		if err != nil {
+			return fmt.Errorf("failed to save chunk metadata: %w", err)
+		}
+
+		if i == 0 {
+			contentType := detectContentType(filename, chunkData)
+			_, err = db.Exec("UPDATE files SET content_type = ?, has_preview = ? WHERE id = ?", contentType, isPreview, fileID)
+			if err != nil {
+				log.Printf("Failed to save content type for file ID %d: %v", fileID, err)
+			}
+		}
+	}
+
+	return nil
+}
+
 func uploadHandler(db *sql.DB, config AppConfig) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
@@ -33,11 +86,36 @@ func uploadHandler(db *sql.DB, config AppConfig) http.HandlerFunc {
 		defer file.Close()
 
 		filename := handler.Filename
+		if !validFilename(filename) {
+			http.Error(w, "Invalid filename", http.StatusBadRequest)
+			return
+		}
 		filesize := handler.Size // Use the size from the handler, no need to read the file
 		log.Printf("Received file: %s, size: %d bytes", filename, filesize)
 
+		annotations, err := annotationsFromForm(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		folderID, err := parseFolderParam(r.FormValue("folder_id"))
+		if err != nil {
+			http.Error(w, "Invalid folder ID", http.StatusBadRequest)
+			return
+		}
+		if err := checkFolderExists(db, folderID); err != nil {
+			if err == errFolderNotFound {
+				http.Error(w, "Folder not found", http.StatusBadRequest)
+			} else {
+				http.Error(w, "Failed to query folder", http.StatusInternalServerError)
+			}
+			return
+		}
+
 		// 1. Save file metadata to DB
-		res, err := db.Exec("INSERT INTO files (filename, filesize, source) VALUES (?, ?, ?)", filename, filesize, "web")
+		res, err := db.Exec("INSERT INTO files (filename, filesize, source, folder_id, owner_id) VALUES (?, ?, ?, ?, ?)",
+			filename, filesize, "web", folderID, userID(currentUser(r)))
 		if err != nil {
 			http.Error(w, "Failed to save file metadata", http.StatusInternalServerError)
 			return
@@ -47,51 +125,17 @@ func uploadHandler(db *sql.DB, config AppConfig) http.HandlerFunc {
 			http.Error(w, "Failed to get last insert ID", http.StatusInternalServerError)
 			return
 		}
+		if err := saveFileAnnotations(db, fileID, annotations); err != nil {
+			log.Printf("Failed to save annotations for file ID %d: %v", fileID, err)
+			http.Error(w, "Failed to save file metadata", http.StatusInternalServerError)
+			return
+		}
 
 		// 2. Process file in chunks
-		numChunks := int(math.Ceil(float64(filesize) / float64(chunkSize)))
-		log.Printf("Splitting into %d chunks", numChunks)
-		chunkBuffer := make([]byte, chunkSize)
-
-		for i := 0; i < numChunks; i++ {
-			// Read a chunk from the file stream
-			bytesRead, err := io.ReadFull(file, chunkBuffer)
-			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
-				http.Error(w, "Failed to read file chunk", http.StatusInternalServerError)
-				log.Printf("Chunk read error: %v", err)
-				return
-			}
-
-			// This is the actual chunk data for this iteration
-			chunkData := chunkBuffer[:bytesRead]
-
-			// 3. Create carrier PNG
-			carrierText := fmt.Sprintf("%s - %d/%d", filename, i+1, numChunks)
-			carrierData, err := createCarrierPNG(carrierText)
-			if err != nil {
-				http.Error(w, "Failed to create carrier PNG", http.StatusInternalServerError)
-				return
-			}
-
-			// 4. Combine carrier and chunk
-			combinedData := append(carrierData, chunkData...)
-
-			// 5. Upload to external API
-			imagePath, err := uploadCombinedData(combinedData, config.AuthToken)
-			if err != nil {
-				http.Error(w, "Failed to upload chunk", http.StatusInternalServerError)
-				log.Printf("Upload error: %v", err)
-				return
-			}
-			log.Printf("Uploaded chunk %d, image path: %s", i+1, imagePath)
-
-			// 6. Save chunk info to DB
-			_, err = db.Exec("INSERT INTO chunks (file_id, chunk_order, image_path) VALUES (?, ?, ?)",
-				fileID, i, imagePath)
-			if err != nil {
-				http.Error(w, "Failed to save chunk metadata", http.StatusInternalServerError)
-				return
-			}
+		if err := storeFileChunks(db, file, fileID, filename, filesize, config.AuthToken); err != nil {
+			log.Printf("Upload error for file ID %d: %v", fileID, err)
+			http.Error(w, "Failed to upload file", http.StatusInternalServerError)
+			return
 		}
 
 		w.Header().Set("Content-Type", "application/json")
@@ -106,78 +150,67 @@ func apiUploadHandler(db *sql.DB, config AppConfig) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		contentDisposition := r.Header.Get("Content-Disposition")
 		if contentDisposition == "" {
-			http.Error(w, "Content-Disposition header is required", http.StatusBadRequest)
+			jsonError(w, "Content-Disposition header is required", http.StatusBadRequest)
 			return
 		}
 
 		_, params, err := mime.ParseMediaType(contentDisposition)
 		if err != nil {
-			http.Error(w, "Invalid Content-Disposition header", http.StatusBadRequest)
+			jsonError(w, "Invalid Content-Disposition header", http.StatusBadRequest)
 			return
 		}
 		filename, ok := params["filename"]
 		if !ok {
-			http.Error(w, "Filename not found in Content-Disposition header", http.StatusBadRequest)
+			jsonError(w, "Filename not found in Content-Disposition header", http.StatusBadRequest)
+			return
+		}
+		if !validFilename(filename) {
+			jsonError(w, "Invalid filename", http.StatusBadRequest)
+			return
+		}
+
+		annotations, err := annotationsFromHeaders(r.Header)
+		if err != nil {
+			jsonError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		folderID, err := parseFolderParam(r.Header.Get("X-Folder-ID"))
+		if err != nil {
+			jsonError(w, "Invalid X-Folder-ID header", http.StatusBadRequest)
+			return
+		}
+		if err := checkFolderExists(db, folderID); err != nil {
+			if err == errFolderNotFound {
+				jsonError(w, "Folder not found", http.StatusBadRequest)
+			} else {
+				jsonError(w, "Failed to query folder", http.StatusInternalServerError)
+			}
 			return
 		}
 
 		// 1. Save file metadata to DB
-		res, err := db.Exec("INSERT INTO files (filename, filesize, source) VALUES (?, ?, ?)", filename, r.ContentLength, "api")
+		res, err := db.Exec("INSERT INTO files (filename, filesize, source, folder_id) VALUES (?, ?, ?, ?)", filename, r.ContentLength, "api", folderID)
 		if err != nil {
-			http.Error(w, "Failed to save file metadata", http.StatusInternalServerError)
+			jsonError(w, "Failed to save file metadata", http.StatusInternalServerError)
 			return
 		}
 		fileID, err := res.LastInsertId()
 		if err != nil {
-			http.Error(w, "Failed to get last insert ID", http.StatusInternalServerError)
+			jsonError(w, "Failed to get last insert ID", http.StatusInternalServerError)
+			return
+		}
+		if err := saveFileAnnotations(db, fileID, annotations); err != nil {
+			log.Printf("Failed to save annotations for file ID %d: %v", fileID, err)
+			jsonError(w, "Failed to save file metadata", http.StatusInternalServerError)
 			return
 		}
 
 		// 2. Process file in chunks
-		numChunks := int(math.Ceil(float64(r.ContentLength) / float64(chunkSize)))
-		log.Printf("Splitting into %d chunks", numChunks)
-		chunkBuffer := make([]byte, chunkSize)
-
-		for i := 0; i < numChunks; i++ {
-			// Read a chunk from the file stream
-			bytesRead, err := io.ReadFull(r.Body, chunkBuffer)
-			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
-				http.Error(w, "Failed to read file chunk", http.StatusInternalServerError)
-				log.Printf("Chunk read error: %v", err)
-				return
-			}
-
-			// This is the actual chunk data for this iteration
-			chunkData := chunkBuffer[:bytesRead]
-
-			// 3. Create carrier PNG
-			carrierText := fmt.Sprintf("%s - %d/%d", filename, i+1, numChunks)
-			carrierData, err := createCarrierPNG(carrierText)
-			if err != nil {
-				http.Error(w, "Failed to create carrier PNG", http.StatusInternalServerError)
-				return
-			}
-
-			// 4. Combine carrier and chunk
-			combinedData := append(carrierData, chunkData...)
-
-			// 5. Upload to external API
-			apiKey := r.Header.Get("X-API-KEY")
-			imagePath, err := uploadCombinedData(combinedData, apiKey)
-			if err != nil {
-				http.Error(w, "Failed to upload chunk", http.StatusInternalServerError)
-				log.Printf("Upload error: %v", err)
-				return
-			}
-			log.Printf("Uploaded chunk %d, image path: %s", i+1, imagePath)
-
-			// 6. Save chunk info to DB
-			_, err = db.Exec("INSERT INTO chunks (file_id, chunk_order, image_path) VALUES (?, ?, ?)",
-				fileID, i, imagePath)
-			if err != nil {
-				http.Error(w, "Failed to save chunk metadata", http.StatusInternalServerError)
-				return
-			}
+		if err := storeFileChunks(db, r.Body, fileID, filename, r.ContentLength, imageHostToken(r, &config)); err != nil {
+			log.Printf("Upload error for file ID %d: %v", fileID, err)
+			jsonError(w, "Failed to upload file", http.StatusInternalServerError)
+			return
 		}
 
 		w.Header().Set("Content-Type", "application/json")
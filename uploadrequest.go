@@ -0,0 +1,522 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// uploadRequestColumns is the column list scanUploadRequest expects.
+const uploadRequestColumns = `upload_requests.id, upload_requests.token, upload_requests.folder_id,
+	upload_requests.label, upload_requests.password, upload_requests.created_at, upload_requests.expires_at,
+	upload_requests.max_file_size, upload_requests.max_files, upload_requests.upload_count, upload_requests.revoked_at,
+	upload_requests.created_by`
+
+var (
+	errUploadRequestNotFound = errors.New("upload request not found")
+	errUploadRequestRevoked  = errors.New("this upload link has been revoked")
+	errUploadRequestExpired  = errors.New("this upload link has expired")
+	errUploadRequestFull     = errors.New("this upload link has reached its file limit")
+)
+
+// maxUploadRequestFileSize is the largest file an upload link accepts, also
+// when it sets no max_file_size of its own.
+const maxUploadRequestFileSize = 2 << 30 // 2 GB
+
+// uploadRequestOptions are the settings of a new upload request. A nil
+// limit means the upload request has no such limit.
+type uploadRequestOptions struct {
+	FolderID    *int64     `json:"folder_id"`
+	Label       string     `json:"label"`
+	Password    string     `json:"password"`
+	ExpiresAt   *time.Time `json:"expires_at"`
+	MaxFileSize *int64     `json:"max_file_size"` // bytes
+	MaxFiles    *int64     `json:"max_files"`
+}
+
+func (o uploadRequestOptions) validate() error {
+	if len(o.Label) > maxShareLabelLength {
+		return errors.New("label is too long")
+	}
+	// bcrypt only uses the first 72 bytes of a password.
+	if len(o.Password) > 72 {
+		return errors.New("password is too long")
+	}
+	if o.ExpiresAt != nil && !o.ExpiresAt.After(time.Now()) {
+		return errors.New("expires_at must be in the future")
+	}
+	if o.MaxFileSize != nil && (*o.MaxFileSize < 1 || *o.MaxFileSize > maxUploadRequestFileSize) {
+		return fmt.Errorf("max_file_size must be between 1 and %d", maxUploadRequestFileSize)
+	}
+	if o.MaxFiles != nil && *o.MaxFiles < 1 {
+		return errors.New("max_files must be at least 1")
+	}
+	return nil
+}
+
+// uploadRequest is a row of the upload_requests table: a link that lets
+// anyone holding it upload files into a folder.
+type uploadRequest struct {
+	ID           int64
+	Token        string
+	FolderID     sql.NullInt64
+	Label        string
+	PasswordHash string
+	CreatedAt    time.Time
+	ExpiresAt    sql.NullTime
+	MaxFileSize  sql.NullInt64
+	MaxFiles     sql.NullInt64
+	UploadCount  int64
+	RevokedAt    sql.NullTime
+	CreatedBy    sql.NullInt64
+}
+
+// UploadRequestInfo describes an upload request in API responses.
+type UploadRequestInfo struct {
+	ID                int64      `json:"id"`
+	Token             string     `json:"token"`
+	Link              string     `json:"upload_link"`
+	FolderID          *int64     `json:"folder_id"`
+	Label             string     `json:"label"`
+	PasswordProtected bool       `json:"password_protected"`
+	CreatedAt         time.Time  `json:"created_at"`
+	ExpiresAt         *time.Time `json:"expires_at"`
+	MaxFileSize       *int64     `json:"max_file_size"`
+	MaxFiles          *int64     `json:"max_files"`
+	UploadCount       int64      `json:"upload_count"`
+	RemainingFiles    *int64     `json:"remaining_files"`
+	RevokedAt         *time.Time `json:"revoked_at"`
+	Active            bool       `json:"active"`
+	CreatedBy         *int64     `json:"created_by"`
+}
+
+func scanUploadRequest(row rowScanner) (*uploadRequest, error) {
+	var u uploadRequest
+	err := row.Scan(&u.ID, &u.Token, &u.FolderID, &u.Label, &u.PasswordHash, &u.CreatedAt, &u.ExpiresAt,
+		&u.MaxFileSize, &u.MaxFiles, &u.UploadCount, &u.RevokedAt, &u.CreatedBy)
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// checkPassword reports whether password unlocks the upload request.
+func (u *uploadRequest) checkPassword(password string) bool {
+	if u.PasswordHash == "" {
+		return true
+	}
+	return bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)) == nil
+}
+
+// attemptTarget names the upload request for linkPasswordAttempts.
+func (u *uploadRequest) attemptTarget() string {
+	return fmt.Sprintf("upload request %d", u.ID)
+}
+
+// check reports whether the upload request still accepts files.
+func (u *uploadRequest) check() error {
+	if u.RevokedAt.Valid {
+		return errUploadRequestRevoked
+	}
+	if u.ExpiresAt.Valid && !time.Now().Before(u.ExpiresAt.Time) {
+		return errUploadRequestExpired
+	}
+	if u.MaxFiles.Valid && u.UploadCount >= u.MaxFiles.Int64 {
+		return errUploadRequestFull
+	}
+	return nil
+}
+
+// info returns the API representation of the upload request.
+func (u *uploadRequest) info(config *AppConfig) UploadRequestInfo {
+	info := UploadRequestInfo{
+		ID:                u.ID,
+		Token:             u.Token,
+		Link:              uploadRequestLink(config, u.Token),
+		Label:             u.Label,
+		PasswordProtected: u.PasswordHash != "",
+		CreatedAt:         u.CreatedAt,
+		UploadCount:       u.UploadCount,
+		Active:            u.check() == nil,
+	}
+	if u.FolderID.Valid {
+		info.FolderID = &u.FolderID.Int64
+	}
+	if u.ExpiresAt.Valid {
+		expiresAt := u.ExpiresAt.Time.UTC()
+		info.ExpiresAt = &expiresAt
+	}
+	if u.MaxFileSize.Valid {
+		info.MaxFileSize = &u.MaxFileSize.Int64
+	}
+	if u.MaxFiles.Valid {
+		remaining := max(0, u.MaxFiles.Int64-u.UploadCount)
+		info.MaxFiles, info.RemainingFiles = &u.MaxFiles.Int64, &remaining
+	}
+	if u.RevokedAt.Valid {
+		info.RevokedAt = &u.RevokedAt.Time
+	}
+	if u.CreatedBy.Valid {
+		info.CreatedBy = &u.CreatedBy.Int64
+	}
+	return info
+}
+
+func uploadRequestLink(config *AppConfig, token string) string {
+	return config.Host + "/upload.html?token=" + token
+}
+
+// lookupUploadRequest finds the upload request with the given token.
+func lookupUploadRequest(db *sql.DB, token string) (*uploadRequest, error) {
+	row := db.QueryRow("SELECT "+uploadRequestColumns+" FROM upload_requests WHERE token = ?", token)
+	u, err := scanUploadRequest(row)
+	if err == sql.ErrNoRows {
+		return nil, errUploadRequestNotFound
+	}
+	return u, err
+}
+
+// writeUploadRequestError reports a failed upload request lookup: 404 for
+// unknown tokens and 410 Gone for links that can no longer be used.
+func writeUploadRequestError(w http.ResponseWriter, err error) {
+	switch err {
+	case errUploadRequestNotFound:
+		http.Error(w, "Upload link not found", http.StatusNotFound)
+	case errUploadRequestRevoked, errUploadRequestExpired, errUploadRequestFull:
+		http.Error(w, err.Error(), http.StatusGone)
+	default:
+		log.Printf("Failed to query upload request: %v", err)
+		http.Error(w, "Failed to query upload link", http.StatusInternalServerError)
+	}
+}
+
+// openUploadRequest looks up the upload request named by the token query
+// parameter and checks that it still accepts files. It writes the error
+// response and returns nil otherwise.
+func openUploadRequest(db *sql.DB, w http.ResponseWriter, r *http.Request) *uploadRequest {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		http.Error(w, "Invalid upload token", http.StatusBadRequest)
+		return nil
+	}
+	u, err := lookupUploadRequest(db, token)
+	if err == nil {
+		err = u.check()
+	}
+	if err != nil {
+		writeUploadRequestError(w, err)
+		return nil
+	}
+	return u
+}
+
+// createUploadRequestHandler creates a new upload request link.
+func createUploadRequestHandler(db *sql.DB, config *AppConfig, fail errorWriter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var opts uploadRequestOptions
+		if err := json.NewDecoder(r.Body).Decode(&opts); err != nil {
+			fail(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if err := opts.validate(); err != nil {
+			fail(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := checkFolderExists(db, opts.FolderID); err != nil {
+			if err == errFolderNotFound {
+				fail(w, "Folder not found", http.StatusNotFound)
+			} else {
+				fail(w, "Failed to query folder", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		token, err := generateShareToken()
+		if err != nil {
+			log.Printf("Failed to generate upload request token: %v", err)
+			fail(w, "Failed to create upload link", http.StatusInternalServerError)
+			return
+		}
+		passwordHash, err := hashSharePassword(opts.Password)
+		if err != nil {
+			log.Printf("Failed to hash upload request password: %v", err)
+			fail(w, "Failed to create upload link", http.StatusInternalServerError)
+			return
+		}
+
+		var expiresAt *time.Time
+		if opts.ExpiresAt != nil {
+			utc := opts.ExpiresAt.UTC()
+			expiresAt = &utc
+		}
+		res, err := db.Exec(`INSERT INTO upload_requests (token, folder_id, label, password, expires_at, max_file_size, max_files, created_by)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			token, opts.FolderID, opts.Label, passwordHash, expiresAt, opts.MaxFileSize, opts.MaxFiles, userID(currentUser(r)))
+		if err != nil {
+			log.Printf("Failed to create upload request: %v", err)
+			fail(w, "Failed to create upload link", http.StatusInternalServerError)
+			return
+		}
+		id, _ := res.LastInsertId()
+		log.Printf("Created upload request %d", id)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"ok":          true,
+			"id":          id,
+			"token":       token,
+			"upload_link": uploadRequestLink(config, token),
+		})
+	}
+}
+
+// listUploadRequestsHandler lists upload requests, newest first, optionally
+// only those of the folder given by folder_id ("root" for the top level).
+func listUploadRequestsHandler(db *sql.DB, config *AppConfig, fail errorWriter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// The list holds live links, so members only see their own.
+		own, args := createdByCondition(currentUser(r), "created_by")
+		query := "SELECT " + uploadRequestColumns + " FROM upload_requests WHERE " + own
+		if folderParam, ok := r.URL.Query()["folder_id"]; ok {
+			folderID, err := parseFolderParam(folderParam[0])
+			if err != nil {
+				fail(w, "Invalid folder ID", http.StatusBadRequest)
+				return
+			}
+			if folderID == nil {
+				query += " AND folder_id IS NULL"
+			} else {
+				query += " AND folder_id = ?"
+				args = append(args, *folderID)
+			}
+		}
+
+		rows, err := db.Query(query+" ORDER BY id DESC", args...)
+		if err != nil {
+			log.Printf("Failed to query upload requests: %v", err)
+			fail(w, "Failed to query upload links", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		infos := []UploadRequestInfo{}
+		for rows.Next() {
+			u, err := scanUploadRequest(rows)
+			if err != nil {
+				log.Printf("Failed to scan upload request row: %v", err)
+				fail(w, "Failed to query upload links", http.StatusInternalServerError)
+				return
+			}
+			infos = append(infos, u.info(config))
+		}
+		if err := rows.Err(); err != nil {
+			log.Printf("Failed to read upload request rows: %v", err)
+			fail(w, "Failed to query upload links", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"upload_requests": infos})
+	}
+}
+
+// revokeUploadRequestHandler stops an upload request link from accepting
+// files. Files already uploaded are kept. Only admins and the user who
+// created the link may revoke it.
+func revokeUploadRequestHandler(db *sql.DB, fail errorWriter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			fail(w, "Invalid upload request ID", http.StatusBadRequest)
+			return
+		}
+
+		var createdBy sql.NullInt64
+		err = db.QueryRow("SELECT created_by FROM upload_requests WHERE id = ?", id).Scan(&createdBy)
+		if err == sql.ErrNoRows {
+			fail(w, "Upload request not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to query upload request %d: %v", id, err)
+			fail(w, "Failed to revoke upload link", http.StatusInternalServerError)
+			return
+		}
+		if !canManageCreated(currentUser(r), createdBy) {
+			fail(w, "You can only revoke upload links you created", http.StatusForbidden)
+			return
+		}
+
+		if _, err := db.Exec("UPDATE upload_requests SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL", time.Now().UTC(), id); err != nil {
+			log.Printf("Failed to revoke upload request %d: %v", id, err)
+			fail(w, "Failed to revoke upload link", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("Revoked upload request %d", id)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "message": "Upload link revoked."})
+	}
+}
+
+// uploadRequestInfoHandler describes an upload request for the public
+// upload page.
+func uploadRequestInfoHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u := openUploadRequest(db, w, r)
+		if u == nil {
+			return
+		}
+
+		info := map[string]interface{}{
+			"label":             u.Label,
+			"password_required": u.PasswordHash != "",
+			"expires_at":        nil,
+			"max_file_size":     nil,
+			"remaining_files":   nil,
+		}
+		if u.ExpiresAt.Valid {
+			info["expires_at"] = u.ExpiresAt.Time.UTC()
+		}
+		if u.MaxFileSize.Valid {
+			info["max_file_size"] = u.MaxFileSize.Int64
+		}
+		if u.MaxFiles.Valid {
+			info["remaining_files"] = u.MaxFiles.Int64 - u.UploadCount
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(info)
+	}
+}
+
+// reserveUploadSlot uses up one file of an upload request. It returns
+// errUploadRequestFull if another upload took the last one first.
+func reserveUploadSlot(db *sql.DB, id int64) error {
+	res, err := db.Exec(`UPDATE upload_requests SET upload_count = upload_count + 1
+		WHERE id = ? AND (max_files IS NULL OR upload_count < max_files)`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errUploadRequestFull
+	}
+	return nil
+}
+
+// uploadRequestUploadHandler receives a file sent through an upload request
+// link by a visitor without an account. The multipart form holds the file;
+// for password protected links the password is sent URL-encoded in the
+// X-Upload-Password header.
+func uploadRequestUploadHandler(db *sql.DB, config AppConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u := openUploadRequest(db, w, r)
+		if u == nil {
+			return
+		}
+		// The password comes in a header, so it is checked before the body
+		// is read and visitors without it cannot make the server spool
+		// uploads to disk.
+		if u.PasswordHash != "" {
+			password, err := url.QueryUnescape(r.Header.Get("X-Upload-Password"))
+			if err != nil || !checkLinkPassword(r, u.checkPassword, password, u.attemptTarget()) {
+				writeLinkPasswordError(w, r, u.attemptTarget())
+				return
+			}
+		}
+		maxFileSize := int64(maxUploadRequestFileSize)
+		if u.MaxFileSize.Valid {
+			maxFileSize = u.MaxFileSize.Int64
+		}
+		// Leave room for the rest of the multipart form.
+		r.Body = http.MaxBytesReader(w, r.Body, maxFileSize+64*1024)
+
+		if err := r.ParseMultipartForm(maxUploadSize); err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				http.Error(w, "File is too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, "Could not parse multipart form", http.StatusBadRequest)
+			return
+		}
+		file, handler, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, "Invalid file", http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+
+		// The name comes from an outsider and ends up in the file list and
+		// in archive paths, so only a plain file name is accepted.
+		filename := path.Base(handler.Filename)
+		filesize := handler.Size
+		if filesize > maxFileSize {
+			http.Error(w, "File is too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if !validFilename(filename) {
+			http.Error(w, "Invalid filename", http.StatusBadRequest)
+			return
+		}
+
+		if err := reserveUploadSlot(db, u.ID); err != nil {
+			writeUploadRequestError(w, err)
+			return
+		}
+		log.Printf("Received file %s, size: %d bytes, via upload request %d", filename, filesize, u.ID)
+
+		var folderID *int64
+		if u.FolderID.Valid {
+			folderID = &u.FolderID.Int64
+		}
+		// Files received through a link belong to whoever created the link.
+		res, err := db.Exec("INSERT INTO files (filename, filesize, source, folder_id, upload_request_id, owner_id) VALUES (?, ?, ?, ?, ?, ?)",
+			filename, filesize, "request", folderID, u.ID, u.CreatedBy)
+		var fileID int64
+		if err == nil {
+			fileID, err = res.LastInsertId()
+		}
+		if err != nil {
+			log.Printf("Failed to save file metadata for upload request %d: %v", u.ID, err)
+			releaseUploadSlot(db, u.ID)
+			http.Error(w, "Failed to save file metadata", http.StatusInternalServerError)
+			return
+		}
+
+		if err := storeFileChunks(db, file, fileID, filename, filesize, config.AuthToken); err != nil {
+			log.Printf("Upload error for file ID %d: %v", fileID, err)
+			// Outsiders cannot clean up after themselves, so a failed upload
+			// is removed and does not count towards the file limit.
+			if err := deleteFile(db, fileID, config.AuthToken); err != nil {
+				log.Printf("Failed to remove incomplete file ID %d: %v", fileID, err)
+			}
+			releaseUploadSlot(db, u.ID)
+			http.Error(w, "Failed to upload file", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"ok":       true,
+			"filename": filename,
+		})
+	}
+}
+
+// releaseUploadSlot gives back a file reserved with reserveUploadSlot.
+func releaseUploadSlot(db *sql.DB, id int64) {
+	if _, err := db.Exec("UPDATE upload_requests SET upload_count = upload_count - 1 WHERE id = ?", id); err != nil {
+		log.Printf("Failed to release upload slot of upload request %d: %v", id, err)
+	}
+}
@@ -0,0 +1,503 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// User roles, from most to least privileged. Admins manage users and every
+// file, members manage the files they uploaded, and read-only users can only
+// browse and download.
+const (
+	roleAdmin    = "admin"
+	roleMember   = "member"
+	roleReadOnly = "readonly"
+)
+
+var roleRank = map[string]int{roleReadOnly: 1, roleMember: 2, roleAdmin: 3}
+
+const maxUsernameLength = 64
+
+var (
+	errUserNotFound = errors.New("user not found")
+	errForbidden    = errors.New("permission denied")
+	errLastAdmin    = errors.New("the last admin cannot be removed or demoted")
+)
+
+// User is an account that can log in to the web UI.
+type User struct {
+	ID          int64     `json:"id"`
+	Username    string    `json:"username"`
+	Role        string    `json:"role"`
+	CreatedAt   time.Time `json:"created_at"`
+	TOTPEnabled bool      `json:"totp_enabled"`
+	// HasPassword is false for users created by single sign-on who have
+	// not been given a password.
+	HasPassword bool `json:"has_password"`
+}
+
+// can reports whether the user has at least the given role.
+func (u *User) can(role string) bool {
+	return roleRank[u.Role] >= roleRank[role]
+}
+
+type userContextKey struct{}
+
+// withUser returns the request with the logged in user attached.
+func withUser(r *http.Request, user *User) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), userContextKey{}, user))
+}
+
+// currentUser returns the user who made a web UI request. It is nil for v1
+// API requests, which are authorised by the API key instead.
+func currentUser(r *http.Request) *User {
+	user, _ := r.Context().Value(userContextKey{}).(*User)
+	return user
+}
+
+const userColumns = "users.id, users.username, users.role, users.created_at, users.totp_secret IS NOT NULL, users.password != ''"
+
+func scanUser(row rowScanner, extra ...interface{}) (*User, error) {
+	var u User
+	if err := row.Scan(append([]interface{}{&u.ID, &u.Username, &u.Role, &u.CreatedAt, &u.TOTPEnabled, &u.HasPassword}, extra...)...); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errUserNotFound
+		}
+		return nil, err
+	}
+	return &u, nil
+}
+
+func lookupUser(db *sql.DB, id int64) (*User, error) {
+	return scanUser(db.QueryRow("SELECT "+userColumns+" FROM users WHERE id = ?", id))
+}
+
+// validUsername reports whether name can be used as a username.
+func validUsername(name string) bool {
+	if name == "" || len(name) > maxUsernameLength {
+		return false
+	}
+	for _, c := range name {
+		if !unicode.IsLetter(c) && !unicode.IsDigit(c) && !strings.ContainsRune("._-@", c) {
+			return false
+		}
+	}
+	return true
+}
+
+func validRole(role string) bool {
+	_, ok := roleRank[role]
+	return ok
+}
+
+func hashUserPassword(password string) (string, error) {
+	if password == "" {
+		return "", errors.New("password is required")
+	}
+	// bcrypt only uses the first 72 bytes of a password.
+	if len(password) > 72 {
+		return "", errors.New("password is too long")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// dummyPasswordHash is compared against when a login names an unknown user,
+// so the response takes as long as for a wrong password.
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("fileinpic"), bcrypt.DefaultCost)
+
+// authenticateUser checks a username and password and returns the user.
+func authenticateUser(db *sql.DB, username, password string) (*User, bool) {
+	var hash string
+	user, err := scanUser(db.QueryRow("SELECT "+userColumns+", password FROM users WHERE username = ?", username), &hash)
+	if err != nil {
+		if err != errUserNotFound {
+			log.Printf("Failed to query user %q: %v", username, err)
+		}
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return nil, false
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return nil, false
+	}
+	return user, true
+}
+
+// ensureAdminUser creates the first admin account, named "admin" with the
+// configured password, when there are no users yet. This keeps the login of
+// installations from before user accounts working.
+func ensureAdminUser(db *sql.DB, password string) {
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM users").Scan(&count); err != nil {
+		log.Fatalf("Failed to count users: %v", err)
+	}
+	if count > 0 {
+		return
+	}
+	hash, err := hashUserPassword(password)
+	if err != nil {
+		log.Fatalf("Failed to hash admin password: %v", err)
+	}
+	if _, err := db.Exec("INSERT INTO users (username, password, role) VALUES (?, ?, ?)", "admin", hash, roleAdmin); err != nil {
+		log.Fatalf("Failed to create admin user: %v", err)
+	}
+	log.Println("Created user \"admin\" with the configured password")
+}
+
+// requireRole rejects web UI requests from users below the given role. v1
+// API requests carry no user and are let through.
+func requireRole(role string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user := currentUser(r); user != nil && !user.can(role) {
+			http.Error(w, "Permission denied", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// checkFileAccess returns nil if the user may change or delete a file:
+// admins and API clients may change any file, members only their own.
+// It returns errFileNotFound if there is no such file.
+func checkFileAccess(db *sql.DB, user *User, fileID int64) error {
+	var ownerID sql.NullInt64
+	err := db.QueryRow("SELECT owner_id FROM files WHERE id = ?", fileID).Scan(&ownerID)
+	if err == sql.ErrNoRows {
+		return errFileNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if user == nil || user.can(roleAdmin) {
+		return nil
+	}
+	if user.can(roleMember) && ownerID.Valid && ownerID.Int64 == user.ID {
+		return nil
+	}
+	return errForbidden
+}
+
+// writeFileAccessError reports a failed checkFileAccess.
+func writeFileAccessError(w http.ResponseWriter, fail errorWriter, err error) {
+	switch err {
+	case errFileNotFound:
+		fail(w, "File not found", http.StatusNotFound)
+	case errForbidden:
+		fail(w, "You can only change files you uploaded", http.StatusForbidden)
+	default:
+		log.Printf("Failed to check file access: %v", err)
+		fail(w, "Failed to query file", http.StatusInternalServerError)
+	}
+}
+
+// canManageCreated reports whether the user may revoke a link created by
+// createdBy: admins and API clients may revoke any link, others their own.
+func canManageCreated(user *User, createdBy sql.NullInt64) bool {
+	return user == nil || user.can(roleAdmin) || (createdBy.Valid && createdBy.Int64 == user.ID)
+}
+
+// createdByCondition returns an SQL condition on column, which holds who
+// created a link, limiting a list to the links the user may manage: admins
+// and API clients see every link, others only their own.
+func createdByCondition(user *User, column string) (string, []interface{}) {
+	if user == nil || user.can(roleAdmin) {
+		return "1 = 1", nil
+	}
+	return column + " = ?", []interface{}{user.ID}
+}
+
+// userID returns the ID stored for something the user created, or nil for
+// API clients.
+func userID(user *User) *int64 {
+	if user == nil {
+		return nil
+	}
+	return &user.ID
+}
+
+// meHandler returns the logged in user.
+func meHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(currentUser(r))
+	}
+}
+
+// listUsersHandler lists every user account.
+func listUsersHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rows, err := db.Query("SELECT " + userColumns + " FROM users ORDER BY username COLLATE NOCASE")
+		if err != nil {
+			log.Printf("Failed to query users: %v", err)
+			http.Error(w, "Failed to query users", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		users := []*User{}
+		for rows.Next() {
+			user, err := scanUser(rows)
+			if err != nil {
+				log.Printf("Failed to scan user row: %v", err)
+				http.Error(w, "Failed to query users", http.StatusInternalServerError)
+				return
+			}
+			users = append(users, user)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"users": users})
+	}
+}
+
+// createUserHandler adds a user account.
+func createUserHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Username string `json:"username"`
+			Password string `json:"password"`
+			Role     string `json:"role"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		req.Username = strings.TrimSpace(req.Username)
+		if !validUsername(req.Username) {
+			http.Error(w, "Invalid username", http.StatusBadRequest)
+			return
+		}
+		if req.Role == "" {
+			req.Role = roleMember
+		}
+		if !validRole(req.Role) {
+			http.Error(w, "Invalid role", http.StatusBadRequest)
+			return
+		}
+		hash, err := hashUserPassword(req.Password)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var taken int
+		if err := db.QueryRow("SELECT COUNT(*) FROM users WHERE username = ?", req.Username).Scan(&taken); err != nil {
+			log.Printf("Failed to query users: %v", err)
+			http.Error(w, "Failed to create user", http.StatusInternalServerError)
+			return
+		}
+		if taken > 0 {
+			http.Error(w, "Username is already taken", http.StatusConflict)
+			return
+		}
+
+		res, err := db.Exec("INSERT INTO users (username, password, role) VALUES (?, ?, ?)", req.Username, hash, req.Role)
+		if err != nil {
+			log.Printf("Failed to create user %q: %v", req.Username, err)
+			http.Error(w, "Failed to create user", http.StatusInternalServerError)
+			return
+		}
+		id, _ := res.LastInsertId()
+		user, err := lookupUser(db, id)
+		if err != nil {
+			log.Printf("Failed to query new user %d: %v", id, err)
+			http.Error(w, "Failed to create user", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Created user %q (%s)", user.Username, user.Role)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(user)
+	}
+}
+
+// otherAdminExists reports whether there is an admin besides userID.
+func otherAdminExists(db *sql.DB, userID int64) (bool, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM users WHERE role = ? AND id != ?", roleAdmin, userID).Scan(&count)
+	return count > 0, err
+}
+
+// updateUserHandler changes the role or password of a user. Admins may
+// change anyone; other users may only change their own password, giving the
+// current one.
+func updateUserHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid user ID", http.StatusBadRequest)
+			return
+		}
+		var req struct {
+			Role            *string `json:"role"`
+			Password        *string `json:"password"`
+			CurrentPassword string  `json:"current_password"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		me := currentUser(r)
+		isAdmin := me == nil || me.can(roleAdmin)
+		if !isAdmin && (me.ID != id || req.Role != nil) {
+			http.Error(w, "Permission denied", http.StatusForbidden)
+			return
+		}
+
+		user, err := lookupUser(db, id)
+		if err == errUserNotFound {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to query user %d: %v", id, err)
+			http.Error(w, "Failed to query user", http.StatusInternalServerError)
+			return
+		}
+
+		if req.Role != nil && *req.Role != user.Role {
+			if !validRole(*req.Role) {
+				http.Error(w, "Invalid role", http.StatusBadRequest)
+				return
+			}
+			if user.Role == roleAdmin {
+				ok, err := otherAdminExists(db, id)
+				if err != nil {
+					log.Printf("Failed to count admins: %v", err)
+					http.Error(w, "Failed to update user", http.StatusInternalServerError)
+					return
+				}
+				if !ok {
+					http.Error(w, errLastAdmin.Error(), http.StatusConflict)
+					return
+				}
+			}
+			if _, err := db.Exec("UPDATE users SET role = ? WHERE id = ?", *req.Role, id); err != nil {
+				log.Printf("Failed to change role of user %d: %v", id, err)
+				http.Error(w, "Failed to update user", http.StatusInternalServerError)
+				return
+			}
+			user.Role = *req.Role
+			log.Printf("Changed role of user %q to %s", user.Username, user.Role)
+		}
+
+		if req.Password != nil {
+			if !isAdmin {
+				attempt, ok := beginLoginAttempt(w, r, user.Username)
+				if !ok {
+					return
+				}
+				if _, ok := authenticateUser(db, user.Username, req.CurrentPassword); !ok {
+					attempt.fail("current password")
+					http.Error(w, "Invalid current password", http.StatusUnauthorized)
+					return
+				}
+				attempt.succeed()
+			}
+			hash, err := hashUserPassword(*req.Password)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if _, err := db.Exec("UPDATE users SET password = ? WHERE id = ?", hash, id); err != nil {
+				log.Printf("Failed to change password of user %d: %v", id, err)
+				http.Error(w, "Failed to update user", http.StatusInternalServerError)
+				return
+			}
+			log.Printf("Changed password of user %q", user.Username)
+
+			// Other logins with the old password end; the user changing
+			// their own password stays logged in here.
+			var keepID int64
+			if s := currentSession(r); s != nil {
+				keepID = s.ID
+			}
+			if err := manager.DeleteOthers(id, keepID); err != nil {
+				log.Printf("Failed to end sessions of user %d: %v", id, err)
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(user)
+	}
+}
+
+// deleteUserHandler removes a user account. Their files stay, without an
+// owner; their sessions and two-factor recovery codes are deleted with the
+// account, which also holds their TOTP secret.
+func deleteUserHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid user ID", http.StatusBadRequest)
+			return
+		}
+
+		user, err := lookupUser(db, id)
+		if err == errUserNotFound {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to query user %d: %v", id, err)
+			http.Error(w, "Failed to query user", http.StatusInternalServerError)
+			return
+		}
+		if user.Role == roleAdmin {
+			ok, err := otherAdminExists(db, id)
+			if err != nil {
+				log.Printf("Failed to count admins: %v", err)
+				http.Error(w, "Failed to delete user", http.StatusInternalServerError)
+				return
+			}
+			if !ok {
+				http.Error(w, errLastAdmin.Error(), http.StatusConflict)
+				return
+			}
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Failed to start transaction: %v", err)
+			http.Error(w, "Failed to delete user", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+		for _, query := range []string{
+			"UPDATE files SET owner_id = NULL WHERE owner_id = ?",
+			"UPDATE shares SET created_by = NULL WHERE created_by = ?",
+			"UPDATE upload_requests SET created_by = NULL WHERE created_by = ?",
+			"UPDATE api_keys SET created_by = NULL WHERE created_by = ?",
+			"DELETE FROM sessions WHERE user_id = ?",
+			"DELETE FROM recovery_codes WHERE user_id = ?",
+			"DELETE FROM users WHERE id = ?",
+		} {
+			if _, err := tx.Exec(query, id); err != nil {
+				log.Printf("Failed to delete user %d: %v", id, err)
+				http.Error(w, "Failed to delete user", http.StatusInternalServerError)
+				return
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			log.Printf("Failed to commit deletion of user %d: %v", id, err)
+			http.Error(w, "Failed to delete user", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Deleted user %q", user.Username)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "message": "User deleted."})
+	}
+}
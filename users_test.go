@@ -0,0 +1,203 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+var (
+	testAdmin    = &User{ID: 1, Username: "admin", Role: roleAdmin}
+	testMember   = &User{ID: 2, Username: "member", Role: roleMember}
+	testOther    = &User{ID: 3, Username: "other", Role: roleMember}
+	testReadOnly = &User{ID: 4, Username: "viewer", Role: roleReadOnly}
+)
+
+func TestUserCan(t *testing.T) {
+	tests := []struct {
+		user *User
+		role string
+		want bool
+	}{
+		{testAdmin, roleAdmin, true},
+		{testAdmin, roleReadOnly, true},
+		{testMember, roleAdmin, false},
+		{testMember, roleMember, true},
+		{testReadOnly, roleMember, false},
+		{testReadOnly, roleReadOnly, true},
+		{&User{Role: "unknown"}, roleReadOnly, false},
+	}
+	for _, tt := range tests {
+		if got := tt.user.can(tt.role); got != tt.want {
+			t.Errorf("%s can %s = %v, want %v", tt.user.Role, tt.role, got, tt.want)
+		}
+	}
+}
+
+func TestCheckFileAccess(t *testing.T) {
+	db := newTestDB(t)
+	owned := insertTestFile(t, db, "owned", 1, time.Now(), &testMember.ID)
+	unowned := insertTestFile(t, db, "unowned", 1, time.Now(), nil)
+
+	tests := []struct {
+		name   string
+		user   *User
+		fileID int64
+		want   error
+	}{
+		{"API client", nil, owned, nil},
+		{"admin", testAdmin, unowned, nil},
+		{"owner", testMember, owned, nil},
+		{"other member", testOther, owned, errForbidden},
+		{"member on a file without owner", testMember, unowned, errForbidden},
+		{"read-only owner", &User{ID: testMember.ID, Role: roleReadOnly}, owned, errForbidden},
+		{"missing file", testAdmin, 999, errFileNotFound},
+		{"missing file for a member", testMember, 999, errFileNotFound},
+	}
+	for _, tt := range tests {
+		if err := checkFileAccess(db, tt.user, tt.fileID); err != tt.want {
+			t.Errorf("%s: checkFileAccess = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestCheckBurnAccess(t *testing.T) {
+	db := newTestDB(t)
+	apiFile := insertTestFile(t, db, "api", 1, time.Now(), &testMember.ID)
+	res, err := db.Exec("INSERT INTO files (filename, filesize, source, owner_id) VALUES ('web', 1, 'web', ?)", testMember.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	webFile, _ := res.LastInsertId()
+	key := &apiKey{Name: "test"}
+
+	tests := []struct {
+		name   string
+		user   *User
+		key    *apiKey
+		fileID int64
+		want   error
+	}{
+		{"owner", testMember, nil, webFile, nil},
+		{"other member", testOther, nil, webFile, errForbidden},
+		{"admin", testAdmin, nil, webFile, nil},
+		{"API key on an API upload", nil, key, apiFile, nil},
+		{"API key on a web upload", nil, key, webFile, errWebUploadDelete},
+		{"API key on a missing file", nil, key, 999, errFileNotFound},
+	}
+	for _, tt := range tests {
+		if err := checkBurnAccess(db, tt.user, tt.key, tt.fileID); err != tt.want {
+			t.Errorf("%s: checkBurnAccess = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestCanManageCreated(t *testing.T) {
+	byMember := sql.NullInt64{Int64: testMember.ID, Valid: true}
+	tests := []struct {
+		name      string
+		user      *User
+		createdBy sql.NullInt64
+		want      bool
+	}{
+		{"API client", nil, byMember, true},
+		{"admin", testAdmin, byMember, true},
+		{"creator", testMember, byMember, true},
+		{"other member", testOther, byMember, false},
+		{"member on a link without creator", testMember, sql.NullInt64{}, false},
+		{"admin on a link without creator", testAdmin, sql.NullInt64{}, true},
+	}
+	for _, tt := range tests {
+		if got := canManageCreated(tt.user, tt.createdBy); got != tt.want {
+			t.Errorf("%s: canManageCreated = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCreatedByCondition(t *testing.T) {
+	db := newTestDB(t)
+	for _, createdBy := range []interface{}{testMember.ID, testMember.ID, testOther.ID, nil} {
+		if _, err := db.Exec("INSERT INTO upload_requests (token, created_by) VALUES (hex(randomblob(16)), ?)", createdBy); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		user *User
+		want int
+	}{
+		{"API client", nil, 4},
+		{"admin", testAdmin, 4},
+		{"member", testMember, 2},
+		{"other member", testOther, 1},
+		{"user without links", testReadOnly, 0},
+	}
+	for _, tt := range tests {
+		condition, args := createdByCondition(tt.user, "upload_requests.created_by")
+		var count int
+		if err := db.QueryRow("SELECT COUNT(*) FROM upload_requests WHERE "+condition, args...).Scan(&count); err != nil {
+			t.Fatal(err)
+		}
+		if count != tt.want {
+			t.Errorf("%s: sees %d links, want %d", tt.name, count, tt.want)
+		}
+	}
+}
+
+func TestResolveOwnerParam(t *testing.T) {
+	tests := []struct {
+		name    string
+		owner   string
+		user    *User
+		want    string
+		wantErr bool
+	}{
+		{"me", "me", testMember, "2", false},
+		{"me without a user", "me", nil, "", true},
+		{"explicit ID", "3", testMember, "3", false},
+		{"none", "", testMember, "", false},
+	}
+	for _, tt := range tests {
+		params := url.Values{}
+		if tt.owner != "" {
+			params.Set("owner_id", tt.owner)
+		}
+		err := resolveOwnerParam(params, tt.user)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && params.Get("owner_id") != tt.want {
+			t.Errorf("%s: owner_id = %q, want %q", tt.name, params.Get("owner_id"), tt.want)
+		}
+	}
+}
+
+func TestRequireRole(t *testing.T) {
+	handler := requireRole(roleMember, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	tests := []struct {
+		name string
+		user *User
+		want int
+	}{
+		{"API client", nil, http.StatusOK},
+		{"admin", testAdmin, http.StatusOK},
+		{"member", testMember, http.StatusOK},
+		{"read-only", testReadOnly, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		if tt.user != nil {
+			r = withUser(r, tt.user)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+}